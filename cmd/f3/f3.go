@@ -2,9 +2,11 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/spreadshirt/f3/meta"
 	"github.com/spreadshirt/f3/server"
@@ -23,9 +25,23 @@ type cliFlags struct {
 	ftpPassivePortRange string
 	features            string
 	noOverwrite         bool
+	recursiveRmDir      bool
+	softDelete          bool
+	ftpGroup            string
+	ftpHome             string
+	showUploader        bool
+	resumableUploads    bool
 	s3Credentials       string
 	s3Bucket            string
 	s3Region            string
+	s3ConditionalWrites bool
+	s3Encryption        string
+	s3KMSKeyID          string
+	s3CustomerKeyFile   string
+	encryptionKeyFile   string
+	configFile          string
+	reloadInterval      time.Duration
+	authProviders       []string
 	disableCloudwatch   bool
 	verbose             bool
 }
@@ -34,37 +50,106 @@ func main() {
 	flags := cliFlags{}
 
 	cmd := &cobra.Command{
-		Use:   fmt.Sprintf("%s /path/to/ftp-credentials.txt", os.Args[0]),
+		Use:   fmt.Sprintf("%s [/path/to/ftp-credentials.txt]", os.Args[0]),
 		Short: "f3 acts like a bridge between FTP and an s3 bucket",
 		Long: `f3 is a bridge between FTP and an s3 bucket.
 It maps FTP commands to s3 equivalents and stores uploaded files as objects in an s3 bucket.
 The feature set of the FTP server can be set very fine grained, e.g. you can only allow 'ls' and 'get' operations.
 Additionally, you can prevent objects from getting overwritten.
+The credentials file and the configuration file are reloaded on SIGHUP without interrupting active sessions.
+Uploads whose data connection fails are never stored. A data connection which is closed early but cleanly can only be
+told apart from a complete transfer if the client announces the file size with ALLO, otherwise the truncated file is stored.
 
 See https://github.com/spreadshirt/f3 for details.`,
+		Args: cobra.ArbitraryArgs,
 		Run: func(cmd *cobra.Command, args []string) {
-			if len(args) < 1 {
-				cmd.Usage()
+			if len(args) > 0 && args[0] == "version" {
+				fmt.Printf("%s %s built on %s\n", AppName, meta.Version, meta.BuildTime)
 				return
 			}
-			if args[0] == "version" {
-				fmt.Printf("%s %s built on %s\n", AppName, meta.Version, meta.BuildTime)
+			credentialsFilename := ""
+			if len(args) > 0 {
+				credentialsFilename = args[0]
+			} else if flags.usesAuthProvider(fileAuthProvider) {
+				cmd.Usage()
 				return
 			}
-			err := run(args[0], flags)
+			err := run(credentialsFilename, flags)
+			if err != nil {
+				logrus.WithFields(logrus.Fields{"msg": err}).Fatal(err)
+			}
+		},
+	}
+
+	var olderThan time.Duration
+	var dryRun bool
+	cleanupCmd := &cobra.Command{
+		Use:   "cleanup-multipart",
+		Short: "Abort incomplete multipart uploads and delete stale temporary objects of the s3 bucket",
+		Long: `Abort the incomplete multipart uploads of the s3 bucket which are older than --older-than.
+Uploads which were interrupted, e.g. because f3 was stopped during a transfer, are invisible but accrue storage costs.
+Interrupted uploads which are kept alive for --resumable-uploads can not be resumed anymore once they are aborted.
+The temporary objects of --no-overwrite uploads in .f3-tmp/ which are older than --older-than are deleted as well,
+they are left behind if f3 is stopped while it copies them to their destination.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			err := cleanupMultipart(flags, olderThan, dryRun)
+			if err != nil {
+				logrus.WithFields(logrus.Fields{"msg": err}).Fatal(err)
+			}
+		},
+	}
+	cleanupCmd.Flags().DurationVar(&olderThan, "older-than", 7*24*time.Hour, "Minimum age of the uploads to abort and the temporary objects to delete")
+	cleanupCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Only list the uploads which would be aborted and the temporary objects which would be deleted")
+	cmd.AddCommand(cleanupCmd)
+
+	var purgeOlderThan time.Duration
+	var purgeDryRun bool
+	trashCmd := &cobra.Command{
+		Use:   "trash",
+		Short: "Manage the files deleted with --ftp-soft-delete",
+		Args:  cobra.NoArgs,
+	}
+	purgeCmd := &cobra.Command{
+		Use:   "purge",
+		Short: "Permanently delete files from the trash",
+		Long: `Permanently delete the files in the trash of the s3 bucket (and of the mounted buckets) which were deleted before --older-than.
+Files deleted by users with --ftp-soft-delete are kept under the prefix '.trash/<date>/<user>/' until they are purged.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			err := purgeTrash(flags, purgeOlderThan, purgeDryRun)
 			if err != nil {
 				logrus.WithFields(logrus.Fields{"msg": err}).Fatal(err)
 			}
 		},
 	}
+	purgeCmd.Flags().DurationVar(&purgeOlderThan, "older-than", 30*24*time.Hour, "Minimum time since the files were deleted")
+	purgeCmd.Flags().BoolVar(&purgeDryRun, "dry-run", false, "Only list the files which would be deleted")
+	trashCmd.AddCommand(purgeCmd)
+	cmd.AddCommand(trashCmd)
+	cmd.AddCommand(usersCommand(os.Stdin), passwdCommand(os.Stdin))
 
 	cmd.PersistentFlags().StringVar(&flags.ftpAddr, "ftp-addr", "127.0.0.1:21", "Address of the FTP server interface, default: 127.0.0.1:21, overrides $FTP_ADDR")
 	cmd.PersistentFlags().StringVar(&flags.ftpPassivePortRange, "ftp-passive-port-range", "", "Port range to use in FTP passive mode, e.g. 1000-1002 for ports [1000, 1001, 1002], default uses a random port, overrides $FTP_PASSIVE_PORT_RANGE")
-	cmd.PersistentFlags().StringVar(&flags.features, "features", server.DefaultFeatureSet, fmt.Sprintf("Feature set, default is empty. Default: --features=%q, overrides $FTP_FEATURES", server.DefaultFeatureSet))
-	cmd.PersistentFlags().BoolVar(&flags.noOverwrite, "no-overwrite", false, "Prevent files from being overwritten")
+	cmd.PersistentFlags().StringVar(&flags.features, "features", server.DefaultFeatureSet, fmt.Sprintf("Feature set of users without own settings in the configuration file. Default: --features=%q, overrides $FTP_FEATURES", server.DefaultFeatureSet))
+	cmd.PersistentFlags().BoolVar(&flags.noOverwrite, "no-overwrite", false, "Prevent files from being overwritten by users without own settings in the configuration file. Without --s3-conditional-writes this only holds for the sessions of a single f3 instance")
+	cmd.PersistentFlags().StringVar(&flags.ftpHome, "ftp-home", server.DefaultHome, "Home directory of users as key prefix, {user} is replaced by the user name, '/' gives all users access to the whole bucket")
+	cmd.PersistentFlags().StringVar(&flags.ftpGroup, "ftp-group", "", "Group name reported for all files and directories")
+	cmd.PersistentFlags().BoolVar(&flags.showUploader, "ftp-show-uploader", false, "List the uploading FTP user as owner of files, requires a HEAD request per listed file")
+	cmd.PersistentFlags().BoolVar(&flags.recursiveRmDir, "recursive-rmdir", false, "Allow 'rmdir' to delete non-empty directories including all of their contents")
+	cmd.PersistentFlags().BoolVar(&flags.softDelete, "ftp-soft-delete", false, "Move files deleted with 'rm' to the trash, from which users can restore them with 'SITE RESTORE <path>'")
+	cmd.PersistentFlags().BoolVar(&flags.resumableUploads, "resumable-uploads", false, "Keep interrupted uploads alive, so that they can be resumed by the same user with 'REST' and 'STOR'. Only files larger than one part (5 MiB) are uploaded resumably")
 	cmd.PersistentFlags().StringVar(&flags.s3Credentials, "s3-credentials", "", "AccessKey:SecretKey, overrides $S3_CREDENTIALS")
 	cmd.PersistentFlags().StringVar(&flags.s3Bucket, "s3-bucket", "", "URL of the s3 bucket, e.g. https://some-bucket.s3.amazonaws.com, overrides $S3_BUCKET")
 	cmd.PersistentFlags().StringVar(&flags.s3Region, "s3-region", server.DefaultRegion, "Region where the s3 bucket is located in, overrides $S3_REGION")
+	cmd.PersistentFlags().BoolVar(&flags.s3ConditionalWrites, "s3-conditional-writes", false, "Enforce --no-overwrite with conditional writes ('If-None-Match: *') of uploads, renames and restores, requires support by the s3 endpoint.")
+	cmd.PersistentFlags().StringVar(&flags.s3Encryption, "s3-sse", "", fmt.Sprintf("Server-side encryption of uploaded objects: %q, %q or %q, default uses the bucket's default encryption", server.SSES3, server.SSEKMS, server.SSEC))
+	cmd.PersistentFlags().StringVar(&flags.s3KMSKeyID, "s3-sse-kms-key-id", "", fmt.Sprintf("ID of the KMS key for %s, default uses the account's default key", server.SSEKMS))
+	cmd.PersistentFlags().StringVar(&flags.s3CustomerKeyFile, "s3-sse-c-key-file", "", fmt.Sprintf("File containing the 256 bit key for %s, raw or base64 encoded", server.SSEC))
+	cmd.PersistentFlags().StringVar(&flags.encryptionKeyFile, "encryption-key-file", "", "File containing the 256 bit master key, raw or base64 encoded, to encrypt objects before they are uploaded, disables appending to objects. Listings require a HEAD request per listed file to tell encrypted files apart")
+	cmd.PersistentFlags().StringVar(&flags.configFile, "config", "", "JSON configuration file, e.g. with upload rules. Once it defines any access rule, operations which no access rule allows are denied to all users")
+	cmd.PersistentFlags().StringSliceVar(&flags.authProviders, "auth", []string{fileAuthProvider, configAuthProvider}, "Comma separated auth providers, which are asked in order: 'file' for the credentials file, 'config' for the users with a password in the configuration file, 'ldap' for the users of the LDAP server of the configuration file")
+	cmd.PersistentFlags().DurationVar(&flags.reloadInterval, "reload-interval", 0, "Interval in which the credentials file and the configuration file are checked for changes and reloaded, 0 only reloads them on SIGHUP")
 	cmd.PersistentFlags().BoolVar(&flags.disableCloudwatch, "disable-cloudwatch", false, "Disable CloudWatch metrics")
 	cmd.PersistentFlags().BoolVarP(&flags.verbose, "verbose", "v", false, "Print what is being done")
 
@@ -79,33 +164,28 @@ func run(credentialsFilename string, flags cliFlags) error {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
 
-	logrus.Debugf("Trying to read credentials file: %q", credentialsFilename)
-	creds, err := server.AuthenticatorFromFile(credentialsFilename)
-	if err != nil {
-		return errors.Wrapf(err, "Failed to read credentials file %q", credentialsFilename)
-	}
-
 	ftpAddr := getEnvOrDefault("FTP_ADDR", flags.ftpAddr)
 	ftpHost, ftpPort, err := splitFtpAddr(ftpAddr)
 	if err != nil {
 		return errors.Wrapf(err, "Failed to split %q in host and port", ftpAddr)
 	}
 
-	factory, err := server.NewDriverFactory(&server.FactoryConfig{
-		FtpFeatures:       getEnvOrDefault("FTP_FEATURES", flags.features),
-		FtpNoOverwrite:    flags.noOverwrite,
-		S3Credentials:     getEnvOrDefault("S3_CREDENTIALS", flags.s3Credentials),
-		S3BucketURL:       getEnvOrDefault("S3_BUCKET", flags.s3Bucket),
-		S3Region:          getEnvOrDefault("S3_REGION", flags.s3Region),
-		DisableCloudWatch: flags.disableCloudwatch,
-	})
+	factory, err := server.NewDriverFactory(factoryConfig(flags))
 	if err != nil {
 		return errors.Wrapf(err, "Failed to instantiate new driver factory")
 	}
+	provider, err := newAuthProvider(factory, flags, credentialsFilename)
+	if err != nil {
+		return err
+	}
+	if err := factory.SetAuthProvider(provider); err != nil {
+		return err
+	}
+	go reloadOnChange(factory, flags, credentialsFilename)
 
 	serverOpts := ftp.ServerOpts{
 		Factory:        factory,
-		Auth:           creds,
+		Auth:           factory.Auth(),
 		Name:           AppName,
 		Hostname:       ftpHost,
 		Port:           ftpPort,
@@ -116,8 +196,141 @@ func run(credentialsFilename string, flags cliFlags) error {
 	logrus.Debugf("Server options: %#v\n", serverOpts)
 
 	ftpServer := ftp.NewServer(&serverOpts)
+	listener, err := net.Listen("tcp", net.JoinHostPort(ftpHost, strconv.Itoa(ftpPort)))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to listen on \"%s:%d\"", ftpHost, ftpPort)
+	}
 	logrus.Infof("FTP server starts listening on \"%s:%d\"", ftpHost, ftpPort)
-	return ftpServer.ListenAndServe()
+	return ftpServer.Serve(factory.Listener(listener))
+}
+
+// Names of the auth providers of --auth.
+const (
+	fileAuthProvider   = "file"
+	configAuthProvider = "config"
+	ldapAuthProvider   = "ldap"
+)
+
+// usesAuthProvider returns true if --auth contains the provider `name`.
+func (f cliFlags) usesAuthProvider(name string) bool {
+	for _, provider := range f.authProviders {
+		if provider == name {
+			return true
+		}
+	}
+	return false
+}
+
+// newAuthProvider returns the chain of the auth providers of --auth, see server.AuthChain.
+func newAuthProvider(factory server.DriverFactory, flags cliFlags, credentialsFilename string) (server.AuthProvider, error) {
+	chain := server.AuthChain{}
+	for _, name := range flags.authProviders {
+		switch name {
+		case fileAuthProvider:
+			creds, err := readCredentials(credentialsFilename)
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, creds)
+		case configAuthProvider:
+			chain = append(chain, factory.ConfigProvider())
+		case ldapAuthProvider:
+			chain = append(chain, factory.LDAPProvider())
+		default:
+			return nil, fmt.Errorf("Unknown auth provider %q", name)
+		}
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("No auth provider")
+	}
+	return chain, nil
+}
+
+// readCredentials reads the credentials file `credentialsFilename` and warns about plaintext passwords.
+func readCredentials(credentialsFilename string) (server.Authenticator, error) {
+	logrus.Debugf("Trying to read credentials file: %q", credentialsFilename)
+	creds, err := server.AuthenticatorFromFile(credentialsFilename)
+	if err != nil {
+		return creds, errors.Wrapf(err, "Failed to read credentials file %q", credentialsFilename)
+	}
+	if users := creds.PlaintextUsers(); len(users) > 0 {
+		logrus.WithFields(logrus.Fields{"users": strings.Join(users, ",")}).Warnf("Credentials file %q contains plaintext passwords, replace them by hashes", credentialsFilename)
+	}
+	return creds, nil
+}
+
+func factoryConfig(flags cliFlags) *server.FactoryConfig {
+	return &server.FactoryConfig{
+		FtpFeatures:         getEnvOrDefault("FTP_FEATURES", flags.features),
+		FtpNoOverwrite:      flags.noOverwrite,
+		FtpRecursiveRmDir:   flags.recursiveRmDir,
+		FtpSoftDelete:       flags.softDelete,
+		FtpGroup:            flags.ftpGroup,
+		FtpHome:             flags.ftpHome,
+		FtpShowUploader:     flags.showUploader,
+		FtpResumableUploads: flags.resumableUploads,
+		S3Credentials:       getEnvOrDefault("S3_CREDENTIALS", flags.s3Credentials),
+		S3BucketURL:         getEnvOrDefault("S3_BUCKET", flags.s3Bucket),
+		S3Region:            getEnvOrDefault("S3_REGION", flags.s3Region),
+		S3ConditionalWrites: flags.s3ConditionalWrites,
+		S3Encryption:        flags.s3Encryption,
+		S3KMSKeyID:          flags.s3KMSKeyID,
+		S3CustomerKeyFile:   flags.s3CustomerKeyFile,
+		EncryptionKeyFile:   flags.encryptionKeyFile,
+		ConfigFile:          flags.configFile,
+		DisableCloudWatch:   flags.disableCloudwatch,
+	}
+}
+
+func cleanupMultipart(flags cliFlags, olderThan time.Duration, dryRun bool) error {
+	if flags.verbose {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	factory, err := server.NewDriverFactory(factoryConfig(flags))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to instantiate new driver factory")
+	}
+	count, err := factory.AbortStaleUploads(olderThan, dryRun)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		fmt.Printf("Found %d incomplete uploads older than %s\n", count, olderThan)
+	} else {
+		fmt.Printf("Aborted %d incomplete uploads older than %s\n", count, olderThan)
+	}
+	count, err = factory.DeleteStaleTemporaryObjects(olderThan, dryRun)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		fmt.Printf("Found %d temporary objects older than %s\n", count, olderThan)
+	} else {
+		fmt.Printf("Deleted %d temporary objects older than %s\n", count, olderThan)
+	}
+	return nil
+}
+
+func purgeTrash(flags cliFlags, olderThan time.Duration, dryRun bool) error {
+	if flags.verbose {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	factory, err := server.NewDriverFactory(factoryConfig(flags))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to instantiate new driver factory")
+	}
+	count, err := factory.PurgeTrash(olderThan, dryRun)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		fmt.Printf("Found %d files deleted more than %s ago\n", count, olderThan)
+	} else {
+		fmt.Printf("Purged %d files deleted more than %s ago\n", count, olderThan)
+	}
+	return nil
 }
 
 func splitFtpAddr(addr string) (string, int, error) {
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spreadshirt/f3/server"
+
+	"github.com/sirupsen/logrus"
+)
+
+// reloadOnChange reloads the credentials file and the configuration file on SIGHUP
+// and, if --reload-interval is positive, whenever a change of either file is noticed by checking them in that interval.
+// Invalid files are logged and the current settings are kept.
+func reloadOnChange(factory server.DriverFactory, flags cliFlags, credentialsFilename string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	var ticks <-chan time.Time
+	if flags.reloadInterval > 0 {
+		ticker := time.NewTicker(flags.reloadInterval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+	files := []string{}
+	for _, file := range []string{credentialsFilename, flags.configFile} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	stamp := fileStamp(files)
+	for {
+		select {
+		case <-signals:
+			logrus.Infof("Received SIGHUP, reloading %q", files)
+		case <-ticks:
+			if fileStamp(files) == stamp {
+				continue
+			}
+			logrus.Infof("Reloading the changed files %q", files)
+		}
+		stamp = fileStamp(files)
+		if err := reload(factory, flags, credentialsFilename); err != nil {
+			logrus.WithFields(logrus.Fields{"error": err}).Errorf("Failed to reload, keeping the current settings")
+			continue
+		}
+		logrus.Infof("Reloaded %q", files)
+	}
+}
+
+// reload recreates the auth providers, e.g. by reading the credentials file `credentialsFilename`, and reloads the settings of `factory`.
+func reload(factory server.DriverFactory, flags cliFlags, credentialsFilename string) error {
+	provider, err := newAuthProvider(factory, flags, credentialsFilename)
+	if err != nil {
+		return err
+	}
+	return factory.Reload(provider)
+}
+
+// fileStamp returns a string which changes whenever any of the files `files` is modified, created or removed.
+func fileStamp(files []string) string {
+	stamp := ""
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			stamp += fmt.Sprintf("%s:%v;", file, err)
+			continue
+		}
+		stamp += fmt.Sprintf("%s:%d:%d;", file, info.ModTime().UnixNano(), info.Size())
+	}
+	return stamp
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spreadshirt/f3/server"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// DefaultCredentialsFile is the credentials file edited by `f3 users` and `f3 passwd` by default.
+const DefaultCredentialsFile = "/etc/f3/ftp-credentials.txt"
+
+// userAttributes are the flags of `f3 users add` and `f3 users modify`.
+type userAttributes struct {
+	home    string
+	groups  []string
+	expires string
+}
+
+// apply sets the attributes of `entry` whose flags were given to `cmd`.
+func (a userAttributes) apply(cmd *cobra.Command, entry *server.CredentialsEntry) error {
+	if cmd.Flags().Changed("home") {
+		entry.Home = a.home
+	}
+	if cmd.Flags().Changed("groups") {
+		entry.Groups = a.groups
+	}
+	if cmd.Flags().Changed("expires") {
+		entry.Expires = time.Time{}
+		if a.expires != "" {
+			expires, err := time.Parse("2006-01-02", a.expires)
+			if err != nil {
+				return fmt.Errorf("Invalid expiry date %q, expected format YYYY-MM-DD", a.expires)
+			}
+			entry.Expires = expires
+		}
+	}
+	return nil
+}
+
+func (a *userAttributes) addFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&a.home, "home", "", "Home directory of the user as key prefix, overrides --ftp-home")
+	cmd.Flags().StringSliceVar(&a.groups, "groups", nil, "Comma separated groups of the user, which must be defined in the configuration file")
+	cmd.Flags().StringVar(&a.expires, "expires", "", "Date in format YYYY-MM-DD from which on the user can not log in anymore, empty for no expiry")
+}
+
+// usersCommand returns the `f3 users` command, which manages the users in the credentials file.
+// Passwords are read from `stdin`.
+func usersCommand(stdin *os.File) *cobra.Command {
+	var credentialsFile string
+	var passwordStdin bool
+	var attributes userAttributes
+
+	usersCmd := &cobra.Command{
+		Use:   "users",
+		Short: "Manage the users in the credentials file",
+		Long: `Manage the users in the credentials file.
+Passwords are stored as argon2id hashes, locked users are marked by a '!' in front of their hash.
+The file is replaced atomically and keeps its permissions, lines without credentials are kept as they are.`,
+		Args: cobra.NoArgs,
+	}
+	usersCmd.PersistentFlags().StringVar(&credentialsFile, "credentials", DefaultCredentialsFile, "Credentials file")
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the users",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			fatalOnError(listUsers(cmd.OutOrStdout(), credentialsFile, time.Now()))
+		},
+	}
+
+	addCmd := &cobra.Command{
+		Use:   "add <user>",
+		Short: "Add a user, prompting for the password",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			fatalOnError(server.EditCredentialsFile(credentialsFile, func(file *server.CredentialsFile) error {
+				if _, ok := file.Entry(args[0]); ok {
+					return fmt.Errorf("User %q exists already", args[0])
+				}
+				entry := server.CredentialsEntry{User: args[0]}
+				if err := attributes.apply(cmd, &entry); err != nil {
+					return err
+				}
+				hash, err := newPasswordHash(stdin, passwordStdin)
+				if err != nil {
+					return err
+				}
+				entry.Password = hash
+				return file.Put(entry)
+			}))
+		},
+	}
+	attributes.addFlags(addCmd)
+	addCmd.Flags().BoolVar(&passwordStdin, "password-stdin", false, "Read the password from the first line of the standard input")
+
+	modifyCmd := &cobra.Command{
+		Use:   "modify <user>",
+		Short: "Change the attributes of a user",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			fatalOnError(editUser(credentialsFile, args[0], func(entry *server.CredentialsEntry) error {
+				return attributes.apply(cmd, entry)
+			}))
+		},
+	}
+	attributes.addFlags(modifyCmd)
+
+	removeCmd := &cobra.Command{
+		Use:   "remove <user>",
+		Short: "Remove a user",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			fatalOnError(server.EditCredentialsFile(credentialsFile, func(file *server.CredentialsFile) error {
+				if !file.Remove(args[0]) {
+					return fmt.Errorf("Unknown user %q", args[0])
+				}
+				return nil
+			}))
+		},
+	}
+
+	lockCmd := &cobra.Command{
+		Use:   "lock <user>",
+		Short: "Prevent a user from logging in",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			fatalOnError(editUser(credentialsFile, args[0], func(entry *server.CredentialsEntry) error {
+				entry.Locked = true
+				return nil
+			}))
+		},
+	}
+
+	unlockCmd := &cobra.Command{
+		Use:   "unlock <user>",
+		Short: "Allow a locked user to log in again",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			fatalOnError(editUser(credentialsFile, args[0], func(entry *server.CredentialsEntry) error {
+				entry.Locked = false
+				return nil
+			}))
+		},
+	}
+
+	usersCmd.AddCommand(listCmd, addCmd, modifyCmd, removeCmd, lockCmd, unlockCmd)
+	return usersCmd
+}
+
+// passwdCommand returns the `f3 passwd` command, which sets the password of a user in the credentials file.
+// The password is read from `stdin`.
+func passwdCommand(stdin *os.File) *cobra.Command {
+	var credentialsFile string
+	var passwordStdin bool
+	passwdCmd := &cobra.Command{
+		Use:   "passwd <user>",
+		Short: "Set the password of a user in the credentials file, prompting for it",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			fatalOnError(editUser(credentialsFile, args[0], func(entry *server.CredentialsEntry) error {
+				hash, err := newPasswordHash(stdin, passwordStdin)
+				if err != nil {
+					return err
+				}
+				entry.Password = hash
+				return nil
+			}))
+		},
+	}
+	passwdCmd.Flags().StringVar(&credentialsFile, "credentials", DefaultCredentialsFile, "Credentials file")
+	passwdCmd.Flags().BoolVar(&passwordStdin, "password-stdin", false, "Read the password from the first line of the standard input")
+	return passwdCmd
+}
+
+func fatalOnError(err error) {
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"msg": err}).Fatal(err)
+	}
+}
+
+// editUser applies `edit` to the credentials of the existing user `user` in the credentials file `path` and saves it.
+func editUser(path, user string, edit func(*server.CredentialsEntry) error) error {
+	return server.EditCredentialsFile(path, func(file *server.CredentialsFile) error {
+		entry, ok := file.Entry(user)
+		if !ok {
+			return fmt.Errorf("Unknown user %q", user)
+		}
+		if err := edit(&entry); err != nil {
+			return err
+		}
+		return file.Put(entry)
+	})
+}
+
+// listUsers writes a table of the users in the credentials file `path` to `w`.
+func listUsers(w io.Writer, path string, now time.Time) error {
+	file, err := server.OpenCredentialsFile(path)
+	if err != nil {
+		return err
+	}
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "USER\tSTATUS\tHOME\tGROUPS\tEXPIRES")
+	for _, entry := range file.Entries() {
+		status := "active"
+		switch {
+		case entry.Locked:
+			status = "locked"
+		case entry.Expired(now):
+			status = "expired"
+		case !entry.Hashed():
+			status = "plaintext"
+		}
+		expires := ""
+		if !entry.Expires.IsZero() {
+			expires = entry.Expires.Format("2006-01-02")
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\n", entry.User, status, entry.Home, strings.Join(entry.Groups, ","), expires)
+	}
+	return table.Flush()
+}
+
+// newPasswordHash reads a new password from the standard input `stdin`, either its first line if `fromStdin` is set,
+// or by prompting twice without echo, and returns its hash.
+func newPasswordHash(stdin *os.File, fromStdin bool) (string, error) {
+	var password string
+	if fromStdin {
+		line, err := bufio.NewReader(stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", errors.Wrapf(err, "Failed to read the password")
+		}
+		password = strings.TrimRight(line, "\r\n")
+	} else {
+		fd := int(stdin.Fd())
+		if !terminal.IsTerminal(fd) {
+			return "", fmt.Errorf("Standard input is not a terminal, use --password-stdin")
+		}
+		fmt.Fprint(os.Stderr, "New password: ")
+		first, err := terminal.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", errors.Wrapf(err, "Failed to read the password")
+		}
+		fmt.Fprint(os.Stderr, "Retype new password: ")
+		second, err := terminal.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", errors.Wrapf(err, "Failed to read the password")
+		}
+		if string(first) != string(second) {
+			return "", fmt.Errorf("Passwords do not match")
+		}
+		password = string(first)
+	}
+	if password == "" {
+		return "", fmt.Errorf("Empty password")
+	}
+	return server.HashPassword(password)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spreadshirt/f3/server"
+
+	"github.com/spf13/cobra"
+)
+
+// execute runs `cmd` with the arguments `args` and returns its output.
+func execute(t *testing.T, cmd *cobra.Command, args ...string) string {
+	var output bytes.Buffer
+	cmd.SetOutput(&output)
+	cmd.SetArgs(args)
+	if err := cmd.Execute(); err != nil {
+		t.Fatalf("%v: %s", args, err)
+	}
+	return output.String()
+}
+
+// passwordInput returns a standard input which contains `input`.
+func passwordInput(t *testing.T, dir, input string) *os.File {
+	path := filepath.Join(dir, "stdin")
+	if err := ioutil.WriteFile(path, []byte(input), 0600); err != nil {
+		t.Fatal(err)
+	}
+	stdin, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stdin
+}
+
+func TestUsersCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "f3-users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ftp-credentials.txt")
+	if err := ioutil.WriteFile(path, []byte("# FTP users\nlegacy:secret\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, 0640); err != nil {
+		t.Fatal(err)
+	}
+	entry := func(user string) server.CredentialsEntry {
+		file, err := server.OpenCredentialsFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry, ok := file.Entry(user)
+		if !ok {
+			t.Fatalf("Expected user %s in the credentials file", user)
+		}
+		return entry
+	}
+	checkPasswd := func(user, password string) bool {
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		auth, err := server.AuthenticatorFromString(string(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok, _ := auth.CheckPasswd(user, password)
+		return ok
+	}
+
+	stdin := passwordInput(t, dir, "first\n")
+	execute(t, usersCommand(stdin), "add", "alice", "--credentials", path, "--password-stdin",
+		"--home", "partners/{user}/", "--groups", "partners,uploaders", "--expires", "2030-01-31")
+	stdin.Close()
+	expected := server.CredentialsEntry{
+		User:     "alice",
+		Password: entry("alice").Password,
+		Home:     "partners/{user}/",
+		Groups:   []string{"partners", "uploaders"},
+		Expires:  time.Date(2030, 1, 31, 0, 0, 0, 0, time.UTC),
+	}
+	if actual := entry("alice"); !reflect.DeepEqual(actual, expected) || !actual.Hashed() {
+		t.Errorf("Expected the added user %+v but was %+v", expected, actual)
+	}
+	if !checkPasswd("alice", "first") {
+		t.Errorf("Expected the password of the added user to be valid")
+	}
+
+	execute(t, usersCommand(os.Stdin), "modify", "alice", "--credentials", path, "--home", "other/", "--expires", "")
+	expected.Home, expected.Expires = "other/", time.Time{}
+	if actual := entry("alice"); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected only the given attributes to be modified to %+v but was %+v", expected, actual)
+	}
+
+	execute(t, usersCommand(os.Stdin), "lock", "alice", "--credentials", path)
+	if !entry("alice").Locked || checkPasswd("alice", "first") {
+		t.Errorf("Expected the user to be locked")
+	}
+	output := execute(t, usersCommand(os.Stdin), "list", "--credentials", path)
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) != 3 || strings.Fields(lines[1])[0] != "alice" || strings.Fields(lines[1])[1] != "locked" || strings.Fields(lines[2])[1] != "plaintext" {
+		t.Errorf("Unexpected list of users:\n%s", output)
+	}
+
+	stdin = passwordInput(t, dir, "second\r\n")
+	execute(t, passwdCommand(stdin), "alice", "--credentials", path, "--password-stdin")
+	stdin.Close()
+	execute(t, usersCommand(os.Stdin), "unlock", "alice", "--credentials", path)
+	if checkPasswd("alice", "first") || !checkPasswd("alice", "second") {
+		t.Errorf("Expected the password to be changed")
+	}
+
+	execute(t, usersCommand(os.Stdin), "remove", "legacy", "--credentials", path)
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(raw), "# FTP users\nalice:$argon2id$") || strings.Contains(string(raw), "legacy") {
+		t.Errorf("Unexpected credentials file %q", raw)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("Expected the permissions of the file to be kept: %v %v", info.Mode(), err)
+	}
+
+	if err := editUser(path, "bob", func(*server.CredentialsEntry) error { return nil }); err == nil {
+		t.Errorf("Expected unknown users not to be edited")
+	}
+	if _, err := newPasswordHash(passwordInput(t, dir, "\n"), true); err == nil {
+		t.Errorf("Expected an empty password to be rejected")
+	}
+	if _, err := newPasswordHash(passwordInput(t, dir, "secret\n"), false); err == nil {
+		t.Errorf("Expected prompting to require a terminal")
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "f3-users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ftp-credentials.txt")
+	hash, err := server.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials := "carol:" + hash + ":expires=2020-01-01\nbob:!" + hash + "\nalice:" + hash + ":home=partners/:groups=a,b\ndave:secret\n"
+	if err := ioutil.WriteFile(path, []byte(credentials), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var output bytes.Buffer
+	if err := listUsers(&output, path, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{
+		{"USER", "STATUS", "HOME", "GROUPS", "EXPIRES"},
+		{"alice", "active", "partners/", "a,b"},
+		{"bob", "locked"},
+		{"carol", "expired", "2020-01-01"},
+		{"dave", "plaintext"},
+	}
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %d lines but was:\n%s", len(expected), output.String())
+	}
+	for i, line := range lines {
+		if fields := strings.Fields(line); !reflect.DeepEqual(fields, expected[i]) {
+			t.Errorf("Expected line %d to be %v but was %v", i, expected[i], fields)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"fmt"
+	pathpkg "path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// allFeatures are the operations of the feature set `*` of access rules.
+const allFeatures = featureChangeDir | featureList | featureRemoveDir | featureRemove | featureMove | featureMakeDir | featureGet | featurePut
+
+// AccessRule allows or denies operations on paths to users, e.g.
+//
+//	{"user": "acme", "path": "/incoming/**", "allow": "put"}
+//	{"user": "acme", "path": "/incoming/secret/**", "deny": "*"}
+//
+// Deny rules win: an operation is allowed if an allow rule matches it and no deny rule does, regardless of the order of the rules.
+// Once any rule is defined, users may only perform the operations which a rule allows them.
+// Removing or moving a directory requires the operation to be allowed for everything below it, too.
+// Paths are FTP paths as seen by users, i.e. relative to their home directory.
+type AccessRule struct {
+	// User restricts the rule to the user with this name
+	User string `json:"user,omitempty"`
+	// Group restricts the rule to the members of the group with this name
+	Group string `json:"group,omitempty"`
+	// Path is an absolute glob pattern, where `**` matches any number of directories and `{user}` is replaced by the user name
+	Path string `json:"path"`
+	// Allow is the feature set of the allowed operations, e.g. `ls,get`, or `*` for all operations
+	Allow string `json:"allow,omitempty"`
+	// Deny is the feature set of the denied operations, e.g. `rm,rmdir`, or `*` for all operations
+	Deny string `json:"deny,omitempty"`
+}
+
+func (r AccessRule) validate() error {
+	if !strings.HasPrefix(r.Path, "/") {
+		return fmt.Errorf("path %q is not absolute", r.Path)
+	}
+	for _, element := range splitPath(r.Path) {
+		if _, err := pathpkg.Match(element, ""); err != nil {
+			return fmt.Errorf("invalid path %q", r.Path)
+		}
+	}
+	if (r.Allow == "") == (r.Deny == "") {
+		return fmt.Errorf("either allow or deny must be set")
+	}
+	_, err := parseAccessFeatures(r.Allow + r.Deny)
+	return err
+}
+
+// parseAccessFeatures parses the feature set of an access rule, which may be `*` for all features.
+func parseAccessFeatures(featureSet string) (int, error) {
+	if strings.TrimSpace(featureSet) == "*" {
+		return allFeatures, nil
+	}
+	return parseFeatureSet(featureSet)
+}
+
+// matches returns true if the rule applies to the operation `feature` of `username`, who is a member of `groups`, on `p`.
+func (r AccessRule) matches(username string, groups []string, feature int, p string) bool {
+	if r.User != "" && r.User != username {
+		return false
+	}
+	if r.Group != "" && !contains(groups, r.Group) {
+		return false
+	}
+	features, err := parseAccessFeatures(r.Allow + r.Deny)
+	if err != nil || features&feature == 0 {
+		return false
+	}
+	pattern := strings.Replace(r.Path, "{user}", escapeGlob(username), -1)
+	return matchPathGlob(splitPath(pattern), splitPath(p))
+}
+
+// accessAllowed evaluates the access `rules` for the operation `feature` of `username`, who is a member of `groups`,
+// on the absolute path `p`. Any matching deny rule denies the operation, otherwise a matching allow rule allows it.
+// Operations which no rule allows are denied. Without any rules, all operations are allowed.
+func accessAllowed(rules []AccessRule, username string, groups []string, feature int, p string) bool {
+	if len(rules) == 0 {
+		return true
+	}
+	allowed := false
+	for _, rule := range rules {
+		if rule.matches(username, groups, feature, p) {
+			if rule.Deny != "" {
+				return false
+			}
+			allowed = true
+		}
+	}
+	return allowed
+}
+
+// matchPathGlob returns true if the path elements `elements` match the glob pattern elements `pattern`.
+// Elements are matched by path.Match except for `**`, which matches any number of elements including none.
+func matchPathGlob(pattern, elements []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(elements); i++ {
+				if matchPathGlob(pattern[1:], elements[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(elements) == 0 {
+			return false
+		}
+		if ok, _ := pathpkg.Match(pattern[0], elements[0]); !ok {
+			return false
+		}
+		pattern, elements = pattern[1:], elements[1:]
+	}
+	return len(elements) == 0
+}
+
+// splitPath returns the elements of the path `p`.
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// escapeGlob escapes the characters of `s` which have a special meaning in glob patterns.
+func escapeGlob(s string) string {
+	var escaped strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]\`, c) {
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(c)
+	}
+	return escaped.String()
+}
+
+// checkAccess returns an error if the access rules deny the operation `feature` on `path` to the logged in user.
+// Directories reserved for the driver, e.g. the trash, are never accessible.
+func (d *S3Driver) checkAccess(feature int, path string) error {
+	p := d.resolvePath(path)
+	if d.isReserved(path) {
+		logrus.WithFields(logrus.Fields{"user": d.user(), "path": p}).Warn("Access to reserved directory denied")
+		return fmt.Errorf("%q: access denied", p)
+	}
+	if d.accessAllowed(feature, p) {
+		return nil
+	}
+	logrus.WithFields(logrus.Fields{"user": d.user(), "path": p}).Warn("Access denied by access rules")
+	return fmt.Errorf("%q: access denied", p)
+}
+
+// accessible returns true if the access rules allow any operation on `path` to the logged in user.
+func (d *S3Driver) accessible(path string) bool {
+	if d.isReserved(path) {
+		return false
+	}
+	p := d.resolvePath(path)
+	for feature := 1; feature <= allFeatures; feature <<= 1 {
+		if d.accessAllowed(feature, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *S3Driver) accessAllowed(feature int, p string) bool {
+	if d.config == nil {
+		return true
+	}
+	user, _ := d.config.user(d.user())
+	return accessAllowed(d.config.AccessRules, d.user(), user.Groups, feature, p)
+}
+
+// checkPrefixAccess returns an error if `check` returns one for any object below the key prefix `prefix` of a directory,
+// which is called with the path of the object relative to the directory and whether the object is a directory marker.
+// Without access rules, the objects are not listed.
+func (d *S3Driver) checkPrefixAccess(prefix string, check func(relative string, dir bool) error) error {
+	if d.config == nil || len(d.config.AccessRules) == 0 {
+		return nil
+	}
+	var denied error
+	err := d.walkPrefix(prefix, "", func(page *s3.ListObjectsV2Output) error {
+		for _, object := range page.Contents {
+			key := aws.StringValue(object.Key)
+			relative := strings.TrimSuffix(strings.TrimPrefix(key, prefix), "/")
+			if relative == "" {
+				continue
+			}
+			if denied = check(relative, strings.HasSuffix(key, "/")); denied != nil {
+				return denied
+			}
+		}
+		return nil
+	})
+	if denied != nil {
+		return denied
+	}
+	return errors.Wrapf(err, "Failed to list %q", d.fqdn(prefix))
+}
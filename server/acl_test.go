@@ -0,0 +1,208 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestMatchPathGlob(t *testing.T) {
+	for _, testData := range []struct {
+		pattern  string
+		path     string
+		expected bool
+	}{
+		{"/", "/", true},
+		{"/", "/file.txt", false},
+		{"/**", "/", true},
+		{"/**", "/a/b/c.txt", true},
+		{"/incoming/**", "/incoming", true},
+		{"/incoming/**", "/incoming/a/b.txt", true},
+		{"/incoming/**", "/incoming.txt", false},
+		{"/incoming/*", "/incoming/a.txt", true},
+		{"/incoming/*", "/incoming/a/b.txt", false},
+		{"/**/*.csv", "/a/b/c.csv", true},
+		{"/**/*.csv", "/c.csv", true},
+		{"/**/*.csv", "/a/b/c.txt", false},
+		{"/a/**/z", "/a/z", true},
+		{"/a/**/z", "/a/b/c/z", true},
+		{"/a/**/z", "/a/b/c/z/d", false},
+	} {
+		if actual := matchPathGlob(splitPath(testData.pattern), splitPath(testData.path)); actual != testData.expected {
+			t.Errorf("Expected match of %q by %q to be %v", testData.path, testData.pattern, testData.expected)
+		}
+	}
+}
+
+func TestAccessAllowed(t *testing.T) {
+	rules := []AccessRule{
+		{User: "acme", Path: "/incoming/**", Allow: "put"},
+		{User: "acme", Path: "/incoming/secret/**", Deny: "*"},
+		{User: "acme", Path: "/outgoing/**", Allow: "ls,get"},
+		{Group: "staff", Path: "/private/**", Deny: "rm,rmdir"},
+		{Group: "staff", Path: "/**", Allow: "*"},
+		{Path: "/users/{user}/**", Allow: "*"},
+	}
+	for _, testData := range []struct {
+		user     string
+		groups   []string
+		feature  int
+		path     string
+		expected bool
+	}{
+		{"acme", nil, featurePut, "/incoming/data.csv", true},
+		{"acme", nil, featurePut, "/incoming/secret/data.csv", false},
+		{"acme", nil, featureGet, "/incoming/data.csv", false},
+		{"acme", nil, featureGet, "/outgoing/report.pdf", true},
+		{"acme", nil, featureList, "/outgoing", true},
+		{"acme", nil, featurePut, "/outgoing/report.pdf", false},
+		{"acme", nil, featureList, "/", false},
+		{"acme", nil, featurePut, "/incoming.csv", false},
+		{"bob", []string{"staff"}, featureRemove, "/private/notes.txt", false},
+		{"bob", []string{"staff"}, featurePut, "/private/notes.txt", true},
+		{"bob", []string{"staff"}, featureRemove, "/public/notes.txt", true},
+		{"bob", nil, featureRemove, "/private/notes.txt", false},
+		{"bob", nil, featurePut, "/users/bob/file.txt", true},
+		{"bob", nil, featureGet, "/users/alice/file.txt", false},
+		{"b*", nil, featureGet, "/users/bob/file.txt", false},
+		{"b*", nil, featureGet, "/users/b*/file.txt", true},
+	} {
+		if actual := accessAllowed(rules, testData.user, testData.groups, testData.feature, testData.path); actual != testData.expected {
+			t.Errorf("Expected access of %q to %q with feature %b to be %v", testData.user, testData.path, testData.feature, testData.expected)
+		}
+	}
+	if !accessAllowed(nil, "anyone", nil, featureRemove, "/file.txt") {
+		t.Errorf("Expected access without rules")
+	}
+	if accessAllowed(rules[:1], "anyone", nil, featureRemove, "/file.txt") {
+		t.Errorf("Expected access to be denied if no rule matches")
+	}
+
+	for _, rule := range []AccessRule{
+		{Path: "relative/**", Allow: "get"},
+		{Path: "/[", Allow: "get"},
+		{Path: "/**"},
+		{Path: "/**", Allow: "get", Deny: "put"},
+		{Path: "/**", Allow: "fly"},
+	} {
+		if err := rule.validate(); err == nil {
+			t.Errorf("Expected %+v to be invalid", rule)
+		}
+	}
+}
+
+func TestAccessRules(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucket := newBucketMock(bucketName)
+	for _, key := range []string{"incoming/", "outgoing/report.txt", "outgoing/private/plan.txt", "secret.txt"} {
+		bucket.Put(key, objectMock{data: []byte(key), lastMod: time.Now(), etag: key})
+	}
+	config := &Config{AccessRules: []AccessRule{
+		{User: "acme", Path: "/", Allow: "cd,ls"},
+		{User: "acme", Path: "/incoming/**", Allow: "cd,ls,put"},
+		{User: "acme", Path: "/outgoing/**", Allow: "cd,ls,get"},
+		{User: "acme", Path: "/outgoing/private/**", Deny: "*"},
+	}}
+	credentials, err := AuthenticatorFromString("acme:secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := startFTPServer(t, func() *S3Driver {
+		return &S3Driver{
+			featureFlags: featureChangeDir | featureList | featureGet | featurePut | featureRemove | featureMove,
+			config:       config,
+			s3:           &s3Mock{bucket: bucket},
+			uploader:     &s3UploaderMock{bucket: bucket},
+			metrics:      metricsSenderMock{},
+			bucketName:   bucketName,
+			bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+		}
+	}, credentials)
+
+	c := dialFTP(t, addr, "acme", "secret")
+	if _, code := c.retrieve("LIST /"); code != 226 {
+		t.Errorf("Expected the root directory to be listed but got %d", code)
+	}
+	if code := c.store("data", "STOR /incoming/data.csv"); code != 226 {
+		t.Errorf("Expected upload to /incoming to succeed but got %d", code)
+	}
+	if _, code := c.retrieve("RETR /incoming/data.csv"); code == 226 {
+		t.Errorf("Expected download from /incoming to be denied")
+	}
+	if data, code := c.retrieve("RETR /outgoing/report.txt"); code != 226 || data != "outgoing/report.txt" {
+		t.Errorf("Expected download from /outgoing to succeed but got %d %q", code, data)
+	}
+	if code := c.store("data", "STOR /outgoing/data.csv"); code == 226 {
+		t.Errorf("Expected upload to /outgoing to be denied")
+	}
+	if _, code := c.retrieve("RETR /secret.txt"); code == 226 {
+		t.Errorf("Expected download of /secret.txt to be denied")
+	}
+	if _, code := c.retrieve("RETR /outgoing/private/plan.txt"); code == 226 {
+		t.Errorf("Expected download from /outgoing/private to be denied")
+	}
+	c.expect(450, "SIZE /secret.txt")
+	c.expect(213, "SIZE /outgoing/report.txt")
+	c.expect(550, "DELE /outgoing/report.txt")
+	c.expect(350, "RNFR /incoming/data.csv")
+	c.expect(550, "RNTO /outgoing/data.csv")
+	if _, err := bucket.Get("outgoing/data.csv"); err == nil {
+		t.Errorf("Expected upload to /outgoing to be denied")
+	}
+}
+
+func TestRecursiveAccessRules(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucket := newBucketMock(bucketName)
+	for _, key := range []string{"data/", "data/a.csv", "data/b.txt", "other/", "other/c.csv", "free/", "free/d.txt"} {
+		bucket.Put(key, objectMock{data: []byte(key), lastMod: time.Now(), etag: key})
+	}
+	config := &Config{AccessRules: []AccessRule{
+		{User: "staff", Path: "/**", Allow: "*"},
+		{User: "staff", Path: "/data/*.csv", Deny: "rm,mv"},
+		{User: "staff", Path: "/archive/*.csv", Deny: "mv"},
+	}}
+	credentials, err := AuthenticatorFromString("staff:secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := startFTPServer(t, func() *S3Driver {
+		return &S3Driver{
+			featureFlags:       featureChangeDir | featureList | featureRemove | featureRemoveDir | featureMove,
+			recursiveRemoveDir: true,
+			config:             config,
+			s3:                 &s3Mock{bucket: bucket},
+			uploader:           &s3UploaderMock{bucket: bucket},
+			metrics:            metricsSenderMock{},
+			bucketName:         bucketName,
+			bucketURL:          intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+		}
+	}, credentials)
+
+	c := dialFTP(t, addr, "staff", "secret")
+	c.expect(550, "DELE /data/a.csv")
+	c.expect(550, "RMD /data")
+	c.expect(350, "RNFR /data")
+	c.expect(550, "RNTO /moved")
+	c.expect(350, "RNFR /other")
+	c.expect(550, "RNTO /archive")
+	for _, key := range []string{"data/a.csv", "data/b.txt", "other/c.csv"} {
+		if _, err := bucket.Get(key); err != nil {
+			t.Errorf("Expected %q to be kept: %s", key, err)
+		}
+	}
+
+	c.expect(250, "RMD /free")
+	if _, err := bucket.Get("free/d.txt"); err == nil {
+		t.Errorf("Expected the directory without denied files to be removed")
+	}
+	c.expect(350, "RNFR /other")
+	c.expect(250, "RNTO /moved")
+	if _, err := bucket.Get("moved/c.csv"); err != nil {
+		t.Errorf("Expected the directory without denied files to be moved: %s", err)
+	}
+}
@@ -3,15 +3,17 @@ package server
 import (
 	"fmt"
 	"io/ioutil"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
 // Authenticator contains credentials.
-// Implements https://godoc.org/github.com/goftp/server#Auth
+// Implements https://godoc.org/github.com/goftp/server#Auth and AuthProvider
 type Authenticator struct {
-	credentials map[string]string
+	credentials map[string]CredentialsEntry
 }
 
 // AuthenticatorFromFile returns an Authenticator with credentials parsed from the given file path.
@@ -26,17 +28,19 @@ func AuthenticatorFromFile(path string) (Authenticator, error) {
 
 // AuthenticatorFromString returns an Authenticator whose credentials where parsed from the given string.
 // The contents must contain one credential pair per line where username and password is separated by a `:`.
+// The password is either a crypt-style hash (see isPasswordHash) or, for legacy files, in plaintext.
+// Hashes may be followed by attributes of the user, see CredentialsEntry.
 func AuthenticatorFromString(contents string) (Authenticator, error) {
-	auth := Authenticator{make(map[string]string)}
+	auth := Authenticator{make(map[string]CredentialsEntry)}
 
 	lines := strings.Split(contents, "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if len(line) > 0 {
-			parts := strings.SplitN(line, ":", 2)
-			if len(parts) == 2 {
-				auth.credentials[parts[0]] = parts[1]
-			}
+	for i, line := range lines {
+		entry, ok, err := parseCredentialsEntry(line)
+		if err != nil {
+			return auth, errors.Wrapf(err, "Invalid credentials of %q in line %d", entry.User, i+1)
+		}
+		if ok {
+			auth.credentials[entry.User] = entry
 		}
 	}
 	if len(auth.credentials) == 0 {
@@ -45,12 +49,51 @@ func AuthenticatorFromString(contents string) (Authenticator, error) {
 	return auth, nil
 }
 
-// CheckPasswd returns `true` if username and password was found in the credentials store.
+// PlaintextUsers returns the sorted names of the users whose password is not hashed.
+func (c Authenticator) PlaintextUsers() []string {
+	users := []string{}
+	for user, entry := range c.credentials {
+		if !entry.Hashed() {
+			users = append(users, user)
+		}
+	}
+	sort.Strings(users)
+	return users
+}
+
+// CheckPasswd returns `true` if username and password was found in the credentials store
+// and the user is neither locked nor expired.
+// The returned error never contains the password.
 func (c Authenticator) CheckPasswd(username, password string) (bool, error) {
-	for user, pass := range c.credentials {
-		if username == user && password == pass {
-			return true, nil
+	_, err := c.Authenticate(username, password)
+	return err == nil, err
+}
+
+// Authenticate returns the identity of `username`, with the user's attributes in the credentials file, see CheckPasswd.
+func (c Authenticator) Authenticate(username, password string) (*Identity, error) {
+	entry, ok := c.credentials[username]
+	if !ok {
+		verifyUnknownUser(password)
+		return nil, errors.Wrapf(ErrUnknownUser, "Unknown credentials of user %q", username)
+	}
+	if !verifyPassword(entry.Password, password) {
+		return nil, fmt.Errorf("Unknown credentials of user %q", username)
+	}
+	if entry.Locked {
+		return nil, fmt.Errorf("User %q is locked", username)
+	}
+	if entry.Expired(time.Now()) {
+		return nil, fmt.Errorf("User %q expired on %s", username, entry.Expires.Format(expiryFormat))
+	}
+	return &Identity{User: username, Home: entry.Home, Groups: entry.Groups}, nil
+}
+
+// validate returns an error if the groups of any user are not defined in the configuration `config`.
+func (c Authenticator) validate(config *Config) error {
+	for name, entry := range c.credentials {
+		if err := (UserConfig{Home: entry.Home, Groups: entry.Groups}).validate(config.Groups); err != nil {
+			return errors.Wrapf(err, "Invalid settings of user %q in the credentials file", name)
 		}
 	}
-	return false, fmt.Errorf("Unknown credentials: %q:%q", username, password)
+	return nil
 }
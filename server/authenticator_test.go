@@ -1,6 +1,8 @@
 package server
 
 import (
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -55,3 +57,47 @@ func TestAuthenticatorFromString(t *testing.T) {
 		}
 	}
 }
+
+func TestHashedCredentials(t *testing.T) {
+	auth, err := AuthenticatorFromString(strings.Join([]string{
+		"plain:secret",
+		"hashed:$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+		"dollar:$ecret",
+	}, "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, testData := range []struct {
+		user, password string
+		valid          bool
+	}{
+		{"plain", "secret", true},
+		{"plain", "secret2", false},
+		{"hashed", "Hello world!", true},
+		{"hashed", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1", false},
+		{"dollar", "$ecret", true},
+		{"unknown", "secret", false},
+	} {
+		valid, err := auth.CheckPasswd(testData.user, testData.password)
+		if valid != testData.valid {
+			t.Errorf("Expected validity of %s:%s to be %v", testData.user, testData.password, testData.valid)
+		}
+		if err != nil && testData.password != "" && strings.Contains(err.Error(), testData.password) {
+			t.Errorf("Expected the error not to contain the password: %s", err)
+		}
+	}
+	// unknown users are verified against a hash of the default algorithm, so that they are not rejected faster than known users
+	if !strings.HasPrefix(dummyHash.hash, prefixArgon2id) || validatePasswordHash(dummyHash.hash) != nil {
+		t.Errorf("Expected unknown users to be verified against an argon2id hash but was %q", dummyHash.hash)
+	}
+	if users := auth.PlaintextUsers(); !reflect.DeepEqual(users, []string{"dollar", "plain"}) {
+		t.Errorf("Expected plaintext passwords of dollar and plain but were %v", users)
+	}
+
+	_, err = AuthenticatorFromString("broken:$6$rounds=many$salt$hash")
+	if err == nil {
+		t.Errorf("Expected a malformed hash to be rejected")
+	} else if strings.Contains(err.Error(), "many") {
+		t.Errorf("Expected the error not to contain the hash: %s", err)
+	}
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// abortStaleUploads aborts the incomplete multipart uploads which were started before `before` and returns their number.
+// Uploads are only listed if `dryRun` is set. For a mount, only the uploads below its prefix are considered.
+func (d *S3Driver) abortStaleUploads(before time.Time, dryRun bool) (int, error) {
+	input := &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(d.bucketName),
+	}
+	if d.mount != nil {
+		// only the uploads below the mounted prefix belong to the server
+		input.Prefix = aws.String(strings.SplitN(strings.TrimPrefix(d.mount.prefix, "/"), "{", 2)[0])
+	}
+	count := 0
+	for {
+		resp, err := d.s3.ListMultipartUploads(input)
+		if err != nil {
+			return count, errors.Wrapf(err, "Failed to list multipart uploads of %q", d.bucketURL)
+		}
+		for _, upload := range resp.Uploads {
+			initiated := aws.TimeValue(upload.Initiated)
+			if !initiated.Before(before) {
+				continue
+			}
+			key, uploadID := aws.StringValue(upload.Key), aws.StringValue(upload.UploadId)
+			fields := logrus.Fields{"key": d.fqdn(key), "upload": uploadID, "initiated": initiated}
+			if dryRun {
+				logrus.WithFields(fields).Infof("Found stale upload of %q", d.fqdn(key))
+				count++
+				continue
+			}
+			_, err := d.s3.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(d.bucketName),
+				Key:      aws.String(key),
+				UploadId: aws.String(uploadID),
+			})
+			if err != nil {
+				return count, errors.Wrapf(err, "Failed to abort upload %q of %q", uploadID, d.fqdn(key))
+			}
+			logrus.WithFields(fields).Infof("Aborted stale upload of %q", d.fqdn(key))
+			count++
+		}
+		if !aws.BoolValue(resp.IsTruncated) {
+			return count, nil
+		}
+		input.KeyMarker = resp.NextKeyMarker
+		input.UploadIdMarker = resp.NextUploadIdMarker
+	}
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestAbortStaleUploads(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	now := time.Now()
+	mock := &s3Mock{
+		bucket:   newBucketMock(bucketName),
+		pageSize: 2,
+		uploads: map[string]*multipartUploadMock{
+			"upload-1": {key: "old.txt", initiated: now.Add(-48 * time.Hour)},
+			"upload-2": {key: "recent.txt", initiated: now.Add(-time.Hour)},
+			"upload-3": {key: "old.txt", initiated: now.Add(-25 * time.Hour)},
+			"upload-4": {key: "dir/old.bin", initiated: now.Add(-72 * time.Hour)},
+			"upload-5": {key: "new.txt", initiated: now},
+		},
+	}
+	d := S3Driver{
+		s3:         mock,
+		bucketName: bucketName,
+		bucketURL:  intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+
+	count, err := d.abortStaleUploads(now.Add(-24*time.Hour), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 || len(mock.uploads) != 5 {
+		t.Fatalf("Dry run: expected 3 of 5 uploads to be found but were %d, %d remain", count, len(mock.uploads))
+	}
+
+	count, err = d.abortStaleUploads(now.Add(-24*time.Hour), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Fatalf("Expected 3 uploads to be aborted but were %d", count)
+	}
+	for _, uploadID := range []string{"upload-2", "upload-5"} {
+		if _, ok := mock.uploads[uploadID]; !ok {
+			t.Errorf("Recent upload %q was aborted", uploadID)
+		}
+	}
+	if len(mock.uploads) != 2 {
+		t.Errorf("Expected 2 remaining uploads but were %d", len(mock.uploads))
+	}
+}
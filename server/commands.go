@@ -0,0 +1,190 @@
+package server
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	hashSHA256 = "SHA-256"
+	hashMD5    = "MD5"
+)
+
+// extensionsSupported is the response to `FEAT`, i.e. the extensions of goftp as well as those implemented by the driver.
+const extensionsSupported = `Extensions supported:
+ UTF8
+ EPRT
+ EPSV
+ SIZE
+ MDTM
+ REST STREAM
+ HASH SHA-256;MD5
+ XMD5
+ XSHA256
+`
+
+// handleCommand implements FTP commands which are not supported by goftp:
+//
+//   - `HASH <path>` returns the digest of a file, the algorithm is selected with `OPTS HASH <algorithm>`.
+//   - `XMD5 <path>` and `XSHA256 <path>` return the MD5 and SHA-256 digest of a file.
+//   - `ALLO <size>` announces the size of the next upload, which fails if fewer bytes are received.
+//   - `SITE RESTORE <path>` restores a file which the user deleted from the trash if soft delete is enabled.
+//
+// `REST`, `APPE`, `RETR` and `STOR` are passed on to goftp, but the offset of `REST` is kept for the next `STOR`.
+// A `STOR` which would resume a file at an offset other than the size of its existing data is rejected.
+func (d *S3Driver) handleCommand(command, param string) (int, string, bool) {
+	switch command {
+	case "REST":
+		if offset, err := strconv.ParseInt(param, 10, 64); err == nil {
+			d.restOffset, d.staleAppend = &offset, false
+		}
+		return 0, "", false
+	case "APPE", "RETR":
+		// goftp resets the offset after `RETR` and appends to the end of the file for `APPE`
+		d.restOffset, d.staleAppend = nil, false
+		return 0, "", false
+	case "STOR":
+		if d.restOffset == nil || *d.restOffset == 0 || param == "" || d.conn != nil && !d.conn.IsLogin() {
+			return 0, "", false
+		}
+		offset := *d.restOffset
+		if d.restOffsetValid(param, offset) {
+			return 0, "", false
+		}
+		d.restOffset, d.staleAppend = nil, true
+		return 554, fmt.Sprintf("Invalid REST offset %d for %s", offset, param), true
+	case "FEAT":
+		return 211, extensionsSupported, true
+	case "OPTS":
+		parts := strings.Fields(param)
+		if len(parts) == 0 || strings.ToUpper(parts[0]) != "HASH" {
+			return 0, "", false
+		}
+		if len(parts) == 1 {
+			return 200, d.hashAlgorithm(), true
+		}
+		algorithm := strings.ToUpper(parts[1])
+		if algorithm != hashSHA256 && algorithm != hashMD5 {
+			return 504, fmt.Sprintf("Unknown algorithm %q", parts[1]), true
+		}
+		d.hashAlgo = algorithm
+		return 200, algorithm, true
+	case "ALLO":
+		parts := strings.Fields(param)
+		if len(parts) == 0 {
+			return 501, "action aborted, required param missing", true
+		}
+		size, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil || size < 0 {
+			return 501, fmt.Sprintf("Invalid size %q", parts[0]), true
+		}
+		d.announcedSize = size
+		return 200, fmt.Sprintf("Expecting %d bytes", size), true
+	case "SITE":
+		parts := strings.SplitN(strings.TrimSpace(param), " ", 2)
+		if strings.ToUpper(parts[0]) != "RESTORE" {
+			return 0, "", false
+		}
+		if d.conn != nil && !d.conn.IsLogin() {
+			return 530, "not logged in", true
+		}
+		if len(parts) < 2 || strings.TrimSpace(parts[1]) == "" {
+			return 501, "action aborted, required param missing", true
+		}
+		path := strings.TrimSpace(parts[1])
+		if err := d.Restore(path); err != nil {
+			return 550, err.Error(), true
+		}
+		return 200, fmt.Sprintf("Restored %s", path), true
+	case "HASH", "XMD5", "XSHA256":
+		if d.conn != nil && !d.conn.IsLogin() {
+			return 530, "not logged in", true
+		}
+		if param == "" {
+			return 501, "action aborted, required param missing", true
+		}
+		algorithm := d.hashAlgorithm()
+		switch command {
+		case "XMD5":
+			algorithm = hashMD5
+		case "XSHA256":
+			algorithm = hashSHA256
+		}
+		sum, size, err := d.Hash(param, algorithm)
+		if err != nil {
+			return 550, err.Error(), true
+		}
+		if command == "HASH" {
+			return 213, fmt.Sprintf("%s 0-%d %s %s", algorithm, size, sum, param), true
+		}
+		return 250, sum, true
+	}
+	return 0, "", false
+}
+
+// hashAlgorithm returns the algorithm selected for the `HASH` command.
+func (d *S3Driver) hashAlgorithm() string {
+	if d.hashAlgo == "" {
+		return hashSHA256
+	}
+	return d.hashAlgo
+}
+
+// Hash returns the hex encoded digest with algorithm `algorithm` and the size of the object located at `path`.
+// Digests which were stored on upload are returned as is, otherwise the object's contents are hashed.
+func (d *S3Driver) Hash(path, algorithm string) (string, int64, error) {
+	defer d.enterMount(path)()
+	if d.features()&featureGet == 0 {
+		return "", -1, notEnabled("GET")
+	}
+	if err := d.checkAccess(featureGet, path); err != nil {
+		return "", -1, err
+	}
+
+	key := d.objectKey(path)
+	fqdn := d.fqdn(key)
+	resp, err := d.s3.HeadObject(&s3.HeadObjectInput{
+		Bucket:               aws.String(d.bucketName),
+		Key:                  aws.String(key),
+		SSECustomerAlgorithm: d.sse.customerAlgorithm(),
+		SSECustomerKey:       d.sse.customerKeyValue(),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return "", -1, fmt.Errorf("%q: no such file", d.resolvePath(path))
+		}
+		return "", -1, errors.Wrapf(err, "Failed to get object %q", fqdn)
+	}
+	size := d.encryption.plaintextSize(aws.Int64Value(resp.ContentLength), resp.Metadata)
+
+	metadataKey := metadataSHA256
+	if algorithm == hashMD5 {
+		metadataKey = metadataMD5
+	}
+	if sum := metadataValue(resp.Metadata, metadataKey); sum != "" {
+		return sum, size, nil
+	}
+
+	logrus.WithFields(logrus.Fields{"key": fqdn, "algorithm": algorithm}).Infof("Computing digest of %q", fqdn)
+	body, err := d.objectReader(key)
+	if err != nil {
+		return "", -1, err
+	}
+	defer body.Close()
+	digest := newDigest()
+	if _, err := io.Copy(digest, body); err != nil {
+		return "", -1, errors.Wrapf(err, "Failed to read object %q", fqdn)
+	}
+	if algorithm == hashMD5 {
+		return hex.EncodeToString(digest.md5.Sum(nil)), digest.size, nil
+	}
+	return hex.EncodeToString(digest.sha256.Sum(nil)), digest.size, nil
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestHashCommands(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	defer func(partSize int64) {
+		uploadPartSize = partSize
+	}(uploadPartSize)
+	uploadPartSize = 8
+
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	bucketMock.Put("legacy.txt", objectMock{data: []byte("uploaded without digest"), lastMod: time.Now(), etag: "legacy"})
+	mock := &s3Mock{bucket: bucketMock}
+	d := S3Driver{
+		featureFlags: featurePut | featureGet,
+		s3:           mock,
+		uploader:     &s3UploaderMock{bucket: bucketMock},
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+
+	contents := map[string]string{
+		"small.txt":  "tiny",
+		"large.txt":  "more data than fits into a single part",
+		"legacy.txt": "uploaded without digest",
+	}
+	for _, key := range []string{"small.txt", "large.txt"} {
+		size, err := d.PutFile(key, strings.NewReader(contents[key]), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != int64(len(contents[key])) {
+			t.Fatalf("Object %q: expected size %d but was %d", key, len(contents[key]), size)
+		}
+		object, _ := bucketMock.Get(key)
+		if metadataValue(object.metadata, metadataSHA256) != fmt.Sprintf("%x", sha256.Sum256([]byte(contents[key]))) {
+			t.Fatalf("Object %q: digest was not stored", key)
+		}
+	}
+
+	for key, data := range contents {
+		md5Sum := fmt.Sprintf("%x", md5.Sum([]byte(data)))
+		sha256Sum := fmt.Sprintf("%x", sha256.Sum256([]byte(data)))
+		for _, testData := range []struct {
+			command  string
+			code     int
+			expected string
+		}{
+			{"XMD5", 250, md5Sum},
+			{"XSHA256", 250, sha256Sum},
+			{"HASH", 213, fmt.Sprintf("SHA-256 0-%d %s %s", len(data), sha256Sum, key)},
+		} {
+			code, message, handled := d.handleCommand(testData.command, key)
+			if !handled || code != testData.code || message != testData.expected {
+				t.Errorf("%s %s: unexpected response (%v) %d %q", testData.command, key, handled, code, message)
+			}
+		}
+	}
+
+	if code, _, _ := d.handleCommand("OPTS", "HASH CRC32"); code != 504 {
+		t.Errorf("Unknown hash algorithm was accepted")
+	}
+	if code, message, _ := d.handleCommand("OPTS", "HASH md5"); code != 200 || message != "MD5" {
+		t.Errorf("Failed to select MD5: %d %q", code, message)
+	}
+	expected := fmt.Sprintf("MD5 0-4 %x small.txt", md5.Sum([]byte("tiny")))
+	if _, message, _ := d.handleCommand("HASH", "small.txt"); message != expected {
+		t.Errorf("Expected %q but was %q", expected, message)
+	}
+	if code, _, _ := d.handleCommand("HASH", "missing.txt"); code != 550 {
+		t.Errorf("Hash of a missing file did not fail")
+	}
+	if _, _, handled := d.handleCommand("OPTS", "UTF8 ON"); handled {
+		t.Errorf("OPTS UTF8 must be handled by the FTP server")
+	}
+	if _, _, handled := d.handleCommand("RETR", "small.txt"); handled {
+		t.Errorf("RETR must be handled by the FTP server")
+	}
+}
+
+func TestRestOffset(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	bucketMock.Put("file.txt", objectMock{data: []byte("hello"), lastMod: time.Now(), etag: "hello"})
+	credentials, err := AuthenticatorFromString("alice:secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := startFTPServer(t, func() *S3Driver {
+		return &S3Driver{
+			featureFlags: featureGet | featurePut,
+			s3:           &s3Mock{bucket: bucketMock},
+			uploader:     &s3UploaderMock{bucket: bucketMock},
+			metrics:      metricsSenderMock{},
+			bucketName:   bucketName,
+			bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+		}
+	}, credentials)
+	c := dialFTP(t, addr, "alice", "secret")
+	content := func() string {
+		object, err := bucketMock.Get("file.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(object.data)
+	}
+
+	for _, testData := range []struct {
+		rest     string
+		data     string
+		code     int
+		expected string
+	}{
+		{"3", "lo, world", 554, "hello"},
+		{"", "replaced", 226, "replaced"},
+		{"8", " again", 226, "replaced again"},
+		{"0", "restarted", 226, "restarted"},
+		{"20", "beyond", 554, "restarted"},
+	} {
+		if testData.rest != "" {
+			c.expect(350, "REST %s", testData.rest)
+		}
+		if code := c.store(testData.data, "STOR file.txt"); code != testData.code || content() != testData.expected {
+			t.Errorf("REST %s: expected %d and %q but was %d and %q", testData.rest, testData.code, testData.expected, code, content())
+		}
+	}
+	// goftp answers `APPE` without a transfer, the next `STOR` appends to the end of the file
+	c.expect(202, "APPE file.txt")
+	if code := c.store("!", "STOR file.txt"); code != 226 || content() != "restarted!" {
+		t.Errorf("Expected APPE to append to the end of the file but was %d and %q", code, content())
+	}
+	c.expect(350, "REST 5")
+	c.expect(202, "APPE new.txt")
+	if code := c.store("new", "STOR new.txt"); code != 226 {
+		t.Errorf("Expected APPE to override a preceding REST but was %d", code)
+	}
+}
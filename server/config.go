@@ -0,0 +1,206 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// Config is the content of the configuration file, which holds the settings that do not fit into command line flags.
+//
+// Example:
+//
+//	{
+//	  "uploadRules": [
+//	    {"glob": "*.csv", "contentType": "text/csv; charset=utf-8"},
+//	    {"prefix": "archive/", "minSize": 134217728, "storageClass": "GLACIER_IR"}
+//	  ],
+//	  "objectTags": {"uploader": "{user}"},
+//	  "users": {
+//	    "alice": {"groups": ["partners"], "noOverwrite": false},
+//	    "bob": {"home": "/", "features": "cd,ls,get", "password": "$argon2id$v=19$m=19456,t=2,p=1$<salt>$<key>"}
+//	  },
+//	  "groups": {"partners": {"features": "cd,ls,get,put", "noOverwrite": true}},
+//	  "accessRules": [
+//	    {"group": "partners", "path": "/", "allow": "cd,ls"},
+//	    {"group": "partners", "path": "/incoming/**", "allow": "cd,ls,put"},
+//	    {"group": "partners", "path": "/outgoing/**", "allow": "cd,ls,get"},
+//	    {"group": "staff", "path": "/**", "allow": "*"},
+//	    {"group": "staff", "path": "/archive/**", "deny": "rm,rmdir"}
+//	  ],
+//	  "mounts": [
+//	    {"path": "/archive", "bucket": "s3://archive-bucket/ftp/", "region": "eu-west-1"},
+//	    {"path": "/incoming", "bucket": "https://landing.s3.example.com/", "credentials": "access_key:secret_key"}
+//	  ],
+//	  "ldap": {"url": "ldaps://ldap.example.com", "baseDN": "ou=people,dc=example,dc=com", "userFilter": "(uid={user})"}
+//	}
+type Config struct {
+	// UploadRules set the attributes of uploaded objects
+	UploadRules []UploadRule `json:"uploadRules,omitempty"`
+	// ObjectTags are added to uploaded objects, see S3Driver.objectTags for placeholders in values
+	ObjectTags map[string]string `json:"objectTags,omitempty"`
+	// KeyTemplate determines the keys of uploaded objects, see keyPlaceholders, e.g.
+	// `incoming/{user}/{yyyy}/{mm}/{dd}/{basename}-{unixtime}{ext}`
+	KeyTemplate string `json:"keyTemplate,omitempty"`
+	// Users holds the settings of individual FTP users by user name
+	Users map[string]UserConfig `json:"users,omitempty"`
+	// Groups holds the settings shared by the members of a group of FTP users by group name
+	Groups map[string]GroupConfig `json:"groups,omitempty"`
+	// AccessRules restrict the operations of users on paths, see accessAllowed.
+	// Once any rule is defined, operations which no rule allows are denied to all users, including users without own rules
+	AccessRules []AccessRule `json:"accessRules,omitempty"`
+	// Mounts serve further buckets at directories of the FTP namespace, the bucket of `--s3-bucket` is served at the root
+	Mounts []MountConfig `json:"mounts,omitempty"`
+	// LDAP configures the authentication of users with an LDAP server, see DriverFactory.LDAPProvider
+	LDAP *LDAPConfig `json:"ldap,omitempty"`
+}
+
+// UserConfig holds the settings of an FTP user.
+type UserConfig struct {
+	// Home is the user's home directory, e.g. `partners/{user}/`, which overrides the default
+	Home string `json:"home,omitempty"`
+	// Groups are the names of the groups the user is a member of
+	Groups []string `json:"groups,omitempty"`
+	// Features is the user's feature set, e.g. `ls,get`, which overrides the ones of the user's groups
+	Features string `json:"features,omitempty"`
+	// NoOverwrite prevents the user from overwriting files if set, which overrides the setting of the user's groups
+	NoOverwrite *bool `json:"noOverwrite,omitempty"`
+	// Password is the hash of the user's password (see isPasswordHash), which allows the user to log in, see DriverFactory.ConfigProvider
+	Password string `json:"password,omitempty"`
+}
+
+// MountConfig mounts a bucket, or a prefix of a bucket, at a directory of the FTP namespace.
+// Settings which are not set are the ones of the bucket of `--s3-bucket`.
+type MountConfig struct {
+	// Path is the absolute FTP path of the mount point, e.g. `/archive`
+	Path string `json:"path"`
+	// Bucket is the URL of the bucket and the mounted prefix, either `s3://<bucket>/<prefix>` or in the format of `--s3-bucket`,
+	// e.g. `https://<bucket>.<endpoint>/<prefix>`. The prefix may contain `{user}`, which is replaced by the user name.
+	Bucket string `json:"bucket"`
+	// Region is the region of the bucket
+	Region string `json:"region,omitempty"`
+	// Endpoint is the URL of the s3 endpoint, e.g. `https://s3.eu-west-1.amazonaws.com`, which must be https with SSE-C
+	Endpoint string `json:"endpoint,omitempty"`
+	// Credentials are the credentials of the bucket in format 'access_key:secret_key'
+	Credentials string `json:"credentials,omitempty"`
+}
+
+// GroupConfig holds the settings of a group of FTP users.
+type GroupConfig struct {
+	// Features is the feature set of the group's members, e.g. `ls,get,put`
+	Features string `json:"features,omitempty"`
+	// NoOverwrite prevents the group's members from overwriting files if set
+	NoOverwrite *bool `json:"noOverwrite,omitempty"`
+}
+
+// user returns the settings of the user `username` and whether there are any.
+func (c *Config) user(username string) (UserConfig, bool) {
+	if c == nil {
+		return UserConfig{}, false
+	}
+	user, ok := c.Users[username]
+	return user, ok
+}
+
+// copy returns a copy of the configuration whose users can be changed without affecting c.
+func (c *Config) copy() *Config {
+	copied := Config{Users: map[string]UserConfig{}}
+	if c != nil {
+		copied = *c
+		copied.Users = make(map[string]UserConfig, len(c.Users))
+		for name, user := range c.Users {
+			copied.Users[name] = user
+		}
+	}
+	return &copied
+}
+
+// LoadConfig reads and validates the configuration file `filename`.
+func LoadConfig(filename string) (*Config, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read %q", filename)
+	}
+	config, err := ParseConfig(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid configuration file %q", filename)
+	}
+	return config, nil
+}
+
+// ParseConfig parses and validates the configuration `data`.
+func ParseConfig(data []byte) (*Config, error) {
+	config := &Config{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Validate returns an error if any setting is invalid.
+func (c *Config) Validate() error {
+	for i, rule := range c.UploadRules {
+		if err := rule.validate(); err != nil {
+			return errors.Wrapf(err, "Invalid upload rule #%d", i+1)
+		}
+	}
+	for i, rule := range c.AccessRules {
+		if err := rule.validate(); err != nil {
+			return errors.Wrapf(err, "Invalid access rule #%d", i+1)
+		}
+	}
+	mounted := map[string]bool{}
+	for _, mount := range c.Mounts {
+		if err := mount.validate(); err != nil {
+			return errors.Wrapf(err, "Invalid mount %q", mount.Path)
+		}
+		if mounted[mount.Path] {
+			return fmt.Errorf("Duplicate mount %q", mount.Path)
+		}
+		mounted[mount.Path] = true
+	}
+	if err := validateKeyTemplate(c.KeyTemplate); err != nil {
+		return err
+	}
+	if c.LDAP != nil {
+		if err := c.LDAP.validate(c.Groups); err != nil {
+			return errors.Wrapf(err, "Invalid LDAP settings")
+		}
+	}
+	for name, user := range c.Users {
+		if err := user.validate(c.Groups); err != nil {
+			return errors.Wrapf(err, "Invalid settings of user %q", name)
+		}
+	}
+	for name, group := range c.Groups {
+		if err := validateFeatures(group.Features); err != nil {
+			return errors.Wrapf(err, "Invalid settings of group %q", name)
+		}
+	}
+	return validateObjectTags(c.ObjectTags)
+}
+
+func (u UserConfig) validate(groups map[string]GroupConfig) error {
+	if err := validateHome(u.Home); err != nil {
+		return err
+	}
+	for _, group := range u.Groups {
+		if _, ok := groups[group]; !ok {
+			return fmt.Errorf("unknown group %q", group)
+		}
+	}
+	if u.Password != "" {
+		if !isPasswordHash(u.Password) {
+			return fmt.Errorf("password is not hashed")
+		}
+		if err := validatePasswordHash(u.Password); err != nil {
+			return err
+		}
+	}
+	return validateFeatures(u.Features)
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// commandHandler implements FTP commands which are not supported by goftp.
+type commandHandler interface {
+	// handleCommand returns the response to the command `command` and whether the command was handled at all.
+	handleCommand(command, param string) (code int, message string, handled bool)
+}
+
+// controlConnHandoff passes an accepted control connection to the driver which is created for it.
+// The FTP server creates the driver right after a connection was accepted, both happens sequentially.
+type controlConnHandoff struct {
+	lock sync.Mutex
+	conn *controlConn
+}
+
+func (h *controlConnHandoff) put(conn *controlConn) {
+	h.lock.Lock()
+	h.conn = conn
+	h.lock.Unlock()
+}
+
+func (h *controlConnHandoff) take() *controlConn {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	conn := h.conn
+	h.conn = nil
+	return conn
+}
+
+// controlListener wraps the listener of the FTP server's control connections.
+type controlListener struct {
+	net.Listener
+	handoff *controlConnHandoff
+}
+
+// Accept waits for and returns the next control connection.
+func (l *controlListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return conn, err
+	}
+	c := &controlConn{
+		Conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+	l.handoff.put(c)
+	return c, nil
+}
+
+// controlConn is an FTP control connection which intercepts the commands implemented by its handler.
+// Intercepted commands are answered directly and never reach the FTP server.
+type controlConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	pending []byte
+	handler commandHandler
+}
+
+// Read passes at most one command line at a time to the FTP server, hence commands are
+// processed in order: a command is only intercepted after the server handled all previous commands.
+func (c *controlConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		line, err := c.reader.ReadString('\n')
+		if line == "" {
+			return 0, err
+		}
+		if err == nil && c.intercept(line) {
+			continue
+		}
+		c.pending = []byte(line)
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// intercept answers the command `line` if it is implemented by the handler.
+func (c *controlConn) intercept(line string) bool {
+	if c.handler == nil {
+		return false
+	}
+	parts := strings.SplitN(strings.Trim(line, "\r\n"), " ", 2)
+	command, param := strings.ToUpper(parts[0]), ""
+	if len(parts) == 2 {
+		param = strings.TrimSpace(parts[1])
+	}
+	code, message, handled := c.handler.handleCommand(command, param)
+	if !handled {
+		return false
+	}
+	if _, err := c.Write([]byte(formatResponse(code, message))); err != nil {
+		logrus.WithFields(logrus.Fields{"command": command, "error": err}).Errorf("Failed to respond to %s", command)
+	}
+	return true
+}
+
+// formatResponse returns the FTP response line(s) for `code` and `message`.
+// Messages with more than one line are sent as multi-line response.
+func formatResponse(code int, message string) string {
+	lines := strings.Split(strings.TrimRight(message, "\n"), "\n")
+	if len(lines) == 1 {
+		return fmt.Sprintf("%d %s\r\n", code, message)
+	}
+	return fmt.Sprintf("%d-%s\r\n%d END\r\n", code, strings.Join(lines, "\r\n"), code)
+}
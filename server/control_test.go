@@ -0,0 +1,73 @@
+package server
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+type commandHandlerMock struct {
+	handled []string
+}
+
+func (h *commandHandlerMock) handleCommand(command, param string) (int, string, bool) {
+	switch command {
+	case "HASH":
+		h.handled = append(h.handled, command+" "+param)
+		return 213, "SHA-256 0-3 abc " + param, true
+	case "FEAT":
+		h.handled = append(h.handled, command)
+		return 211, "Extensions supported:\n HASH\n", true
+	}
+	return 0, "", false
+}
+
+func TestControlConn(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	handler := &commandHandlerMock{}
+	conn := &controlConn{
+		Conn:    server,
+		reader:  bufio.NewReader(server),
+		handler: handler,
+	}
+
+	go func() {
+		client.Write([]byte("USER foo\r\nHASH some/file.txt\r\nFEAT\r\nPWD\r\n"))
+	}()
+	responses := make(chan string)
+	go func() {
+		reader := bufio.NewReader(client)
+		lines := []string{}
+		for i := 0; i < 4; i++ {
+			line, _ := reader.ReadString('\n')
+			lines = append(lines, line)
+		}
+		responses <- strings.Join(lines, "")
+	}()
+
+	reader := bufio.NewReader(conn)
+	for _, expected := range []string{"USER foo\r\n", "PWD\r\n"} {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != expected {
+			t.Fatalf("Expected %q to be passed to the server but was %q", expected, line)
+		}
+	}
+	expected := "213 SHA-256 0-3 abc some/file.txt\r\n211-Extensions supported:\r\n HASH\r\n211 END\r\n"
+	if r := <-responses; r != expected {
+		t.Fatalf("Expected responses %q but were %q", expected, r)
+	}
+	if len(handler.handled) != 2 {
+		t.Fatalf("Expected 2 intercepted commands but were %v", handler.handled)
+	}
+
+	client.Close()
+	if _, err := ioutil.ReadAll(reader); err != nil {
+		t.Fatalf("Closing the connection should result in EOF but was: %s", err)
+	}
+}
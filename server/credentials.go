@@ -0,0 +1,329 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Prefix of the password of locked users in the credentials file.
+const lockedPrefix = "!"
+
+// expiryFormat is the format of the expiry date in the credentials file.
+const expiryFormat = "2006-01-02"
+
+// CredentialsEntry is a line of the credentials file, which has the format
+// `<user>:<password>[:<attribute>=<value>]...`.
+// The password is either a hash (see isPasswordHash), which is prefixed by `!` if the user is locked, or a legacy plaintext password.
+// Attributes can only follow a hash, since plaintext passwords may contain colons:
+//   - `home` is the user's home directory, e.g. `partners/{user}/`
+//   - `groups` are the comma separated names of the user's groups
+//   - `expires` is the date in format `YYYY-MM-DD` from which on (UTC) the user can not log in anymore
+type CredentialsEntry struct {
+	User     string
+	Password string
+	Locked   bool
+	Home     string
+	Groups   []string
+	Expires  time.Time
+}
+
+// parseCredentialsEntry parses the line `line` of the credentials file and returns false if it contains no credentials.
+func parseCredentialsEntry(line string) (CredentialsEntry, bool, error) {
+	parts := strings.SplitN(strings.TrimSpace(line), ":", 2)
+	if len(parts) != 2 {
+		return CredentialsEntry{}, false, nil
+	}
+	entry := CredentialsEntry{User: parts[0], Password: parts[1]}
+	hash := parts[1]
+	if strings.HasPrefix(hash, lockedPrefix) && isPasswordHash(strings.TrimPrefix(hash, lockedPrefix)) {
+		entry.Locked, hash = true, strings.TrimPrefix(hash, lockedPrefix)
+	}
+	if !isPasswordHash(hash) {
+		return entry, true, nil
+	}
+	fields := strings.Split(hash, ":")
+	entry.Password = fields[0]
+	if err := validatePasswordHash(entry.Password); err != nil {
+		return entry, true, err
+	}
+	for _, attribute := range fields[1:] {
+		pair := strings.SplitN(attribute, "=", 2)
+		if len(pair) != 2 {
+			return entry, true, fmt.Errorf("malformed attribute %q", attribute)
+		}
+		switch pair[0] {
+		case "home":
+			entry.Home = pair[1]
+		case "groups":
+			entry.Groups = strings.Split(pair[1], ",")
+		case "expires":
+			expires, err := time.Parse(expiryFormat, pair[1])
+			if err != nil {
+				return entry, true, fmt.Errorf("invalid expiry date %q", pair[1])
+			}
+			entry.Expires = expires
+		default:
+			return entry, true, fmt.Errorf("unknown attribute %q", pair[0])
+		}
+	}
+	return entry, true, entry.validateAttributes()
+}
+
+// validate returns an error if the entry can not be written to the credentials file.
+func (e CredentialsEntry) validate() error {
+	if e.User == "" || e.User != strings.TrimSpace(e.User) || strings.ContainsAny(e.User, ":\n") {
+		return fmt.Errorf("invalid user name %q", e.User)
+	}
+	if strings.Contains(e.Password, "\n") {
+		return fmt.Errorf("invalid password")
+	}
+	if !e.Hashed() {
+		if e.Locked || e.Home != "" || len(e.Groups) > 0 || !e.Expires.IsZero() {
+			return fmt.Errorf("user %q has a plaintext password, set a new one first", e.User)
+		}
+		return nil
+	}
+	if err := validatePasswordHash(e.Password); err != nil {
+		return err
+	}
+	return e.validateAttributes()
+}
+
+// validateAttributes returns an error if any attribute can not be represented in the credentials file.
+func (e CredentialsEntry) validateAttributes() error {
+	if strings.ContainsAny(e.Home, ":\n") {
+		return fmt.Errorf("invalid home directory %q", e.Home)
+	}
+	if err := validateHome(e.Home); err != nil {
+		return err
+	}
+	for _, group := range e.Groups {
+		if group == "" || strings.ContainsAny(group, ":,\n") {
+			return fmt.Errorf("invalid group name %q", group)
+		}
+	}
+	return nil
+}
+
+// String returns the entry in the format of the credentials file.
+func (e CredentialsEntry) String() string {
+	line := e.User + ":"
+	if e.Locked {
+		line += lockedPrefix
+	}
+	line += e.Password
+	if e.Home != "" {
+		line += ":home=" + e.Home
+	}
+	if len(e.Groups) > 0 {
+		line += ":groups=" + strings.Join(e.Groups, ",")
+	}
+	if !e.Expires.IsZero() {
+		line += ":expires=" + e.Expires.Format(expiryFormat)
+	}
+	return line
+}
+
+// Hashed returns false if the password is in plaintext.
+func (e CredentialsEntry) Hashed() bool {
+	return isPasswordHash(e.Password)
+}
+
+// Expired returns true if the user can not log in anymore at `now`.
+func (e CredentialsEntry) Expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !now.Before(e.Expires)
+}
+
+// CredentialsFile is a credentials file which is edited, e.g. by `f3 users`.
+// Lines which contain no credentials, like comments, are kept as they are.
+type CredentialsFile struct {
+	path  string
+	mode  os.FileMode
+	uid   int
+	gid   int
+	lines []string
+}
+
+// EditCredentialsFile applies `edit` to the credentials file `path` and saves it.
+// The directory of the file is locked meanwhile, so that concurrent edits can not overwrite each other.
+func EditCredentialsFile(path string, edit func(*CredentialsFile) error) error {
+	unlock, err := lockDir(filepath.Dir(path))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to lock %q", path)
+	}
+	defer unlock()
+	file, err := OpenCredentialsFile(path)
+	if err != nil {
+		return err
+	}
+	if err := edit(file); err != nil {
+		return err
+	}
+	return file.Save()
+}
+
+// lockDir takes an exclusive lock of the directory `dir`, which is released by the returned function.
+func lockDir(dir string) (func(), error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// OpenCredentialsFile reads the credentials file `path`, which is created by Save if it does not exist.
+// Use EditCredentialsFile to change the file.
+func OpenCredentialsFile(path string) (*CredentialsFile, error) {
+	file := &CredentialsFile{path: path, mode: 0600, uid: -1, gid: -1}
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return file, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read %q", path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read %q", path)
+	}
+	file.mode = info.Mode().Perm()
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		file.uid, file.gid = int(stat.Uid), int(stat.Gid)
+	}
+	file.lines = strings.Split(strings.TrimSuffix(string(raw), "\n"), "\n")
+	for i, line := range file.lines {
+		if entry, ok, err := parseCredentialsEntry(line); ok && err != nil {
+			return nil, errors.Wrapf(err, "Invalid credentials of %q in line %d", entry.User, i+1)
+		}
+	}
+	return file, nil
+}
+
+// Entries returns the credentials in the file sorted by user name.
+func (f *CredentialsFile) Entries() []CredentialsEntry {
+	entries := map[string]CredentialsEntry{}
+	for _, line := range f.lines {
+		if entry, ok, _ := parseCredentialsEntry(line); ok {
+			entries[entry.User] = entry
+		}
+	}
+	sorted := []CredentialsEntry{}
+	for _, entry := range entries {
+		sorted = append(sorted, entry)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].User < sorted[j].User
+	})
+	return sorted
+}
+
+// Entry returns the credentials of `user` and whether there are any.
+// Like for AuthenticatorFromString, the last line of the user counts.
+func (f *CredentialsFile) Entry(user string) (CredentialsEntry, bool) {
+	for i := len(f.lines) - 1; i >= 0; i-- {
+		if entry, ok, _ := parseCredentialsEntry(f.lines[i]); ok && entry.User == user {
+			return entry, true
+		}
+	}
+	return CredentialsEntry{}, false
+}
+
+// Put adds the credentials `entry` to the file or replaces the ones of the user.
+func (f *CredentialsFile) Put(entry CredentialsEntry) error {
+	if err := entry.validate(); err != nil {
+		return err
+	}
+	replaced := f.remove(entry.User)
+	if replaced < 0 {
+		f.lines = append(f.lines, entry.String())
+		return nil
+	}
+	f.lines = append(f.lines[:replaced], append([]string{entry.String()}, f.lines[replaced:]...)...)
+	return nil
+}
+
+// Remove removes the credentials of `user` from the file and returns false if there were none.
+func (f *CredentialsFile) Remove(user string) bool {
+	return f.remove(user) >= 0
+}
+
+// remove removes all lines with credentials of `user` and returns the index of the first one, or -1 if there were none.
+func (f *CredentialsFile) remove(user string) int {
+	first := -1
+	lines := []string{}
+	for _, line := range f.lines {
+		if entry, ok, _ := parseCredentialsEntry(line); ok && entry.User == user {
+			if first < 0 {
+				first = len(lines)
+			}
+			continue
+		}
+		lines = append(lines, line)
+	}
+	f.lines = lines
+	return first
+}
+
+// Save atomically replaces the credentials file by the edited one, which keeps the permissions and the owner of the file.
+func (f *CredentialsFile) Save() error {
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), "."+filepath.Base(f.path)+".")
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create temporary file for %q", f.path)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	contents := ""
+	if len(f.lines) > 0 {
+		contents = strings.Join(f.lines, "\n") + "\n"
+	}
+	if err := tmp.Chmod(f.mode); err != nil {
+		return errors.Wrapf(err, "Failed to set permissions of %q", tmp.Name())
+	}
+	if err := f.chown(tmp); err != nil {
+		return errors.Wrapf(err, "Failed to set the owner of %q", tmp.Name())
+	}
+	if _, err := tmp.WriteString(contents); err != nil {
+		return errors.Wrapf(err, "Failed to write %q", tmp.Name())
+	}
+	if err := tmp.Sync(); err != nil {
+		return errors.Wrapf(err, "Failed to write %q", tmp.Name())
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrapf(err, "Failed to write %q", tmp.Name())
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return errors.Wrapf(err, "Failed to replace %q", f.path)
+	}
+	return nil
+}
+
+// chown sets the owner and the group of the temporary file `tmp` to the ones of the credentials file,
+// e.g. the user of the service if the file is edited by root.
+func (f *CredentialsFile) chown(tmp *os.File) error {
+	if f.uid < 0 {
+		return nil
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		return err
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) == f.uid && int(stat.Gid) == f.gid {
+		return nil
+	}
+	return tmp.Chown(f.uid, f.gid)
+}
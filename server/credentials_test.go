@@ -0,0 +1,217 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCredentialsEntry(t *testing.T) {
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verifyPassword(hash, "secret") || verifyPassword(hash, "Secret") {
+		t.Fatalf("Expected the hash %q to match only the hashed password", hash)
+	}
+
+	for _, testData := range []struct {
+		line     string
+		expected CredentialsEntry
+	}{
+		{"alice:secret", CredentialsEntry{User: "alice", Password: "secret"}},
+		{"alice:pass:home=x", CredentialsEntry{User: "alice", Password: "pass:home=x"}},
+		{"alice:!secret", CredentialsEntry{User: "alice", Password: "!secret"}},
+		{"alice:" + hash, CredentialsEntry{User: "alice", Password: hash}},
+		{"alice:!" + hash, CredentialsEntry{User: "alice", Password: hash, Locked: true}},
+		{
+			"alice:" + hash + ":home=partners/{user}/:groups=partners,uploaders:expires=2030-01-31",
+			CredentialsEntry{
+				User:     "alice",
+				Password: hash,
+				Home:     "partners/{user}/",
+				Groups:   []string{"partners", "uploaders"},
+				Expires:  time.Date(2030, 1, 31, 0, 0, 0, 0, time.UTC),
+			},
+		},
+	} {
+		entry, ok, err := parseCredentialsEntry(testData.line)
+		if !ok || err != nil {
+			t.Errorf("Failed to parse %q: %v", testData.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(entry, testData.expected) {
+			t.Errorf("Expected %q to be parsed to %+v but was %+v", testData.line, testData.expected, entry)
+		}
+		if entry.String() != testData.line {
+			t.Errorf("Expected %+v to be formatted as %q but was %q", entry, testData.line, entry.String())
+		}
+	}
+
+	for _, line := range []string{
+		"alice:" + hash + ":home",
+		"alice:" + hash + ":shell=/bin/sh",
+		"alice:" + hash + ":home=../bob",
+		"alice:" + hash + ":groups=a,,b",
+		"alice:" + hash + ":expires=31.01.2030",
+	} {
+		if _, _, err := parseCredentialsEntry(line); err == nil {
+			t.Errorf("Expected %q to be invalid", line)
+		}
+	}
+
+	if err := (CredentialsEntry{User: "alice", Password: "secret", Locked: true}).validate(); err == nil {
+		t.Errorf("Expected plaintext passwords not to be lockable")
+	}
+	for _, user := range []string{"", " alice", "a:b"} {
+		if err := (CredentialsEntry{User: user, Password: hash}).validate(); err == nil {
+			t.Errorf("Expected user name %q to be invalid", user)
+		}
+	}
+
+	expires := CredentialsEntry{Expires: time.Date(2030, 1, 31, 0, 0, 0, 0, time.UTC)}
+	if expires.Expired(time.Date(2030, 1, 30, 23, 59, 59, 0, time.UTC)) || !expires.Expired(time.Date(2030, 1, 31, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the user to expire at the beginning of the expiry date")
+	}
+}
+
+func TestCredentialsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "f3-credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ftp-credentials.txt")
+	if err := ioutil.WriteFile(path, []byte("# FTP users\nalice:secret\nbob:first\nbob:second\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, 0640); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := OpenCredentialsFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry, _ := file.Entry("bob"); entry.Password != "second" {
+		t.Errorf("Expected the last credentials of bob to count but were %+v", entry)
+	}
+	if err := file.Put(CredentialsEntry{User: "bob", Password: hash, Locked: true, Groups: []string{"partners"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Put(CredentialsEntry{User: "carol", Password: hash}); err != nil {
+		t.Fatal(err)
+	}
+	if !file.Remove("alice") || file.Remove("dave") {
+		t.Errorf("Expected only existing users to be removed")
+	}
+	if err := file.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "# FTP users\nbob:!" + hash + ":groups=partners\ncarol:" + hash + "\n"
+	if string(raw) != expected {
+		t.Errorf("Expected the file to contain %q but was %q", expected, raw)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("Expected the permissions of the file to be kept: %v %v", info.Mode(), err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("Expected no temporary files to be left but were %d files", len(files))
+	}
+
+	auth, err := AuthenticatorFromString(string(raw) + "dave:!" + hash + "\neve:" + hash + ":expires=2000-01-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for user, valid := range map[string]bool{"bob": false, "carol": true, "dave": false, "eve": false} {
+		if ok, err := auth.CheckPasswd(user, "secret"); ok != valid {
+			t.Errorf("Expected validity of %s to be %v: %v", user, valid, err)
+		}
+	}
+
+	identity, err := auth.Authenticate("carol", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.User != "carol" || identity.Home != "" || identity.Groups != nil {
+		t.Errorf("Unexpected identity %+v", identity)
+	}
+	if err := auth.validate(&Config{}); err == nil || !strings.Contains(err.Error(), "partners") {
+		t.Errorf("Expected unknown groups in the credentials file to be rejected: %v", err)
+	}
+	if err := auth.validate(&Config{Groups: map[string]GroupConfig{"partners": {}}}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEditCredentialsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "f3-credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ftp-credentials.txt")
+	if err := ioutil.WriteFile(path, nil, 0640); err != nil {
+		t.Fatal(err)
+	}
+	owned := os.Geteuid() == 0
+	if owned {
+		// the service user owns the file, which is edited by root
+		if err := os.Chown(path, 1234, 5678); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := []string{"alice", "bob", "carol", "dave", "eve", "frank"}
+	done := make(chan error, len(users))
+	for _, user := range users {
+		go func(user string) {
+			done <- EditCredentialsFile(path, func(file *CredentialsFile) error {
+				// widen the window in which an unlocked edit would be lost
+				time.Sleep(10 * time.Millisecond)
+				return file.Put(CredentialsEntry{User: user, Password: hash})
+			})
+		}(user)
+	}
+	for range users {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file, err := OpenCredentialsFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries := file.Entries(); len(entries) != len(users) {
+		t.Errorf("Expected all %d concurrent edits to be saved but were %v", len(users), entries)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("Expected the permissions of the file to be kept but were %v", info.Mode())
+	}
+	if stat := info.Sys().(*syscall.Stat_t); owned && (stat.Uid != 1234 || stat.Gid != 5678) {
+		t.Errorf("Expected the owner of the file to be kept but was %d:%d", stat.Uid, stat.Gid)
+	}
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+const (
+	// metadataMD5 is the object metadata key of the hex encoded MD5 digest of an object's contents.
+	metadataMD5 = "f3-md5"
+	// metadataSHA256 is the object metadata key of the hex encoded SHA-256 digest of an object's contents.
+	metadataSHA256 = "f3-sha256"
+)
+
+// digest computes the MD5 and SHA-256 digests as well as the size of the data written to it.
+type digest struct {
+	md5    hash.Hash
+	sha256 hash.Hash
+	size   int64
+}
+
+func newDigest() *digest {
+	return &digest{
+		md5:    md5.New(),
+		sha256: sha256.New(),
+	}
+}
+
+// Write adds `p` to the digests.
+func (d *digest) Write(p []byte) (int, error) {
+	d.md5.Write(p)
+	d.sha256.Write(p)
+	d.size += int64(len(p))
+	return len(p), nil
+}
+
+// contentMD5 returns the base64 encoded MD5 digest of `data` as expected by the `Content-MD5` header.
+func contentMD5(data []byte) *string {
+	sum := md5.Sum(data)
+	return aws.String(base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+// setMetadata stores the hex encoded digests in the object metadata `metadata`.
+func (d *digest) setMetadata(metadata map[string]*string) {
+	metadata[metadataMD5] = aws.String(hex.EncodeToString(d.md5.Sum(nil)))
+	metadata[metadataSHA256] = aws.String(hex.EncodeToString(d.sha256.Sum(nil)))
+}
+
+// metadataValue returns the value of the object metadata `name`.
+// Metadata keys are compared case-insensitively because they are transferred as HTTP headers.
+func metadataValue(metadata map[string]*string, name string) string {
+	for key, value := range metadata {
+		if strings.EqualFold(key, name) {
+			return aws.StringValue(value)
+		}
+	}
+	return ""
+}
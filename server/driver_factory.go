@@ -3,13 +3,17 @@ package server
 import (
 	"errors"
 	"fmt"
+	"net"
 	"net/url"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	ftp "github.com/goftp/server"
 	goErrors "github.com/pkg/errors"
@@ -26,31 +30,67 @@ const (
 // DriverFactory builds FTP drivers.
 // Implements https://godoc.org/github.com/goftp/server#DriverFactory
 type DriverFactory struct {
-	featureFlags      int
-	noOverwrite       bool
-	awsCredentials    *credentials.Credentials
-	s3PathStyle       bool
-	s3Region          string
-	s3Endpoint        string
-	hostname          string
-	bucketName        string
-	bucketURL         *url.URL
-	DisableCloudWatch bool
+	featureFlags       int
+	noOverwrite        bool
+	conditionalWrites  bool
+	recursiveRemoveDir bool
+	softDelete         bool
+	pendingUploads     *pendingUploads
+	reservations       *keyReservations
+	sse                *serverSideEncryption
+	encryption         *envelopeEncryption
+	configFile         string
+	settings           *currentSettings
+	identities         *identities
+	controlConns       *controlConnHandoff
+	awsCredentials     *credentials.Credentials
+	s3PathStyle        bool
+	s3Region           string
+	s3Endpoint         string
+	hostname           string
+	ftpGroup           string
+	homeTemplate       string
+	showUploader       bool
+	bucketName         string
+	bucketURL          *url.URL
+	DisableCloudWatch  bool
 }
 
-// NewDriver returns a new FTP driver.
-func (d DriverFactory) NewDriver() (ftp.Driver, error) {
-	logrus.Debugf("Trying to create an aws session with: Region: %q, PathStyle: %v, Endpoint: %q", d.s3Region, d.s3PathStyle, d.s3Endpoint)
+// newS3Client returns a client of the bucket's s3 endpoint.
+func (d DriverFactory) newS3Client() (*s3.S3, error) {
+	return newS3Client(d.s3Region, d.s3Endpoint, d.s3PathStyle, d.awsCredentials)
+}
+
+// newS3Client returns a client of the s3 endpoint `endpoint` in region `region`.
+func newS3Client(region, endpoint string, pathStyle bool, awsCredentials *credentials.Credentials) (*s3.S3, error) {
+	logrus.Debugf("Trying to create an aws session with: Region: %q, PathStyle: %v, Endpoint: %q", region, pathStyle, endpoint)
 	s3Session, err := session.NewSession(&aws.Config{
-		Region:           aws.String(d.s3Region),
-		S3ForcePathStyle: aws.Bool(d.s3PathStyle),
-		Endpoint:         aws.String(d.s3Endpoint),
-		Credentials:      d.awsCredentials,
+		Region:           aws.String(region),
+		S3ForcePathStyle: aws.Bool(pathStyle),
+		Endpoint:         aws.String(endpoint),
+		Credentials:      awsCredentials,
+		// each uploaded part is sent with its MD5 and SHA-256 checksum, so that corrupted uploads are rejected
+		S3DisableContentMD5Validation: aws.Bool(false),
 	})
+	if err != nil {
+		return nil, err
+	}
+	return s3.New(s3Session), nil
+}
+
+// NewDriver returns a new FTP driver.
+func (d DriverFactory) NewDriver() (ftp.Driver, error) {
+	s3Client, err := d.newS3Client()
+	if err != nil {
+		return nil, goErrors.Wrapf(err, "Failed to instantiate driver")
+	}
+	sessionID, err := newSessionID()
 	if err != nil {
 		return nil, goErrors.Wrapf(err, "Failed to instantiate driver")
 	}
-	s3Client := s3.New(s3Session)
+
+	// sessions keep the settings they were started with, see Reload
+	current := d.settings.get()
 
 	var metricsSender MetricsSender
 	if d.DisableCloudWatch {
@@ -69,31 +109,154 @@ func (d DriverFactory) NewDriver() (ftp.Driver, error) {
 			return nil, goErrors.Wrapf(err, "Failed to instantiate cloudwatch sender")
 		}
 	}
-	return S3Driver{
-		featureFlags: d.featureFlags,
-		noOverwrite:  d.noOverwrite,
-		s3:           s3Client,
-		uploader:     s3manager.NewUploaderWithClient(s3Client),
-		metrics:      metricsSender,
-		bucketName:   d.bucketName,
-		bucketURL:    d.bucketURL,
-	}, nil
+	driver := &S3Driver{
+		featureFlags:       d.featureFlags,
+		noOverwrite:        d.noOverwrite,
+		conditionalWrites:  d.conditionalWrites,
+		recursiveRemoveDir: d.recursiveRemoveDir,
+		softDelete:         d.softDelete,
+		pendingUploads:     d.pendingUploads,
+		reservations:       d.reservations,
+		sse:                d.sse,
+		encryption:         d.encryption,
+		config:             current.config,
+		s3:                 s3Client,
+		uploader:           s3manager.NewUploaderWithClient(s3Client),
+		metrics:            metricsSender,
+		hostname:           d.hostname,
+		sessionID:          sessionID,
+		group:              d.ftpGroup,
+		homeTemplate:       d.homeTemplate,
+		showUploader:       d.showUploader,
+		bucketName:         d.bucketName,
+		bucketURL:          d.bucketURL,
+		mounts:             current.mounts,
+		identities:         d.identities,
+	}
+	if d.controlConns != nil {
+		if conn := d.controlConns.take(); conn != nil {
+			conn.handler = driver
+			driver.clientIP = clientIP(conn.RemoteAddr())
+		}
+	}
+	return driver, nil
+}
+
+// Auth returns the authenticator of the FTP server, which authenticates users with the provider set by SetAuthProvider or Reload.
+// Only users which have a valid home directory can log in, see reloadableAuth.
+// The drivers resolve all paths relative to the home directory of the user logged in to their connection.
+func (d DriverFactory) Auth() ftp.Auth {
+	return reloadableAuth{settings: d.settings, identities: d.identities, home: d.homeTemplate}
+}
+
+// Listener wraps the listener `l` of the FTP server, so that the drivers can implement additional FTP commands.
+// Connections accepted by the returned listener must be passed to the FTP server,
+// which is done by `Serve` (https://godoc.org/github.com/goftp/server#Server.Serve).
+func (d DriverFactory) Listener(l net.Listener) net.Listener {
+	return &controlListener{
+		Listener: l,
+		handoff:  d.controlConns,
+	}
+}
+
+// AbortStaleUploads aborts the incomplete multipart uploads of the bucket and the mounted buckets which were started before `olderThan`
+// and returns their number. Uploads are only listed if `dryRun` is set.
+// Interrupted uploads kept alive by a running server for resumption are aborted as well if they are old enough.
+func (d DriverFactory) AbortStaleUploads(olderThan time.Duration, dryRun bool) (int, error) {
+	s3Client, err := d.newS3Client()
+	if err != nil {
+		return 0, goErrors.Wrapf(err, "Failed to create s3 client")
+	}
+	before := time.Now().Add(-olderThan)
+	return d.forEachBucket(s3Client, func(driver *S3Driver) (int, error) {
+		return driver.abortStaleUploads(before, dryRun)
+	})
+}
+
+// DeleteStaleTemporaryObjects deletes the temporary objects of no-overwrite uploads of the bucket and the mounted buckets
+// which were uploaded before `olderThan` and returns their number. Objects are only listed if `dryRun` is set.
+func (d DriverFactory) DeleteStaleTemporaryObjects(olderThan time.Duration, dryRun bool) (int, error) {
+	s3Client, err := d.newS3Client()
+	if err != nil {
+		return 0, goErrors.Wrapf(err, "Failed to create s3 client")
+	}
+	before := time.Now().Add(-olderThan)
+	return d.forEachBucket(s3Client, func(driver *S3Driver) (int, error) {
+		return driver.deleteStaleTemporaryObjects(before, dryRun)
+	})
+}
+
+// PurgeTrash deletes the objects in the trash of the bucket and the mounted buckets which were deleted before `olderThan`
+// and returns their number. Objects are only listed if `dryRun` is set.
+func (d DriverFactory) PurgeTrash(olderThan time.Duration, dryRun bool) (int, error) {
+	s3Client, err := d.newS3Client()
+	if err != nil {
+		return 0, goErrors.Wrapf(err, "Failed to create s3 client")
+	}
+	before := time.Now().Add(-olderThan)
+	return d.forEachBucket(s3Client, func(driver *S3Driver) (int, error) {
+		return driver.purgeTrash(before, dryRun)
+	})
+}
+
+// forEachBucket calls `fn` with a driver of the bucket, which uses the client `s3Client`, and with a driver of each mount.
+// It returns the sum of the counts returned by `fn` and stops at the first error.
+func (d DriverFactory) forEachBucket(s3Client s3iface.S3API, fn func(*S3Driver) (int, error)) (int, error) {
+	count, err := fn(&S3Driver{
+		s3:         s3Client,
+		sse:        d.sse,
+		bucketName: d.bucketName,
+		bucketURL:  d.bucketURL,
+	})
+	for _, m := range d.settings.get().mounts {
+		if err != nil {
+			return count, err
+		}
+		var n int
+		n, err = fn(&S3Driver{s3: m.s3, sse: d.sse, bucketName: m.bucketName, bucketURL: m.bucketURL, mount: m})
+		count += n
+	}
+	return count, err
 }
 
 // FactoryConfig wraps config values required to setup an FTP driver and for the s3 backend.
 type FactoryConfig struct {
 	FtpFeatures       string
 	FtpNoOverwrite    bool
-	S3Credentials     string
-	S3BucketURL       string
-	S3Region          string
-	S3UsePathStyle    bool
+	FtpRecursiveRmDir bool
+	// FtpSoftDelete moves deleted files to the trash, see trashKey
+	FtpSoftDelete bool
+	// FtpHome is the home directory of users, see DefaultHome, the whole bucket if empty
+	FtpHome string
+	// FtpGroup is reported as group of all files and directories
+	FtpGroup string
+	// FtpShowUploader lists the uploading FTP user as owner of objects, which requires a HEAD request per listed object
+	FtpShowUploader bool
+	// FtpResumableUploads keeps interrupted uploads alive, so that they can be continued by the same user
+	FtpResumableUploads bool
+	S3Credentials       string
+	S3BucketURL         string
+	S3Region            string
+	S3UsePathStyle      bool
+	// S3ConditionalWrites enables conditional writes (`If-None-Match: *`) to enforce no-overwrite,
+	// which must be supported by the endpoint
+	S3ConditionalWrites bool
+	// S3Encryption is the server-side encryption of written objects (SSES3, SSEKMS or SSEC), the bucket's default if empty
+	S3Encryption string
+	// S3KMSKeyID is the ID of the KMS key for SSE-KMS, the account's default key if empty
+	S3KMSKeyID string
+	// S3CustomerKeyFile is the file containing the key for SSE-C
+	S3CustomerKeyFile string
+	// EncryptionKeyFile is the file containing the master key of the client-side encryption, which is disabled if empty
+	EncryptionKeyFile string
+	// ConfigFile is the configuration file (see Config), which is optional
+	ConfigFile        string
 	DisableCloudWatch bool
 }
 
 // NewDriverFactory returns a DriverFactory.
 func NewDriverFactory(config *FactoryConfig) (DriverFactory, error) {
-	_, factory, err := setupS3(setupFtp(config, &DriverFactory{}, nil))
+	_, factory, err := setupS3(setupFtp(config, &DriverFactory{controlConns: &controlConnHandoff{}, reservations: newKeyReservations(), settings: &currentSettings{}, identities: newIdentities()}, nil))
 	factory.DisableCloudWatch = config.DisableCloudWatch
 	return *factory, err
 }
@@ -103,6 +266,21 @@ func setupFtp(config *FactoryConfig, factory *DriverFactory, err error) (*Factor
 		return config, factory, err
 	}
 	factory.noOverwrite = config.FtpNoOverwrite
+	factory.recursiveRemoveDir = config.FtpRecursiveRmDir
+	factory.softDelete = config.FtpSoftDelete
+	factory.ftpGroup = config.FtpGroup
+	if err := validateHome(config.FtpHome); err != nil {
+		return config, factory, err
+	}
+	factory.homeTemplate = config.FtpHome
+	factory.showUploader = config.FtpShowUploader
+	factory.hostname, err = os.Hostname()
+	if err != nil {
+		return config, factory, goErrors.Wrapf(err, "Failed to get hostname")
+	}
+	if config.FtpResumableUploads {
+		factory.pendingUploads = newPendingUploads()
+	}
 
 	logrus.Debugf("Trying to parse feature set: %q", config.FtpFeatures)
 	featureFlags, err := parseFeatureSet(config.FtpFeatures)
@@ -111,6 +289,24 @@ func setupFtp(config *FactoryConfig, factory *DriverFactory, err error) (*Factor
 	}
 	factory.featureFlags = featureFlags
 
+	if config.EncryptionKeyFile != "" {
+		encryption, err := newEnvelopeEncryption(config.EncryptionKeyFile)
+		if err != nil {
+			return config, factory, goErrors.Wrapf(err, "Failed to set up client-side encryption")
+		}
+		factory.encryption = encryption
+	}
+
+	fileConfig := &Config{}
+	if config.ConfigFile != "" {
+		fileConfig, err = LoadConfig(config.ConfigFile)
+		if err != nil {
+			return config, factory, err
+		}
+	}
+	factory.configFile = config.ConfigFile
+	factory.settings.set(settings{config: fileConfig})
+
 	return config, factory, nil
 }
 
@@ -178,15 +374,85 @@ func setupS3(config *FactoryConfig, factory *DriverFactory, err error) (*Factory
 	factory.bucketURL = bucketURL
 
 	// retrieve bucket name and endpoint from bucket FQDN
-	pair = strings.SplitN(bucketURL.Host, ".", 2)
-	if len(pair) != 2 {
+	bucketName, endpoint, err := parseBucketURL(bucketURL)
+	if err != nil || endpoint == "" {
 		return config, factory, fmt.Errorf("Not a fully qualified bucket name (e.g. 'bucket.host.domain'): %q", bucketURL.String())
 	}
-	bucketName, endpoint := pair[0], fmt.Sprintf("%s://%s", bucketURL.Scheme, pair[1])
 	factory.bucketName = bucketName
 	factory.s3Endpoint = endpoint
 	factory.s3Region = config.S3Region
 	factory.s3PathStyle = config.S3UsePathStyle
+	factory.conditionalWrites = config.S3ConditionalWrites
+
+	sse, err := newServerSideEncryption(config.S3Encryption, config.S3KMSKeyID, config.S3CustomerKeyFile)
+	if err != nil {
+		return config, factory, goErrors.Wrapf(err, "Failed to set up server-side encryption")
+	}
+	if sse.customerAlgorithm() != nil && bucketURL.Scheme != "https" {
+		return config, factory, fmt.Errorf("%s requires an https bucket URL: %q", SSEC, bucketURL.String())
+	}
+	factory.sse = sse
+
+	current := factory.settings.get()
+	if current.mounts, err = factory.newMounts(current.config); err != nil {
+		return config, factory, err
+	}
+	factory.settings.set(current)
 
 	return config, factory, nil
 }
+
+// newMounts returns the mounts of the configuration `config`.
+func (d DriverFactory) newMounts(config *Config) ([]*mount, error) {
+	mounts := []*mount{}
+	for _, mountConfig := range config.Mounts {
+		mount, err := d.newMount(mountConfig)
+		if err != nil {
+			return nil, goErrors.Wrapf(err, "Failed to mount %q at %q", mountConfig.Bucket, mountConfig.Path)
+		}
+		mounts = append(mounts, mount)
+	}
+	return mounts, nil
+}
+
+// newMount returns the mount configured by `config` with a client of the mounted bucket's s3 endpoint.
+func (d DriverFactory) newMount(config MountConfig) (*mount, error) {
+	mountURL, err := url.Parse(config.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	bucketName, endpoint, err := parseBucketURL(mountURL)
+	if err != nil {
+		return nil, err
+	}
+	if config.Endpoint != "" {
+		endpoint = config.Endpoint
+	} else if endpoint == "" {
+		endpoint = d.s3Endpoint
+	}
+	region := d.s3Region
+	if config.Region != "" {
+		region = config.Region
+	}
+	awsCredentials := d.awsCredentials
+	if config.Credentials != "" {
+		pair := strings.SplitN(config.Credentials, ":", 2)
+		awsCredentials = credentials.NewStaticCredentials(pair[0], pair[1], "")
+	}
+	s3Client, err := newS3Client(region, endpoint, d.s3PathStyle, awsCredentials)
+	if err != nil {
+		return nil, err
+	}
+	// the customer key is sent with every request, like for the bucket
+	if resolved, err := url.Parse(s3Client.Endpoint); d.sse.customerAlgorithm() != nil && (err != nil || resolved.Scheme != "https") {
+		return nil, fmt.Errorf("%s requires an https endpoint: %q", SSEC, s3Client.Endpoint)
+	}
+	return &mount{
+		path:       config.Path,
+		prefix:     mountURL.Path,
+		bucketName: bucketName,
+		bucketURL:  &url.URL{Scheme: mountURL.Scheme, Host: mountURL.Host},
+		s3:         s3Client,
+		uploader:   s3manager.NewUploaderWithClient(s3Client),
+	}, nil
+}
@@ -69,13 +69,13 @@ func TestDriverFactory(t *testing.T) {
 		},
 		{
 			FactoryConfig{
-				DefaultFeatureSet,
-				false,
-				"access:secret",
-				"https://some-bucket.somewhere.com",
-				DefaultRegion,
-				true,
-				true,
+				FtpFeatures:       DefaultFeatureSet,
+				FtpNoOverwrite:    false,
+				S3Credentials:     "access:secret",
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          DefaultRegion,
+				S3UsePathStyle:    true,
+				DisableCloudWatch: true,
 			},
 			"some-bucket",
 			"valid-minimal-config",
@@ -83,13 +83,13 @@ func TestDriverFactory(t *testing.T) {
 		},
 		{
 			FactoryConfig{
-				"ls,rm,mkdir,get",
-				false,
-				"access:secret",
-				"https://another-bucket.somewhere.in.some.datacenter.domain.com",
-				"us-east-1",
-				false,
-				true,
+				FtpFeatures:       "ls,rm,mkdir,get",
+				FtpNoOverwrite:    false,
+				S3Credentials:     "access:secret",
+				S3BucketURL:       "https://another-bucket.somewhere.in.some.datacenter.domain.com",
+				S3Region:          "us-east-1",
+				S3UsePathStyle:    false,
+				DisableCloudWatch: true,
 			},
 			"another-bucket",
 			"valid-config",
@@ -0,0 +1,365 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+const (
+	// metadataEncryption is the cipher of an object encrypted by the driver.
+	metadataEncryption = "f3-encryption"
+	// metadataChunkSize is the size of the plaintext chunks which are encrypted separately.
+	metadataChunkSize = "f3-chunk-size"
+	// metadataDataKey is the object's data key, encrypted with the master key.
+	metadataDataKey = "f3-data-key"
+	// metadataMasterKeyID identifies the master key which encrypted the data key.
+	metadataMasterKeyID = "f3-master-key-id"
+
+	encryptionCipher = "AES-256-GCM"
+	// chunkOverhead is the size of the authentication tag of each chunk
+	chunkOverhead = 16
+)
+
+var (
+	// encryptionChunkSize is the size of the plaintext chunks.
+	// Each chunk is sealed separately, so that ranges of an object can be decrypted.
+	// All objects must use the same chunk size, because the plaintext size is derived from the ciphertext size.
+	encryptionChunkSize = 64 * 1024
+)
+
+// envelopeEncryption encrypts the objects on the client side, i.e. the bucket only holds ciphertext.
+// Each object is encrypted with its own random data key, which is stored in the object's metadata
+// encrypted with the master key.
+//
+// The plaintext is split into chunks of `encryptionChunkSize` bytes which are sealed with AES-256-GCM.
+// The nonce of a chunk is its index and the last chunk is marked as such, so that chunks can neither be
+// reordered nor be cut off. Each chunk grows by the size of its authentication tag.
+type envelopeEncryption struct {
+	masterKey   cipher.AEAD
+	masterKeyID string
+}
+
+// newEnvelopeEncryption returns the encryption with the master key from `keyFile`,
+// which contains 32 raw bytes or base64 encoded.
+func newEnvelopeEncryption(keyFile string) (*envelopeEncryption, error) {
+	key, err := readKeyFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	masterKey, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	id := sha256.Sum256(key)
+	return &envelopeEncryption{
+		masterKey:   masterKey,
+		masterKeyID: hex.EncodeToString(id[:8]),
+	}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create cipher")
+	}
+	return cipher.NewGCM(block)
+}
+
+// isEncrypted returns true if the object with metadata `metadata` was encrypted by the driver.
+func isEncrypted(metadata map[string]*string) bool {
+	return metadataValue(metadata, metadataEncryption) != ""
+}
+
+// plaintextSize returns the size of the plaintext of an object of `size` bytes with metadata `metadata`.
+// The size is returned as is if encryption is disabled or if the object is not encrypted,
+// e.g. because it was stored before encryption was enabled.
+func (e *envelopeEncryption) plaintextSize(size int64, metadata map[string]*string) int64 {
+	if !isEncrypted(metadata) {
+		return size
+	}
+	return e.listedSize(size)
+}
+
+// listedSize returns the size of the plaintext of a listed object of `size` bytes whose metadata could not be retrieved.
+// Such objects are assumed to be encrypted if encryption is enabled, see listedMetadata.
+// The size is returned as is if encryption is disabled.
+func (e *envelopeEncryption) listedSize(size int64) int64 {
+	if e == nil {
+		return size
+	}
+	sealedSize := int64(encryptionChunkSize + chunkOverhead)
+	chunks, remainder := size/sealedSize, size%sealedSize
+	plaintext := chunks * int64(encryptionChunkSize)
+	if remainder > chunkOverhead {
+		plaintext += remainder - chunkOverhead
+	}
+	return plaintext
+}
+
+// getDecrypted returns the plaintext of the object with key `key` starting at offset `offset` and its remaining size.
+// Only the ciphertext starting at the chunk which contains the offset is requested.
+// Objects which are not encrypted are returned as they are.
+func (d *S3Driver) getDecrypted(key string, offset int64) (int64, io.ReadCloser, error) {
+	fqdn := d.fqdn(key)
+	head, err := d.s3.HeadObject(&s3.HeadObjectInput{
+		Bucket:               aws.String(d.bucketName),
+		Key:                  aws.String(key),
+		SSECustomerAlgorithm: d.sse.customerAlgorithm(),
+		SSECustomerKey:       d.sse.customerKeyValue(),
+	})
+	if err != nil {
+		return -1, nil, errors.Wrapf(err, "Failed to get object %q", fqdn)
+	}
+	encrypted := isEncrypted(head.Metadata)
+	size := d.encryption.plaintextSize(aws.Int64Value(head.ContentLength), head.Metadata)
+	if offset > size {
+		return -1, nil, fmt.Errorf("offset %d is beyond the end of object %q", offset, fqdn)
+	}
+	if offset == size {
+		return 0, ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(d.bucketName),
+		Key:    aws.String(key),
+		// the ciphertext must belong to the data key of the metadata
+		IfMatch:              head.ETag,
+		SSECustomerAlgorithm: d.sse.customerAlgorithm(),
+		SSECustomerKey:       d.sse.customerKeyValue(),
+	}
+	if offset > 0 && encrypted {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-", chunkOffset(offset)))
+	} else if offset > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := d.s3.GetObject(input)
+	if err != nil {
+		return -1, nil, errors.Wrapf(err, "Failed to get object %q", fqdn)
+	}
+	if !encrypted {
+		return size - offset, resp.Body, nil
+	}
+	body, err := d.encryption.decrypt(resp.Body, resp.Metadata, offset)
+	if err != nil {
+		resp.Body.Close()
+		return -1, nil, errors.Wrapf(err, "Failed to decrypt %q", fqdn)
+	}
+	return size - offset, body, nil
+}
+
+// ciphertextSize returns the size of the ciphertext of `size` bytes of plaintext.
+// The size is returned as is if encryption is disabled.
+func (e *envelopeEncryption) ciphertextSize(size int64) int64 {
+	if e == nil {
+		return size
+	}
+	chunks := (size + int64(encryptionChunkSize) - 1) / int64(encryptionChunkSize)
+	if chunks == 0 {
+		// empty plaintext is sealed as a single empty chunk
+		chunks = 1
+	}
+	return size + chunks*chunkOverhead
+}
+
+// encrypt returns the ciphertext of `plaintext` and adds the data key and cipher parameters to `metadata`.
+func (e *envelopeEncryption) encrypt(plaintext io.Reader, metadata map[string]*string) (io.Reader, error) {
+	dataKey := make([]byte, keySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, errors.Wrap(err, "Failed to generate data key")
+	}
+	nonce := make([]byte, e.masterKey.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrap(err, "Failed to generate nonce")
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata[metadataEncryption] = aws.String(encryptionCipher)
+	metadata[metadataChunkSize] = aws.String(strconv.Itoa(encryptionChunkSize))
+	metadata[metadataDataKey] = aws.String(base64.StdEncoding.EncodeToString(e.masterKey.Seal(nonce, nonce, dataKey, nil)))
+	metadata[metadataMasterKeyID] = aws.String(e.masterKeyID)
+	return &encryptingReader{
+		plaintext: bufio.NewReader(plaintext),
+		aead:      aead,
+		chunk:     make([]byte, encryptionChunkSize),
+	}, nil
+}
+
+// decrypt returns the plaintext of an object with metadata `metadata` starting at plaintext offset `offset`.
+// `ciphertext` must start at the chunk which contains the offset, see `chunkOffset`.
+func (e *envelopeEncryption) decrypt(ciphertext io.ReadCloser, metadata map[string]*string, offset int64) (io.ReadCloser, error) {
+	if metadataValue(metadata, metadataEncryption) != encryptionCipher {
+		return nil, fmt.Errorf("object is not encrypted with %s", encryptionCipher)
+	}
+	if metadataValue(metadata, metadataChunkSize) != strconv.Itoa(encryptionChunkSize) {
+		return nil, fmt.Errorf("object is encrypted with unsupported chunk size %q", metadataValue(metadata, metadataChunkSize))
+	}
+	if id := metadataValue(metadata, metadataMasterKeyID); id != e.masterKeyID {
+		return nil, fmt.Errorf("object is encrypted with master key %q instead of %q", id, e.masterKeyID)
+	}
+	sealedKey, err := base64.StdEncoding.DecodeString(metadataValue(metadata, metadataDataKey))
+	nonceSize := e.masterKey.NonceSize()
+	if err != nil || len(sealedKey) < nonceSize {
+		return nil, fmt.Errorf("object has a malformed data key")
+	}
+	dataKey, err := e.masterKey.Open(nil, sealedKey[:nonceSize], sealedKey[nonceSize:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt the data key of the object")
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptingReader{
+		ciphertext: bufio.NewReader(ciphertext),
+		closer:     ciphertext,
+		aead:       aead,
+		index:      uint64(offset / int64(encryptionChunkSize)),
+		skip:       int(offset % int64(encryptionChunkSize)),
+		chunk:      make([]byte, encryptionChunkSize+aead.Overhead()),
+	}, nil
+}
+
+// chunkOffset returns the offset of the ciphertext of the chunk which contains plaintext offset `offset`.
+func chunkOffset(offset int64) int64 {
+	return offset / int64(encryptionChunkSize) * int64(encryptionChunkSize+chunkOverhead)
+}
+
+// chunkNonce returns the nonce of chunk `index`.
+func chunkNonce(index uint64, size int) []byte {
+	nonce := make([]byte, size)
+	binary.BigEndian.PutUint64(nonce[size-8:], index)
+	return nonce
+}
+
+// chunkData returns the additional authenticated data of a chunk, which marks the last chunk of an object.
+func chunkData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// encryptingReader reads plaintext and returns the sealed chunks.
+type encryptingReader struct {
+	plaintext *bufio.Reader
+	aead      cipher.AEAD
+	index     uint64
+	chunk     []byte
+	sealed    []byte
+	done      bool
+}
+
+func (r *encryptingReader) Read(p []byte) (int, error) {
+	for len(r.sealed) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.seal(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.sealed)
+	r.sealed = r.sealed[n:]
+	return n, nil
+}
+
+// seal reads and seals the next chunk.
+func (r *encryptingReader) seal() error {
+	n, err := io.ReadFull(r.plaintext, r.chunk)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	last := err != nil
+	if !last {
+		// a full chunk is the last one if no data follows
+		if _, err := r.plaintext.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+	r.sealed = r.aead.Seal(nil, chunkNonce(r.index, r.aead.NonceSize()), r.chunk[:n], chunkData(last))
+	r.index++
+	r.done = last
+	return nil
+}
+
+// decryptingReader reads sealed chunks and returns the plaintext, skipping the first `skip` bytes.
+// It fails if any chunk is not authentic or if the ciphertext does not end with the last chunk.
+type decryptingReader struct {
+	ciphertext *bufio.Reader
+	closer     io.Closer
+	aead       cipher.AEAD
+	index      uint64
+	skip       int
+	chunk      []byte
+	plaintext  []byte
+	done       bool
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	for len(r.plaintext) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plaintext)
+	r.plaintext = r.plaintext[n:]
+	return n, nil
+}
+
+// open reads and opens the next chunk.
+func (r *decryptingReader) open() error {
+	n, err := io.ReadFull(r.ciphertext, r.chunk)
+	if err == io.EOF {
+		return errors.Wrapf(io.ErrUnexpectedEOF, "ciphertext ends before its last chunk")
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	last := err != nil
+	if !last {
+		if _, err := r.ciphertext.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+	plaintext, err := r.aead.Open(r.chunk[:0], chunkNonce(r.index, r.aead.NonceSize()), r.chunk[:n], chunkData(last))
+	if err != nil {
+		return fmt.Errorf("chunk %d of the ciphertext is not authentic", r.index)
+	}
+	if r.skip > len(plaintext) {
+		return fmt.Errorf("offset is beyond the end of the plaintext")
+	}
+	r.plaintext = plaintext[r.skip:]
+	r.skip = 0
+	r.index++
+	r.done = last
+	return nil
+}
+
+func (r *decryptingReader) Close() error {
+	return r.closer.Close()
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	ftp "github.com/goftp/server"
+	"github.com/sirupsen/logrus"
+)
+
+func newTestEncryption(t *testing.T, key string) *envelopeEncryption {
+	dir, err := ioutil.TempDir("", "f3-encryption")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "master.key")
+	if err := ioutil.WriteFile(keyFile, []byte(key), 0600); err != nil {
+		t.Fatal(err)
+	}
+	encryption, err := newEnvelopeEncryption(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encryption
+}
+
+func TestEnvelopeEncryption(t *testing.T) {
+	defer func(chunkSize int) {
+		encryptionChunkSize = chunkSize
+	}(encryptionChunkSize)
+	encryptionChunkSize = 16
+
+	encryption := newTestEncryption(t, "0123456789abcdef0123456789abcdef")
+	for _, size := range []int{0, 1, 15, 16, 17, 48, 50} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+		metadata := map[string]*string{}
+		reader, err := encryption.encrypt(bytes.NewReader(plaintext), metadata)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ciphertext, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(ciphertext)) != encryption.ciphertextSize(int64(size)) {
+			t.Errorf("Size %d: expected %d bytes of ciphertext but were %d", size, encryption.ciphertextSize(int64(size)), len(ciphertext))
+		}
+		if plaintextSize := encryption.plaintextSize(int64(len(ciphertext)), metadata); plaintextSize != int64(size) {
+			t.Errorf("Size %d: plaintext size of the ciphertext is %d", size, plaintextSize)
+		}
+		if plaintextSize := encryption.plaintextSize(int64(len(ciphertext)), nil); plaintextSize != int64(len(ciphertext)) {
+			t.Errorf("Size %d: size of an unencrypted object is %d instead of %d", size, plaintextSize, len(ciphertext))
+		}
+		// shorter plaintexts may be contained by chance
+		if size >= 16 && bytes.Contains(ciphertext, plaintext) {
+			t.Errorf("Size %d: ciphertext contains the plaintext", size)
+		}
+
+		for offset := 0; offset < size; offset += 7 {
+			body, err := encryption.decrypt(ioutil.NopCloser(bytes.NewReader(ciphertext[chunkOffset(int64(offset)):])), metadata, int64(offset))
+			if err != nil {
+				t.Fatal(err)
+			}
+			decrypted, err := ioutil.ReadAll(body)
+			if err != nil {
+				t.Errorf("Size %d, offset %d: %s", size, offset, err)
+			}
+			if !bytes.Equal(decrypted, plaintext[offset:]) {
+				t.Errorf("Size %d, offset %d: decrypted data differs from plaintext", size, offset)
+			}
+		}
+
+		damaged := map[string][]byte{
+			"modified": append([]byte{ciphertext[0] ^ 1}, ciphertext[1:]...),
+		}
+		// the ciphertext without its last chunk
+		if lastChunk := (len(ciphertext) - 1) / (encryptionChunkSize + chunkOverhead) * (encryptionChunkSize + chunkOverhead); lastChunk > 0 {
+			damaged["truncated"] = ciphertext[:lastChunk]
+		}
+		for description, data := range damaged {
+			body, err := encryption.decrypt(ioutil.NopCloser(bytes.NewReader(data)), metadata, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ioutil.ReadAll(body); err == nil {
+				t.Errorf("Size %d: %s ciphertext was decrypted", size, description)
+			}
+		}
+		other := newTestEncryption(t, "fedcba9876543210fedcba9876543210")
+		if _, err := other.decrypt(ioutil.NopCloser(bytes.NewReader(ciphertext)), metadata, 0); err == nil {
+			t.Errorf("Size %d: ciphertext was decrypted with another master key", size)
+		}
+	}
+}
+
+func TestEncryptedObjects(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	defer func(chunkSize int, partSize int64) {
+		encryptionChunkSize, uploadPartSize = chunkSize, partSize
+	}(encryptionChunkSize, uploadPartSize)
+	encryptionChunkSize, uploadPartSize = 16, 40
+
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	d := S3Driver{
+		featureFlags: featurePut | featureGet | featureList | featureMove,
+		encryption:   newTestEncryption(t, "0123456789abcdef0123456789abcdef"),
+		s3:           &s3Mock{bucket: bucketMock},
+		uploader:     &s3UploaderMock{bucket: bucketMock},
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+
+	contents := map[string]string{
+		"empty.txt": "",
+		"small.txt": "some secret",
+		"large.txt": strings.Repeat("a secret which does not fit into a single part ", 3),
+	}
+	for key, data := range contents {
+		size, err := d.PutFile(key, strings.NewReader(data), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != int64(len(data)) {
+			t.Errorf("%s: expected size %d but was %d", key, len(data), size)
+		}
+		object, _ := bucketMock.Get(key)
+		if len(data) > 0 && bytes.Contains(object.data, []byte(data)) {
+			t.Errorf("%s: bucket holds plaintext", key)
+		}
+	}
+	if err := d.Rename("large.txt", "renamed.txt"); err != nil {
+		t.Fatal(err)
+	}
+	contents["renamed.txt"] = contents["large.txt"]
+	delete(contents, "large.txt")
+
+	// objects which were stored before encryption was enabled are reported and served as they are
+	legacy := "a file which was stored before encryption was enabled"
+	bucketMock.Put("legacy.txt", objectMock{data: []byte(legacy), lastMod: time.Now(), etag: "legacy"})
+	contents["legacy.txt"] = legacy
+	listed := 0
+	err := d.ListDir("/", func(info ftp.FileInfo) error {
+		if info.Size() != int64(len(contents[info.Name()])) {
+			t.Errorf("%s: listed with size %d instead of %d", info.Name(), info.Size(), len(contents[info.Name()]))
+		}
+		listed++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listed != len(contents) {
+		t.Errorf("Expected %d listed files but were %d", len(contents), listed)
+	}
+	for key, data := range contents {
+		info, err := d.Stat(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != int64(len(data)) {
+			t.Errorf("%s: stat reports size %d instead of %d", key, info.Size(), len(data))
+		}
+		sum, _, err := d.Hash(key, hashSHA256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := sha256.Sum256([]byte(data)); sum != hex.EncodeToString(expected[:]) {
+			t.Errorf("%s: digest is not the one of the plaintext", key)
+		}
+		for _, offset := range []int{0, 1, 16, 17, len(data)} {
+			if offset > len(data) {
+				continue
+			}
+			size, body, err := d.GetFile(key, int64(offset))
+			if err != nil {
+				t.Fatalf("%s, offset %d: %s", key, offset, err)
+			}
+			decrypted, err := ioutil.ReadAll(body)
+			if err != nil {
+				t.Fatalf("%s, offset %d: %s", key, offset, err)
+			}
+			if string(decrypted) != data[offset:] || size != int64(len(data)-offset) {
+				t.Errorf("%s, offset %d: expected %q but was %q (%d bytes)", key, offset, data[offset:], decrypted, size)
+			}
+		}
+	}
+
+	if _, err := d.PutFile("small.txt", strings.NewReader("more"), true); err == nil {
+		t.Errorf("Appending to an encrypted object succeeded")
+	}
+}
@@ -0,0 +1,72 @@
+package server
+
+// validateFeatures returns an error if the optional feature set `featureSet` is invalid.
+func validateFeatures(featureSet string) error {
+	if featureSet == "" {
+		return nil
+	}
+	_, err := parseFeatureSet(featureSet)
+	return err
+}
+
+// features returns the feature flags of the logged in user, see Config.userFeatures.
+func (d *S3Driver) features() int {
+	return d.config.userFeatures(d.user(), d.featureFlags)
+}
+
+// preventOverwrite returns true if the logged in user must not overwrite files, see Config.userNoOverwrite.
+func (d *S3Driver) preventOverwrite() bool {
+	return d.config.userNoOverwrite(d.user(), d.noOverwrite)
+}
+
+// userGroups returns the settings of the groups `username` is a member of.
+func (c *Config) userGroups(username string) []GroupConfig {
+	user, _ := c.user(username)
+	groups := make([]GroupConfig, 0, len(user.Groups))
+	for _, name := range user.Groups {
+		if group, ok := c.Groups[name]; ok {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// userFeatures returns the feature flags of `username`: the user's own feature set if configured,
+// otherwise the union of the feature sets of the user's groups, otherwise `defaults`.
+func (c *Config) userFeatures(username string, defaults int) int {
+	if user, ok := c.user(username); ok && user.Features != "" {
+		featureFlags, _ := parseFeatureSet(user.Features)
+		return featureFlags
+	}
+	featureFlags, configured := 0, false
+	for _, group := range c.userGroups(username) {
+		if group.Features != "" {
+			groupFlags, _ := parseFeatureSet(group.Features)
+			featureFlags |= groupFlags
+			configured = true
+		}
+	}
+	if configured {
+		return featureFlags
+	}
+	return defaults
+}
+
+// userNoOverwrite returns whether `username` must not overwrite files: the user's own setting if configured,
+// otherwise true if any of the user's groups prevents overwriting, otherwise `defaults`.
+func (c *Config) userNoOverwrite(username string, defaults bool) bool {
+	if user, ok := c.user(username); ok && user.NoOverwrite != nil {
+		return *user.NoOverwrite
+	}
+	noOverwrite, configured := false, false
+	for _, group := range c.userGroups(username) {
+		if group.NoOverwrite != nil {
+			noOverwrite = noOverwrite || *group.NoOverwrite
+			configured = true
+		}
+	}
+	if configured {
+		return noOverwrite
+	}
+	return defaults
+}
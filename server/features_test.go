@@ -0,0 +1,106 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestUserFeatures(t *testing.T) {
+	yes, no := true, false
+	config := &Config{
+		Users: map[string]UserConfig{
+			"alice": {Features: "ls,get", Groups: []string{"uploaders"}},
+			"bob":   {Groups: []string{"readers", "uploaders"}},
+			"carol": {Groups: []string{"readers", "unknown"}, NoOverwrite: &no},
+			"dave":  {Groups: []string{"archivists", "uploaders"}},
+		},
+		Groups: map[string]GroupConfig{
+			"readers":    {Features: "cd,ls,get"},
+			"uploaders":  {Features: "put", NoOverwrite: &no},
+			"archivists": {NoOverwrite: &yes},
+		},
+	}
+	defaults := featureList | featureRemove
+	for _, testData := range []struct {
+		user        string
+		features    int
+		noOverwrite bool
+	}{
+		{"alice", featureList | featureGet, false},
+		{"bob", featureChangeDir | featureList | featureGet | featurePut, false},
+		{"carol", featureChangeDir | featureList | featureGet, false},
+		{"dave", featurePut, true},
+		{"eve", defaults, true},
+		{"", defaults, true},
+	} {
+		if actual := config.userFeatures(testData.user, defaults); actual != testData.features {
+			t.Errorf("Expected features %b of %q but were %b", testData.features, testData.user, actual)
+		}
+		if actual := config.userNoOverwrite(testData.user, true); actual != testData.noOverwrite {
+			t.Errorf("Expected no-overwrite of %q to be %v", testData.user, testData.noOverwrite)
+		}
+	}
+	if actual := (*Config)(nil).userFeatures("alice", defaults); actual != defaults {
+		t.Errorf("Expected the default features without configuration but were %b", actual)
+	}
+}
+
+func TestSessionFeatures(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucket := newBucketMock(bucketName)
+	bucket.Put("file.txt", objectMock{data: []byte("file"), lastMod: time.Now(), etag: "file"})
+	yes := true
+	config := &Config{
+		Users: map[string]UserConfig{
+			"reader":   {Features: "ls,get"},
+			"uploader": {Groups: []string{"uploaders"}},
+		},
+		Groups: map[string]GroupConfig{
+			"uploaders": {Features: "ls,get,put", NoOverwrite: &yes},
+		},
+	}
+	credentials, err := AuthenticatorFromString("reader:secret\nuploader:secret\nadmin:secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := startFTPServer(t, func() *S3Driver {
+		return &S3Driver{
+			featureFlags: featureList | featureGet | featurePut | featureRemove,
+			config:       config,
+			s3:           &s3Mock{bucket: bucket},
+			uploader:     &s3UploaderMock{bucket: bucket},
+			metrics:      metricsSenderMock{},
+			bucketName:   bucketName,
+			bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+		}
+	}, credentials)
+
+	for _, testData := range []struct {
+		user      string
+		newFile   int
+		overwrite int
+		remove    int
+	}{
+		{"reader", 450, 450, 550},
+		{"uploader", 226, 450, 550},
+		{"admin", 226, 226, 250},
+	} {
+		c := dialFTP(t, addr, testData.user, "secret")
+		if data, code := c.retrieve("RETR file.txt"); code != 226 || data != "file" {
+			t.Errorf("%s: expected to download the file but got %d %q", testData.user, code, data)
+		}
+		if code := c.store("data", "STOR %s.txt", testData.user); code != testData.newFile {
+			t.Errorf("%s: expected upload of a new file to return %d but was %d", testData.user, testData.newFile, code)
+		}
+		if code := c.store("data", "STOR file.txt"); code != testData.overwrite {
+			t.Errorf("%s: expected overwrite to return %d but was %d", testData.user, testData.overwrite, code)
+		}
+		if code, _ := c.send("DELE %s.txt", testData.user); code != testData.remove {
+			t.Errorf("%s: expected removal to return %d but was %d", testData.user, testData.remove, code)
+		}
+	}
+}
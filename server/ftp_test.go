@@ -0,0 +1,168 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"testing"
+
+	ftp "github.com/goftp/server"
+)
+
+// driverFactoryMock creates the drivers of the test FTP server.
+type driverFactoryMock func() *S3Driver
+
+func (f driverFactoryMock) NewDriver() (ftp.Driver, error) {
+	return f(), nil
+}
+
+// ftpLoggerMock discards the log of the test FTP server.
+type ftpLoggerMock struct{}
+
+func (ftpLoggerMock) Print(sessionID string, message interface{})                  {}
+func (ftpLoggerMock) Printf(sessionID string, format string, v ...interface{})     {}
+func (ftpLoggerMock) PrintCommand(sessionID string, command string, params string) {}
+func (ftpLoggerMock) PrintResponse(sessionID string, code int, message string)     {}
+
+// startFTPServer serves the drivers created by `newDriver` on a local port and returns the server's address.
+// Like for a DriverFactory, the drivers implement the commands which are not supported by goftp, see handleCommand.
+// The server is shut down at the end of the test.
+func startFTPServer(t *testing.T, newDriver func() *S3Driver, auth ftp.Auth) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handoff := &controlConnHandoff{}
+	server := ftp.NewServer(&ftp.ServerOpts{
+		Factory: driverFactoryMock(func() *S3Driver {
+			driver := newDriver()
+			if conn := handoff.take(); conn != nil {
+				conn.handler = driver
+			}
+			return driver
+		}),
+		Auth:     auth,
+		Hostname: "127.0.0.1",
+		Logger:   ftpLoggerMock{},
+	})
+	go server.Serve(&controlListener{Listener: listener, handoff: handoff})
+	t.Cleanup(func() {
+		server.Shutdown()
+	})
+	return listener.Addr().String()
+}
+
+// ftpClient is a minimal FTP client for tests.
+type ftpClient struct {
+	*textproto.Conn
+	t    *testing.T
+	host string
+}
+
+// dialFTP connects to the FTP server at `addr` and logs in with `user` and `password`.
+func dialFTP(t *testing.T, addr, user, password string) *ftpClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	c := &ftpClient{Conn: textproto.NewConn(conn), t: t, host: host}
+	t.Cleanup(func() {
+		c.Close()
+	})
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	c.expect(331, "USER %s", user)
+	c.expect(230, "PASS %s", password)
+	return c
+}
+
+// send sends the command and returns the response code and message.
+func (c *ftpClient) send(format string, args ...interface{}) (int, string) {
+	if _, err := c.Cmd(format, args...); err != nil {
+		c.t.Fatal(err)
+	}
+	code, message, err := c.ReadResponse(0)
+	if err != nil && code == 0 {
+		c.t.Fatal(err)
+	}
+	return code, message
+}
+
+// expect sends the command and fails the test if the response code is not `code`.
+func (c *ftpClient) expect(code int, format string, args ...interface{}) string {
+	actual, message := c.send(format, args...)
+	if actual != code {
+		c.t.Fatalf("%s: expected %d but was %d %s", fmt.Sprintf(format, args...), code, actual, message)
+	}
+	return message
+}
+
+var epsvPattern = regexp.MustCompile(`\(\|\|\|(\d+)\|\)`)
+
+// dataConn opens a passive data connection.
+func (c *ftpClient) dataConn() net.Conn {
+	message := c.expect(229, "EPSV")
+	port := epsvPattern.FindStringSubmatch(message)
+	if port == nil {
+		c.t.Fatalf("Unexpected EPSV response %q", message)
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(c.host, port[1]))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return conn
+}
+
+// retrieve sends the command, e.g. `LIST` or `RETR`, and returns the received data and the final response code.
+func (c *ftpClient) retrieve(format string, args ...interface{}) (string, int) {
+	conn := c.dataConn()
+	defer conn.Close()
+	if code, _ := c.send(format, args...); code != 150 {
+		return "", code
+	}
+	data, err := ioutil.ReadAll(conn)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	code, _ := c.readResponse()
+	return string(data), code
+}
+
+// store sends the command, e.g. `STOR` or `APPE`, transfers `data` and returns the final response code.
+func (c *ftpClient) store(data string, format string, args ...interface{}) int {
+	conn := c.dataConn()
+	defer conn.Close()
+	if code, _ := c.send(format, args...); code != 150 {
+		return code
+	}
+	if _, err := conn.Write([]byte(data)); err != nil {
+		c.t.Fatal(err)
+	}
+	conn.Close()
+	code, _ := c.readResponse()
+	return code
+}
+
+func (c *ftpClient) readResponse() (int, string) {
+	code, message, err := c.ReadResponse(0)
+	if err != nil && code == 0 {
+		c.t.Fatal(err)
+	}
+	return code, message
+}
+
+// listedNames returns the names of the files in the `LIST` output `data`.
+func listedNames(data string) []string {
+	names := []string{}
+	for _, line := range strings.Split(data, "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			names = append(names, fields[len(fields)-1])
+		}
+	}
+	return names
+}
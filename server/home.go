@@ -0,0 +1,81 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultHome is the default home directory template of users, i.e. each user is confined to the prefix `<username>/`.
+const DefaultHome = "{user}/"
+
+// validateHome returns an error if the home directory template `home` could point above the root of the bucket.
+func validateHome(home string) error {
+	home = strings.Trim(home, "/")
+	if home == "" {
+		return nil
+	}
+	for _, element := range strings.Split(home, "/") {
+		if element == "" || element == "." || element == ".." {
+			return fmt.Errorf("invalid home directory %q", home)
+		}
+	}
+	return nil
+}
+
+// validUsername returns an error if `username` can not be part of a key prefix, e.g. because it contains a slash.
+func validUsername(username string) error {
+	if username == "" || username == "." || username == ".." || strings.ContainsAny(username, "/\\") {
+		return fmt.Errorf("user name %q can not be used as home directory", username)
+	}
+	return nil
+}
+
+// homePrefix returns the key prefix of the home directory `home` of `username`, where `{user}` is replaced by the user name.
+// The prefix is empty if the home directory is the root of the bucket, otherwise it ends with a slash.
+func homePrefix(home, username string) string {
+	home = strings.Trim(strings.Replace(home, "{user}", username, -1), "/")
+	if home == "" {
+		return ""
+	}
+	return home + "/"
+}
+
+// home returns the key prefix of the logged in user's home directory, which is the root of all FTP paths of the session.
+// Users are confined to their home directory since paths can never point above their root (see resolvePath).
+// In a mounted bucket, the mounted prefix takes the place of the home directory.
+func (d *S3Driver) home() string {
+	if d.mount != nil {
+		return homePrefix(d.mount.prefix, d.user())
+	}
+	return homePrefix(d.config.userHome(d.user(), d.homeTemplate), d.user())
+}
+
+// userHome returns the home directory template of `username`, the user's own one if configured, otherwise `home`.
+func (c *Config) userHome(username, home string) string {
+	if user, ok := c.user(username); ok && user.Home != "" {
+		return user.Home
+	}
+	return home
+}
+
+// checkUsername returns an error if `username` can not be part of the user's home directory, whose default is `home`,
+// or of the prefix of a mount.
+func (c *Config) checkUsername(username, home string) error {
+	if strings.Contains(c.userHome(username, home), "{user}") || c.mountsUserPrefix() {
+		return validUsername(username)
+	}
+	return nil
+}
+
+// mountsUserPrefix returns true if the mounted prefix of any mount contains the user name.
+func (c *Config) mountsUserPrefix() bool {
+	if c == nil {
+		return false
+	}
+	for _, mount := range c.Mounts {
+		if strings.Contains(mount.Bucket, "{user}") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestHomePrefix(t *testing.T) {
+	for _, testData := range []struct {
+		home     string
+		user     string
+		expected string
+	}{
+		{"{user}/", "alice", "alice/"},
+		{"{user}", "alice", "alice/"},
+		{"/partners/{user}/", "alice", "partners/alice/"},
+		{"shared", "alice", "shared/"},
+		{"/", "alice", ""},
+		{"", "alice", ""},
+	} {
+		if actual := homePrefix(testData.home, testData.user); actual != testData.expected {
+			t.Errorf("Expected home %q of %q to be %q but was %q", testData.home, testData.user, testData.expected, actual)
+		}
+	}
+
+	for _, home := range []string{"../{user}", "a/./{user}", "a//{user}"} {
+		if err := validateHome(home); err == nil {
+			t.Errorf("Expected home %q to be invalid", home)
+		}
+	}
+	for _, user := range []string{"", ".", "..", "a/b", `a\b`} {
+		if err := validUsername(user); err == nil {
+			t.Errorf("Expected user name %q to be invalid", user)
+		}
+	}
+}
+
+func TestHomeAuth(t *testing.T) {
+	credentials, err := AuthenticatorFromString("alice:secret\n../bob:secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := &currentSettings{}
+	current.set(settings{provider: credentials})
+	auth := reloadableAuth{settings: current, identities: newIdentities(), home: DefaultHome}
+	if ok, err := auth.CheckPasswd("alice", "secret"); !ok {
+		t.Errorf("Expected alice to be authenticated: %v", err)
+	}
+	if ok, _ := auth.CheckPasswd("../bob", "secret"); ok {
+		t.Errorf("Expected ../bob to be rejected")
+	}
+	current.set(settings{config: &Config{Users: map[string]UserConfig{"../bob": {Home: "shared/"}}}, provider: credentials})
+	if ok, err := auth.CheckPasswd("../bob", "secret"); !ok {
+		t.Errorf("Expected ../bob to be authenticated with a fixed home: %v", err)
+	}
+}
+
+func TestHomeDirectory(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucket := newBucketMock(bucketName)
+	for _, key := range []string{"alice/a.txt", "bob/b.txt", "top.txt"} {
+		bucket.Put(key, objectMock{data: []byte(key), lastMod: time.Now(), etag: key})
+	}
+	config := &Config{Users: map[string]UserConfig{"admin": {Home: "/"}}}
+	credentials, err := AuthenticatorFromString("alice:secret\nadmin:secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := &currentSettings{}
+	current.set(settings{config: config, provider: credentials})
+	loggedIn := newIdentities()
+	addr := startFTPServer(t, func() *S3Driver {
+		return &S3Driver{
+			featureFlags: featureChangeDir | featureList | featureGet | featurePut | featureMakeDir | featureMove,
+			config:       config,
+			homeTemplate: DefaultHome,
+			s3:           &s3Mock{bucket: bucket},
+			uploader:     &s3UploaderMock{bucket: bucket},
+			metrics:      metricsSenderMock{},
+			bucketName:   bucketName,
+			bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+		}
+	}, reloadableAuth{settings: current, identities: loggedIn, home: DefaultHome})
+
+	alice := dialFTP(t, addr, "alice", "secret")
+	for _, dir := range []string{"/", "..", "/../.."} {
+		alice.expect(250, "CWD %s", dir)
+		if message := alice.expect(257, "PWD"); message != `"/" is the current directory` {
+			t.Errorf("Unexpected working directory: %s", message)
+		}
+		listing, code := alice.retrieve("LIST")
+		if code != 226 {
+			t.Fatalf("Listing failed with %d", code)
+		}
+		if names := listedNames(listing); !reflect.DeepEqual(names, []string{"a.txt"}) {
+			t.Errorf("Expected only the home directory to be listed but was %v", names)
+		}
+	}
+	if _, code := alice.retrieve("RETR ../bob/b.txt"); code != 551 {
+		t.Errorf("Expected the file of another user to be inaccessible but was %d", code)
+	}
+	alice.expect(213, "SIZE /a.txt")
+	alice.expect(257, "MKD ../../dir")
+	if code := alice.store("data", "STOR /../dir/upload.txt"); code != 226 {
+		t.Errorf("Upload failed with %d", code)
+	}
+	alice.expect(350, "RNFR /a.txt")
+	alice.expect(250, "RNTO ../../renamed.txt")
+	alice.expect(250, "CWD dir")
+	if message := alice.expect(257, "PWD"); message != `"/dir" is the current directory` {
+		t.Errorf("Unexpected working directory: %s", message)
+	}
+
+	admin := dialFTP(t, addr, "admin", "secret")
+	listing, code := admin.retrieve("LIST /")
+	if code != 226 {
+		t.Fatalf("Listing failed with %d", code)
+	}
+	names := listedNames(listing)
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, []string{"alice", "bob", "top.txt"}) {
+		t.Errorf("Expected the whole bucket to be listed but was %v", names)
+	}
+
+	keys := []string{}
+	for key := range bucket.List() {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	expected := []string{"alice/dir/", "alice/dir/upload.txt", "alice/renamed.txt", "bob/b.txt", "top.txt"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected objects %v but were %v", expected, keys)
+	}
+}
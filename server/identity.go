@@ -0,0 +1,145 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ErrUnknownUser is the cause of the errors of AuthProviders which do not know the user, see AuthChain.
+var ErrUnknownUser = errors.New("unknown user")
+
+// Identity is an authenticated FTP user with the user's settings.
+// Unset settings fall back to the ones of the configuration file, which take precedence, see Config.withIdentity.
+type Identity struct {
+	// User is the user's name as known to the provider, sessions are only authenticated if it equals the login name
+	User string
+	// Home is the user's home directory, e.g. `partners/{user}/`
+	Home string
+	// Groups are the names of the groups the user is a member of
+	Groups []string
+	// Features is the user's feature set, e.g. `ls,get`
+	Features string
+	// NoOverwrite prevents the user from overwriting files if set
+	NoOverwrite *bool
+}
+
+// AuthProvider authenticates FTP users, e.g. with the credentials file (see Authenticator) or a directory service.
+type AuthProvider interface {
+	// Authenticate returns the identity of `username` if `password` is valid.
+	// The cause of the error is ErrUnknownUser if the provider does not know the user, see errors.Cause.
+	// Errors never contain the password.
+	Authenticate(username, password string) (*Identity, error)
+}
+
+// validatingProvider is an AuthProvider whose users' settings can be checked against the configuration.
+type validatingProvider interface {
+	validate(config *Config) error
+}
+
+// AuthChain authenticates users with the first provider which knows them,
+// e.g. with the credentials file first and then with a directory service.
+// Users known to a provider are rejected if their password is wrong, they are not passed on to the next provider.
+type AuthChain []AuthProvider
+
+// Authenticate returns the identity of `username` given by the first provider which knows the user.
+func (c AuthChain) Authenticate(username, password string) (*Identity, error) {
+	for _, provider := range c {
+		identity, err := provider.Authenticate(username, password)
+		if errors.Cause(err) != ErrUnknownUser {
+			return identity, err
+		}
+	}
+	return nil, errors.Wrapf(ErrUnknownUser, "User %q", username)
+}
+
+func (c AuthChain) validate(config *Config) error {
+	for _, provider := range c {
+		if p, ok := provider.(validatingProvider); ok {
+			if err := p.validate(config); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// configProvider authenticates the users which have a password in the current configuration file of a DriverFactory.
+type configProvider struct {
+	settings *currentSettings
+}
+
+// ConfigProvider returns an AuthProvider of the users with a password in the configuration file, see UserConfig.
+// It uses the configuration reloaded by Reload.
+func (d DriverFactory) ConfigProvider() AuthProvider {
+	return configProvider{settings: d.settings}
+}
+
+// Authenticate returns the identity of `username`, whose settings are the ones of the configuration file.
+func (p configProvider) Authenticate(username, password string) (*Identity, error) {
+	user, ok := p.settings.get().config.user(username)
+	if !ok || user.Password == "" {
+		verifyUnknownUser(password)
+		return nil, errors.Wrapf(ErrUnknownUser, "User %q", username)
+	}
+	if !verifyPassword(user.Password, password) {
+		return nil, fmt.Errorf("Unknown credentials of user %q", username)
+	}
+	return &Identity{User: username, Home: user.Home, Groups: user.Groups, Features: user.Features, NoOverwrite: user.NoOverwrite}, nil
+}
+
+// withIdentity returns a copy of the configuration in which the unset settings of the identity's user are the ones of `identity`.
+func (c *Config) withIdentity(identity *Identity) *Config {
+	config := c.copy()
+	user := config.Users[identity.User]
+	if user.Home == "" {
+		user.Home = identity.Home
+	}
+	if user.Groups == nil {
+		user.Groups = identity.Groups
+	}
+	if user.Features == "" {
+		user.Features = identity.Features
+	}
+	if user.NoOverwrite == nil {
+		user.NoOverwrite = identity.NoOverwrite
+	}
+	config.Users[identity.User] = user
+	return config
+}
+
+// identities holds the identities of the users who logged in, by user name.
+// Sessions take the identity of their user once the user has logged in, see S3Driver.takeIdentity.
+type identities struct {
+	mutex      sync.Mutex
+	identities map[string]*Identity
+}
+
+func newIdentities() *identities {
+	return &identities{identities: map[string]*Identity{}}
+}
+
+func (i *identities) get(username string) (*Identity, bool) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	identity, ok := i.identities[username]
+	return identity, ok
+}
+
+func (i *identities) set(identity *Identity) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.identities[identity.User] = identity
+}
+
+// takeIdentity adds the identity of `username`, the logged in user, to the session's configuration, once per login.
+func (d *S3Driver) takeIdentity(username string) {
+	if d.identities == nil || username == "" || username == d.identityUser {
+		return
+	}
+	d.identityUser = username
+	if identity, ok := d.identities.get(username); ok {
+		d.config = d.config.withIdentity(identity)
+	}
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// authProviderMock authenticates the users in the map with the password "secret".
+type authProviderMock map[string]Identity
+
+func (p authProviderMock) Authenticate(username, password string) (*Identity, error) {
+	identity, ok := p[username]
+	if !ok {
+		return nil, errors.Wrapf(ErrUnknownUser, "User %q", username)
+	}
+	if password != "secret" {
+		return nil, fmt.Errorf("Unknown credentials of user %q", username)
+	}
+	identity.User = username
+	return &identity, nil
+}
+
+func TestAuthChain(t *testing.T) {
+	credentials, err := AuthenticatorFromString("alice:secret\nbob:other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := &currentSettings{}
+	current.set(settings{config: &Config{Users: map[string]UserConfig{
+		"carol": {Password: hash, Features: "ls"},
+		"dave":  {Features: "ls"},
+	}}})
+	chain := AuthChain{credentials, configProvider{settings: current}, authProviderMock{"bob": {}, "dave": {Groups: []string{"partners"}}}}
+
+	for _, testData := range []struct {
+		user     string
+		valid    bool
+		unknown  bool
+		features string
+		groups   []string
+	}{
+		{"alice", true, false, "", nil},
+		{"bob", false, false, "", nil},
+		{"carol", true, false, "ls", nil},
+		{"dave", true, false, "", []string{"partners"}},
+		{"eve", false, true, "", nil},
+	} {
+		identity, err := chain.Authenticate(testData.user, "secret")
+		if valid := err == nil; valid != testData.valid {
+			t.Errorf("Expected validity of %s to be %v: %v", testData.user, testData.valid, err)
+			continue
+		}
+		if unknown := errors.Cause(err) == ErrUnknownUser; unknown != testData.unknown {
+			t.Errorf("Expected %s to be unknown: %v", testData.user, testData.unknown)
+		}
+		if err != nil {
+			continue
+		}
+		if identity.User != testData.user || identity.Features != testData.features || !reflect.DeepEqual(identity.Groups, testData.groups) {
+			t.Errorf("Unexpected identity of %s: %+v", testData.user, identity)
+		}
+	}
+}
+
+func TestSessionIdentity(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucket := newBucketMock(bucketName)
+	for _, key := range []string{"partners/alice/a.txt", "partners/bob/b.txt", "bob/c.txt"} {
+		bucket.Put(key, objectMock{data: []byte(key), lastMod: time.Now(), etag: key})
+	}
+	config := &Config{
+		Users:  map[string]UserConfig{"bob": {Features: "ls,get,put"}},
+		Groups: map[string]GroupConfig{"readers": {Features: "ls,get"}},
+	}
+	current := &currentSettings{}
+	current.set(settings{config: config, provider: authProviderMock{
+		"alice": {Home: "partners/{user}/", Groups: []string{"readers"}},
+		"bob":   {Home: "partners/{user}/", Groups: []string{"readers"}},
+		"../x":  {},
+	}})
+	loggedIn := newIdentities()
+	addr := startFTPServer(t, func() *S3Driver {
+		return &S3Driver{
+			featureFlags: featureList | featureGet | featurePut | featureRemove,
+			config:       current.get().config,
+			homeTemplate: DefaultHome,
+			identities:   loggedIn,
+			s3:           &s3Mock{bucket: bucket},
+			uploader:     &s3UploaderMock{bucket: bucket},
+			metrics:      metricsSenderMock{},
+			bucketName:   bucketName,
+			bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+		}
+	}, reloadableAuth{settings: current, identities: loggedIn, home: DefaultHome})
+
+	alice := dialFTP(t, addr, "alice", "secret")
+	listing, code := alice.retrieve("LIST /")
+	if names := listedNames(listing); code != 226 || !reflect.DeepEqual(names, []string{"a.txt"}) {
+		t.Errorf("Expected the home directory of the identity to be listed but was %d %v", code, names)
+	}
+	if code := alice.store("data", "STOR upload.txt"); code != 450 {
+		t.Errorf("Expected the features of the identity's groups to prevent uploads but was %d", code)
+	}
+
+	bob := dialFTP(t, addr, "bob", "secret")
+	if code := bob.store("data", "STOR upload.txt"); code != 226 {
+		t.Errorf("Expected the features of the configuration file to take precedence but was %d", code)
+	}
+
+	if ok, _ := (reloadableAuth{settings: current, identities: loggedIn, home: DefaultHome}).CheckPasswd("alice", "wrong"); ok {
+		t.Errorf("Expected a wrong password to be rejected")
+	}
+	if ok, _ := (reloadableAuth{settings: current, identities: loggedIn, home: "shared/"}).CheckPasswd("../x", "secret"); !ok {
+		t.Errorf("Expected a user with a fixed home directory to be authenticated")
+	}
+	if ok, _ := (reloadableAuth{settings: current, identities: loggedIn, home: DefaultHome}).CheckPasswd("../x", "secret"); ok {
+		t.Errorf("Expected a user whose name can not be part of the home directory to be rejected")
+	}
+
+	keys := []string{}
+	for key := range bucket.List() {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	expected := []string{"bob/c.txt", "partners/alice/a.txt", "partners/bob/b.txt", "partners/bob/upload.txt"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected objects %v but were %v", expected, keys)
+	}
+}
+
+func TestWithIdentity(t *testing.T) {
+	identity := &Identity{User: "alice", Home: "partners/{user}/", Features: "ls"}
+	config := (*Config)(nil).withIdentity(identity)
+	if user, ok := config.Users["alice"]; !ok || user.Home != identity.Home || user.Features != identity.Features {
+		t.Errorf("Expected the identity's settings without a configuration but were %+v", config.Users)
+	}
+
+	original := &Config{Users: map[string]UserConfig{"alice": {Features: "ls,get"}}}
+	config = original.withIdentity(identity)
+	if user := config.Users["alice"]; user.Home != identity.Home || user.Features != "ls,get" {
+		t.Errorf("Expected the configured features to take precedence but were %+v", user)
+	}
+	if user := original.Users["alice"]; user.Home != "" {
+		t.Errorf("Expected the original configuration to be unchanged but was %+v", user)
+	}
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"crypto/rand"
+	"fmt"
+	pathpkg "path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	ftp "github.com/goftp/server"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// keyPlaceholders are the placeholders of key templates:
+//
+//   - `{user}` is the FTP user, `{session}` the session ID
+//   - `{yyyy}`, `{mm}`, `{dd}` and `{hh}` are the year, month, day and hour (UTC) of the upload, `{unixtime}` its Unix time
+//   - `{uuid}` is a random UUID
+//   - `{path}` is the uploaded path, `{dir}` its directory, `{basename}` its file name without and `{ext}` its extension
+var keyPlaceholders = []string{"{user}", "{session}", "{yyyy}", "{mm}", "{dd}", "{hh}", "{unixtime}", "{uuid}", "{path}", "{dir}", "{basename}", "{ext}"}
+
+var placeholderPattern = regexp.MustCompile(`\{[^{}]*\}`)
+
+// validateKeyTemplate returns an error if `template` contains unknown placeholders.
+func validateKeyTemplate(template string) error {
+	for _, placeholder := range placeholderPattern.FindAllString(template, -1) {
+		if !contains(keyPlaceholders, placeholder) {
+			return fmt.Errorf("unknown placeholder %s in key template %q, expected any of %s", placeholder, template, strings.Join(keyPlaceholders, ", "))
+		}
+	}
+	return nil
+}
+
+// expandKeyTemplate returns the key of an upload by `user` to the FTP path `p`, which must be absolute and normalized.
+// The key never starts with a slash and contains no `.` or `..` elements.
+func expandKeyTemplate(template, p, user, sessionID string, now time.Time) (string, error) {
+	id := ""
+	if strings.Contains(template, "{uuid}") {
+		var err error
+		if id, err = newUUID(); err != nil {
+			return "", err
+		}
+	}
+	now = now.UTC()
+	dir, name := pathpkg.Split(p)
+	ext := pathpkg.Ext(name)
+	replacer := strings.NewReplacer(
+		"{user}", user,
+		"{session}", sessionID,
+		"{yyyy}", fmt.Sprintf("%04d", now.Year()),
+		"{mm}", fmt.Sprintf("%02d", now.Month()),
+		"{dd}", fmt.Sprintf("%02d", now.Day()),
+		"{hh}", fmt.Sprintf("%02d", now.Hour()),
+		"{unixtime}", strconv.FormatInt(now.Unix(), 10),
+		"{uuid}", id,
+		"{path}", strings.TrimPrefix(p, "/"),
+		"{dir}", strings.Trim(dir, "/"),
+		"{basename}", strings.TrimSuffix(name, ext),
+		"{ext}", ext,
+	)
+	expanded := replacer.Replace(template)
+	key := strings.TrimPrefix(pathpkg.Clean("/"+expanded), "/")
+	if key == "" || strings.HasSuffix(expanded, "/") {
+		return "", fmt.Errorf("key template %q results in the invalid key %q for %q", template, key, p)
+	}
+	return key, nil
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", errors.Wrap(err, "Failed to generate a UUID")
+	}
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:]), nil
+}
+
+// uploadKey returns the key of the object which stores an upload to the FTP path `p`.
+// If a key template is configured, it determines the key below the user's home directory unless an append continues a file uploaded by the session.
+func (d *S3Driver) uploadKey(p string, appendMode bool, now time.Time) (string, error) {
+	name := d.resolvePath(p)
+	if _, uploaded := d.uploadedNames[name]; (uploaded && appendMode) || d.config == nil || d.config.KeyTemplate == "" {
+		return d.objectKey(p), nil
+	}
+	key, err := expandKeyTemplate(d.config.KeyTemplate, "/"+d.relativePath(p), d.user(), d.sessionID, now)
+	if err != nil {
+		return "", err
+	}
+	return d.home() + key, nil
+}
+
+// rememberUpload maps the FTP path `p` onto the key `key` for the rest of the session
+// if the file was stored under a key other than its name, so that it can be accessed by the name it was uploaded with.
+func (d *S3Driver) rememberUpload(p, key string) {
+	name := d.resolvePath(p)
+	if key == d.home()+d.relativePath(p) {
+		delete(d.uploadedNames, name)
+		return
+	}
+	if d.uploadedNames == nil {
+		d.uploadedNames = map[string]string{}
+	}
+	d.uploadedNames[name] = key
+}
+
+// forgetUpload removes the mapping of the FTP path `p`, e.g. after the file was deleted.
+func (d *S3Driver) forgetUpload(p string) {
+	delete(d.uploadedNames, d.resolvePath(p))
+}
+
+// listUploadedNames calls `cb` for each file which was uploaded by the session into the FTP directory `dir`
+// under a key other than its name, unless a file with that name was already listed (`listed`).
+// Files are reported with the names they were uploaded with.
+func (d *S3Driver) listUploadedNames(dir string, listed map[string]bool, cb func(ftp.FileInfo) error) error {
+	names := []string{}
+	for name := range d.uploadedNames {
+		if pathpkg.Dir(name) == dir && !listed[pathpkg.Base(name)] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		key := d.uploadedNames[name]
+		resp, err := d.s3.HeadObject(&s3.HeadObjectInput{
+			Bucket:               aws.String(d.bucketName),
+			Key:                  aws.String(key),
+			SSECustomerAlgorithm: d.sse.customerAlgorithm(),
+			SSECustomerKey:       d.sse.customerKeyValue(),
+		})
+		if isNotFound(err) {
+			// the object was removed by someone else
+			delete(d.uploadedNames, name)
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Failed to get object %q", d.fqdn(key))
+		}
+		err = cb(S3ObjectInfo{
+			name:    pathpkg.Base(name),
+			size:    d.encryption.plaintextSize(aws.Int64Value(resp.ContentLength), resp.Metadata),
+			owner:   uploader(resp.Metadata),
+			group:   d.group,
+			modTime: aws.TimeValue(resp.LastModified),
+		})
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"time": time.Now(), "error": err}).Errorf("Could not list %q", d.fqdn(key))
+		}
+	}
+	return nil
+}
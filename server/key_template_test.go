@@ -0,0 +1,179 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	ftp "github.com/goftp/server"
+	"github.com/sirupsen/logrus"
+)
+
+func TestExpandKeyTemplate(t *testing.T) {
+	now := time.Date(2019, time.March, 7, 9, 30, 0, 0, time.UTC)
+	for _, testData := range []struct {
+		template string
+		path     string
+		expected string
+	}{
+		{"incoming/{user}/{yyyy}/{mm}/{dd}/{basename}-{unixtime}{ext}", "/report.csv", "incoming/alice/2019/03/07/report-1551951000.csv"},
+		{"{dir}/{hh}/{basename}{ext}", "/a/b/report.tar.gz", "a/b/09/report.tar.gz"},
+		{"{dir}/{basename}{ext}", "/report", "report"},
+		{"archive/{session}/{path}", "/a/b.txt", "archive/s1/a/b.txt"},
+		{"../{user}/{path}", "/b.txt", "alice/b.txt"},
+		{"{user}//{path}", "/b.txt", "alice/b.txt"},
+	} {
+		actual, err := expandKeyTemplate(testData.template, testData.path, "alice", "s1", now)
+		if err != nil {
+			t.Errorf("%q: %s", testData.template, err)
+		} else if actual != testData.expected {
+			t.Errorf("%q: expected key %q for %q but was %q", testData.template, testData.expected, testData.path, actual)
+		}
+	}
+
+	key, err := expandKeyTemplate("{uuid}{ext}", "/b.txt", "alice", "s1", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}\.txt$`).MatchString(key) {
+		t.Errorf("Expected a UUID but was %q", key)
+	}
+
+	for _, template := range []string{"{user}/", "{user}"} {
+		if key, err := expandKeyTemplate(template, "/b.txt", "", "s1", now); err == nil {
+			t.Errorf("%q: expected an error but key was %q", template, key)
+		}
+	}
+	if err := validateKeyTemplate("{user}/{filename}"); err == nil {
+		t.Errorf("Expected an error for an unknown placeholder")
+	}
+}
+
+func TestKeyTemplate(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucket := newBucketMock(bucketName)
+	d := S3Driver{
+		featureFlags: featurePut | featureGet | featureList | featureRemove | featureMove,
+		config:       &Config{KeyTemplate: "incoming/{dir}/{uuid}-{basename}{ext}"},
+		s3:           &s3Mock{bucket: bucket},
+		uploader:     &s3UploaderMock{bucket: bucket},
+		metrics:      metricsSenderMock{},
+		cwd:          "/",
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+
+	for _, data := range []string{"first", "second"} {
+		if _, err := d.PutFile("/out/report.csv", strings.NewReader(data), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := d.PutFile("/out/report.csv", strings.NewReader(" and more"), true); err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for key := range bucket.List() {
+		keys = append(keys, key)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("Expected two objects but were %v", keys)
+	}
+	for _, key := range keys {
+		if !strings.HasPrefix(key, "incoming/out/") || !strings.HasSuffix(key, "-report.csv") {
+			t.Errorf("Unexpected key %q", key)
+		}
+	}
+
+	info, err := d.Stat("/out/report.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name() != "report.csv" || info.Size() != int64(len("second and more")) {
+		t.Errorf("Unexpected file information %s (%d bytes)", info.Name(), info.Size())
+	}
+	_, body, err := d.GetFile("/out/report.csv", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil || string(data) != "second and more" {
+		t.Errorf("Expected the latest upload but was %q (%v)", data, err)
+	}
+
+	listed := []string{}
+	err = d.ListDir("/out", func(info ftp.FileInfo) error {
+		listed = append(listed, info.Name())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0] != "report.csv" {
+		t.Errorf("Expected the uploaded name to be listed but was %v", listed)
+	}
+
+	if err := d.Rename("/out/report.csv", "/out/final.csv"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bucket.Get("out/final.csv"); err != nil {
+		t.Errorf("Renamed file is missing: %s", err)
+	}
+	listed = []string{}
+	err = d.ListDir("/out", func(info ftp.FileInfo) error {
+		listed = append(listed, info.Name())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(listed)
+	if len(listed) != 1 || listed[0] != "final.csv" {
+		t.Errorf("Expected only the renamed file to be listed but was %v", listed)
+	}
+}
+
+func TestRememberUpload(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucket := newBucketMock(bucketName)
+	archive := newBucketMock("archive")
+	d := S3Driver{
+		featureFlags: featurePut,
+		homeTemplate: "home/",
+		s3:           &s3Mock{bucket: bucket},
+		uploader:     &s3UploaderMock{bucket: bucket},
+		metrics:      metricsSenderMock{},
+		cwd:          "/",
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+		mounts: []*mount{{
+			path:       "/archive",
+			prefix:     "ftp/",
+			bucketName: "archive",
+			bucketURL:  intoURL("s3://archive"),
+			s3:         &s3Mock{bucket: archive},
+			uploader:   &s3UploaderMock{bucket: archive},
+		}},
+	}
+
+	for _, p := range []string{"/report.csv", "/archive/report.csv"} {
+		if _, err := d.PutFile(p, strings.NewReader("data"), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := bucket.Get("home/report.csv"); err != nil {
+		t.Errorf("Expected the file in the home directory: %s", err)
+	}
+	if _, err := archive.Get("ftp/report.csv"); err != nil {
+		t.Errorf("Expected the file in the mounted bucket: %s", err)
+	}
+	if len(d.uploadedNames) != 0 {
+		t.Errorf("Expected files stored under their names not to be remembered but were %v", d.uploadedNames)
+	}
+}
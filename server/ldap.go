@@ -0,0 +1,247 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/pkg/errors"
+)
+
+// ldapTimeout is the timeout of connecting to the LDAP server and of each request.
+const ldapTimeout = 10 * time.Second
+
+// LDAPConfig configures the authentication of users with an LDAP server, e.g. Active Directory, see DriverFactory.LDAPProvider.
+//
+// Example:
+//
+//	{
+//	  "url": "ldaps://ldap.example.com",
+//	  "bindDN": "cn=f3,ou=services,dc=example,dc=com",
+//	  "bindPassword": "secret",
+//	  "baseDN": "ou=people,dc=example,dc=com",
+//	  "userFilter": "(&(objectClass=person)(uid={user}))",
+//	  "homeAttribute": "ftpHome",
+//	  "groups": {"cn=partners,ou=groups,dc=example,dc=com": "partners"}
+//	}
+type LDAPConfig struct {
+	// URL is the URL of the LDAP server, `ldap://<host>[:<port>]` or `ldaps://<host>[:<port>]`
+	URL string `json:"url"`
+	// StartTLS upgrades `ldap://` connections to TLS
+	StartTLS bool `json:"startTLS,omitempty"`
+	// BindDN and BindPassword are the credentials of the service account which searches users, anonymous if empty
+	BindDN       string `json:"bindDN,omitempty"`
+	BindPassword string `json:"bindPassword,omitempty"`
+	// BaseDN is the DN below which users are searched
+	BaseDN string `json:"baseDN"`
+	// UserFilter is the filter which finds a user, `{user}` is replaced by the escaped user name,
+	// e.g. `(&(objectClass=person)(uid={user}))` or `(sAMAccountName={user})` for Active Directory
+	UserFilter string `json:"userFilter"`
+	// UserAttribute is the attribute of users which contains their user name, `uid` if empty, e.g. `sAMAccountName` for Active Directory.
+	// Users must log in with their name as stored in this attribute, though the filter may match it case-insensitively.
+	UserAttribute string `json:"userAttribute,omitempty"`
+	// GroupAttribute is the attribute of users which contains the DNs of their groups, `memberOf` if empty
+	GroupAttribute string `json:"groupAttribute,omitempty"`
+	// Groups maps the DNs of directory groups to the names of groups of the configuration file, other groups are ignored
+	Groups map[string]string `json:"groups,omitempty"`
+	// HomeAttribute is the attribute of users which contains their home directory, e.g. `partners/{user}/`
+	HomeAttribute string `json:"homeAttribute,omitempty"`
+	// FeaturesAttribute is the attribute of users which contains their feature set, e.g. `ls,get`
+	FeaturesAttribute string `json:"featuresAttribute,omitempty"`
+}
+
+func (c LDAPConfig) validate(groups map[string]GroupConfig) error {
+	ldapURL, err := url.Parse(c.URL)
+	if err != nil {
+		return err
+	}
+	if ldapURL.Scheme != "ldap" && ldapURL.Scheme != "ldaps" || ldapURL.Host == "" {
+		return fmt.Errorf("URL %q is neither ldap://<host> nor ldaps://<host>", c.URL)
+	}
+	if c.StartTLS && ldapURL.Scheme != "ldap" {
+		return fmt.Errorf("startTLS requires an ldap:// URL")
+	}
+	if c.BaseDN == "" {
+		return fmt.Errorf("empty base DN")
+	}
+	if !strings.Contains(c.UserFilter, "{user}") {
+		return fmt.Errorf("user filter %q does not contain {user}", c.UserFilter)
+	}
+	if _, err := ldap.CompileFilter(c.userFilter("user")); err != nil {
+		return errors.Wrapf(err, "invalid user filter %q", c.UserFilter)
+	}
+	for dn, group := range c.Groups {
+		if _, err := ldap.ParseDN(dn); err != nil {
+			return errors.Wrapf(err, "invalid group DN %q", dn)
+		}
+		if _, ok := groups[group]; !ok {
+			return fmt.Errorf("unknown group %q", group)
+		}
+	}
+	return nil
+}
+
+// userFilter returns the filter which finds the user `username`.
+func (c LDAPConfig) userFilter(username string) string {
+	return strings.Replace(c.UserFilter, "{user}", ldap.EscapeFilter(username), -1)
+}
+
+// userAttribute returns the attribute of users which contains their user name.
+func (c LDAPConfig) userAttribute() string {
+	if c.UserAttribute == "" {
+		return "uid"
+	}
+	return c.UserAttribute
+}
+
+// groupAttribute returns the attribute of users which contains the DNs of their groups.
+func (c LDAPConfig) groupAttribute() string {
+	if c.GroupAttribute == "" {
+		return "memberOf"
+	}
+	return c.GroupAttribute
+}
+
+// mapGroups returns the names of the groups of the configuration file to which the directory groups `dns` are mapped.
+// DNs are compared case-insensitively.
+func (c LDAPConfig) mapGroups(dns []string) []string {
+	groups := []string{}
+	for _, dn := range dns {
+		parsed, err := ldap.ParseDN(dn)
+		if err != nil {
+			continue
+		}
+		for mappedDN, group := range c.Groups {
+			if mapped, err := ldap.ParseDN(mappedDN); err == nil && equalFoldDN(mapped, parsed) {
+				groups = append(groups, group)
+			}
+		}
+	}
+	return groups
+}
+
+// equalFoldDN returns true if the DNs `a` and `b` are equal except for the case of their attribute types and values.
+func equalFoldDN(a, b *ldap.DN) bool {
+	if len(a.RDNs) != len(b.RDNs) {
+		return false
+	}
+	for i := range a.RDNs {
+		if len(a.RDNs[i].Attributes) != len(b.RDNs[i].Attributes) {
+			return false
+		}
+		for j, attribute := range a.RDNs[i].Attributes {
+			other := b.RDNs[i].Attributes[j]
+			if !strings.EqualFold(attribute.Type, other.Type) || !strings.EqualFold(attribute.Value, other.Value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ldapProvider authenticates users with the LDAP server of the current configuration file of a DriverFactory.
+type ldapProvider struct {
+	settings *currentSettings
+	// tlsConfig is the TLS configuration of the connections, the system's default if nil
+	tlsConfig *tls.Config
+}
+
+// LDAPProvider returns an AuthProvider of the users of the LDAP server of the configuration file, see LDAPConfig.
+// It uses the configuration reloaded by Reload.
+func (d DriverFactory) LDAPProvider() AuthProvider {
+	return ldapProvider{settings: d.settings}
+}
+
+func (p ldapProvider) validate(config *Config) error {
+	if config.LDAP == nil {
+		return fmt.Errorf("No LDAP server configured in the configuration file")
+	}
+	return nil
+}
+
+// Authenticate searches `username` with the service account and verifies the password by binding as the found user.
+// The identity contains the user's name as stored in the user attribute, which may differ from `username` in case,
+// the user's mapped groups and the attributes of the user's entry.
+func (p ldapProvider) Authenticate(username, password string) (*Identity, error) {
+	config := p.settings.get().config.LDAP
+	if config == nil {
+		return nil, errors.Wrapf(ErrUnknownUser, "User %q, no LDAP server configured", username)
+	}
+	tlsConfig := p.tlsConfig
+	if tlsConfig == nil {
+		ldapURL, err := url.Parse(config.URL)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig = &tls.Config{ServerName: ldapURL.Hostname()}
+	}
+	conn, err := ldap.DialURL(config.URL, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}), ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to connect to %q", config.URL)
+	}
+	defer conn.Close()
+	conn.SetTimeout(ldapTimeout)
+	if config.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			return nil, errors.Wrapf(err, "Failed to start TLS with %q", config.URL)
+		}
+	}
+	if config.BindDN != "" {
+		if err := conn.Bind(config.BindDN, config.BindPassword); err != nil {
+			return nil, errors.Wrapf(err, "Failed to bind as %q", config.BindDN)
+		}
+	}
+
+	attributes := []string{config.userAttribute(), config.groupAttribute()}
+	for _, attribute := range []string{config.HomeAttribute, config.FeaturesAttribute} {
+		if attribute != "" {
+			attributes = append(attributes, attribute)
+		}
+	}
+	result, err := conn.Search(ldap.NewSearchRequest(config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(ldapTimeout/time.Second), false,
+		config.userFilter(username), attributes, nil))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to search user %q", username)
+	}
+	if len(result.Entries) == 0 {
+		return nil, errors.Wrapf(ErrUnknownUser, "User %q not found in %q", username, config.BaseDN)
+	}
+	if len(result.Entries) > 1 {
+		return nil, fmt.Errorf("User %q is ambiguous in %q", username, config.BaseDN)
+	}
+	entry := result.Entries[0]
+
+	// servers treat binds without password as anonymous binds, which succeed
+	if password == "" {
+		return nil, fmt.Errorf("Unknown credentials of user %q", username)
+	}
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, fmt.Errorf("Unknown credentials of user %q", username)
+		}
+		return nil, errors.Wrapf(err, "Failed to bind as %q", entry.DN)
+	}
+
+	user := entry.GetEqualFoldAttributeValue(config.userAttribute())
+	if user == "" {
+		return nil, fmt.Errorf("User %q has no %s attribute", username, config.userAttribute())
+	}
+	identity := &Identity{User: user, Groups: config.mapGroups(entry.GetEqualFoldAttributeValues(config.groupAttribute()))}
+	if config.HomeAttribute != "" {
+		identity.Home = entry.GetEqualFoldAttributeValue(config.HomeAttribute)
+		if err := validateHome(identity.Home); err != nil {
+			return nil, errors.Wrapf(err, "Invalid home directory of user %q", username)
+		}
+	}
+	if config.FeaturesAttribute != "" {
+		identity.Features = entry.GetEqualFoldAttributeValue(config.FeaturesAttribute)
+		if err := validateFeatures(identity.Features); err != nil {
+			return nil, errors.Wrapf(err, "Invalid features of user %q", username)
+		}
+	}
+	return identity, nil
+}
@@ -0,0 +1,292 @@
+package server
+
+import (
+	"net"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/pkg/errors"
+)
+
+// ldapEntryMock is an entry of ldapServerMock.
+type ldapEntryMock struct {
+	dn         string
+	password   string
+	attributes map[string][]string
+}
+
+// ldapServerMock is an LDAP server which supports simple binds and case-insensitive searches for the `uid` of an equality or substring filter.
+// Only bound users may search.
+type ldapServerMock struct {
+	listener net.Listener
+	entries  []ldapEntryMock
+	mutex    sync.Mutex
+	binds    []string
+}
+
+var ldapUIDPattern = regexp.MustCompile(`\(uid=([^)]*)\)`)
+
+func startLDAPServer(t *testing.T, entries ...ldapEntryMock) *ldapServerMock {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &ldapServerMock{listener: listener, entries: entries}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (s *ldapServerMock) url() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+func (s *ldapServerMock) boundDNs() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string{}, s.binds...)
+}
+
+func (s *ldapServerMock) serve(conn net.Conn) {
+	defer conn.Close()
+	bound := false
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		messageID := packet.Children[0].Value.(int64)
+		request := packet.Children[1]
+		switch request.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := request.Children[1].Data.String()
+			password := request.Children[2].Data.String()
+			resultCode := int64(ldap.LDAPResultInvalidCredentials)
+			for _, entry := range s.entries {
+				if strings.EqualFold(entry.dn, dn) && entry.password == password {
+					resultCode = ldap.LDAPResultSuccess
+					s.mutex.Lock()
+					s.binds = append(s.binds, dn)
+					s.mutex.Unlock()
+				}
+			}
+			bound = resultCode == ldap.LDAPResultSuccess
+			s.respond(conn, messageID, ldap.ApplicationBindResponse, resultCode)
+		case ldap.ApplicationSearchRequest:
+			if !bound {
+				s.respond(conn, messageID, ldap.ApplicationSearchResultDone, ldap.LDAPResultInsufficientAccessRights)
+				continue
+			}
+			filter, err := ldap.DecompileFilter(request.Children[6])
+			match := ldapUIDPattern.FindStringSubmatch(filter)
+			if err != nil || match == nil {
+				s.respond(conn, messageID, ldap.ApplicationSearchResultDone, ldap.LDAPResultUnwillingToPerform)
+				continue
+			}
+			for _, entry := range s.entries {
+				uid := entry.attributes["uid"]
+				if len(uid) == 0 {
+					continue
+				}
+				if ok, _ := path.Match(strings.ToLower(match[1]), strings.ToLower(uid[0])); ok {
+					s.send(conn, messageID, searchResultEntry(entry))
+				}
+			}
+			s.respond(conn, messageID, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)
+		case ldap.ApplicationUnbindRequest:
+			return
+		default:
+			return
+		}
+	}
+}
+
+func searchResultEntry(entry ldapEntryMock) *ber.Packet {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.dn, "DN"))
+	attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	for name, values := range entry.attributes {
+		attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+		attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, value := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Value"))
+		}
+		attribute.AppendChild(set)
+		attributes.AppendChild(attribute)
+	}
+	result.AppendChild(attributes)
+	return result
+}
+
+func (s *ldapServerMock) respond(conn net.Conn, messageID int64, tag ber.Tag, resultCode int64) {
+	response := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Response")
+	response.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, resultCode, "Result Code"))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	s.send(conn, messageID, response)
+}
+
+func (s *ldapServerMock) send(conn net.Conn, messageID int64, response *ber.Packet) {
+	message := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Message")
+	message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "Message ID"))
+	message.AppendChild(response)
+	conn.Write(message.Bytes())
+}
+
+func TestLDAPProvider(t *testing.T) {
+	const serviceDN = "cn=f3,ou=services,dc=example,dc=com"
+	server := startLDAPServer(t,
+		ldapEntryMock{dn: serviceDN, password: "service"},
+		ldapEntryMock{dn: "uid=alice,ou=people,dc=example,dc=com", password: "secret", attributes: map[string][]string{
+			"uid":      {"alice"},
+			"memberOf": {"CN=Partners,OU=Groups,DC=example,DC=com", "cn=staff,ou=groups,dc=example,dc=com"},
+			"ftpHome":  {"partners/{user}/"},
+			"ftpRules": {"ls,get"},
+		}},
+		ldapEntryMock{dn: "uid=bob,ou=people,dc=example,dc=com", password: "secret", attributes: map[string][]string{
+			"uid":     {"bob"},
+			"ftpHome": {"../bob"},
+		}},
+		ldapEntryMock{dn: "uid=carol,ou=people,dc=example,dc=com", password: "secret", attributes: map[string][]string{"uid": {"carol"}}},
+		ldapEntryMock{dn: "uid=carol,ou=former,dc=example,dc=com", password: "secret", attributes: map[string][]string{"uid": {"carol"}}},
+	)
+	defer server.listener.Close()
+
+	ldapConfig := &LDAPConfig{
+		URL:               server.url(),
+		BindDN:            serviceDN,
+		BindPassword:      "service",
+		BaseDN:            "dc=example,dc=com",
+		UserFilter:        "(&(objectClass=person)(uid={user}))",
+		Groups:            map[string]string{"cn=partners,ou=groups,dc=example,dc=com": "partners"},
+		HomeAttribute:     "ftpHome",
+		FeaturesAttribute: "ftprules",
+	}
+	config := &Config{Groups: map[string]GroupConfig{"partners": {}}, LDAP: ldapConfig}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	current := &currentSettings{}
+	current.set(settings{config: config})
+	provider := ldapProvider{settings: current}
+
+	identity, err := provider.Authenticate("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &Identity{User: "alice", Home: "partners/{user}/", Groups: []string{"partners"}, Features: "ls,get"}
+	if !reflect.DeepEqual(identity, expected) {
+		t.Errorf("Expected the identity %+v but was %+v", expected, identity)
+	}
+	if binds := server.boundDNs(); !reflect.DeepEqual(binds, []string{serviceDN, "uid=alice,ou=people,dc=example,dc=com"}) {
+		t.Errorf("Expected binds as the service account and as the user but were %v", binds)
+	}
+
+	for _, testData := range []struct {
+		user     string
+		password string
+		unknown  bool
+	}{
+		{"alice", "wrong", false},
+		{"alice", "", false},
+		{"a*", "secret", true},
+		{"dave", "secret", true},
+		{"bob", "secret", false},
+		{"carol", "secret", false},
+	} {
+		if _, err := provider.Authenticate(testData.user, testData.password); err == nil {
+			t.Errorf("Expected %s with password %q to be rejected", testData.user, testData.password)
+		} else if unknown := errors.Cause(err) == ErrUnknownUser; unknown != testData.unknown {
+			t.Errorf("Expected %s to be unknown: %v, but was: %v", testData.user, testData.unknown, err)
+		} else if strings.Contains(err.Error(), testData.password) && testData.password != "" {
+			t.Errorf("Expected the error not to contain the password: %v", err)
+		}
+	}
+
+	identity, err = provider.Authenticate("ALICE", "secret")
+	if err != nil || identity.User != "alice" {
+		t.Errorf("Expected the user name of the entry for a differently cased login but was %+v: %v", identity, err)
+	}
+	current.set(settings{config: config, provider: provider})
+	auth := reloadableAuth{settings: current, identities: newIdentities(), home: DefaultHome}
+	if ok, err := auth.CheckPasswd("ALICE", "secret"); ok || err == nil {
+		t.Errorf("Expected a login with a differently cased user name to be rejected")
+	}
+	if _, ok := auth.identities.get("ALICE"); ok {
+		t.Errorf("Expected no identity for a rejected login")
+	}
+	if ok, err := auth.CheckPasswd("alice", "secret"); !ok {
+		t.Errorf("Expected a login with the user name of the entry to be accepted: %v", err)
+	}
+	ldapConfig.UserAttribute = "sAMAccountName"
+	if _, err := provider.Authenticate("alice", "secret"); err == nil {
+		t.Errorf("Expected users without the user attribute to be rejected")
+	}
+	ldapConfig.UserAttribute = ""
+
+	ldapConfig.BindPassword = "wrong"
+	if _, err := provider.Authenticate("alice", "secret"); err == nil || errors.Cause(err) == ErrUnknownUser {
+		t.Errorf("Expected a failing service bind to be an error: %v", err)
+	}
+	ldapConfig.BindPassword = "service"
+
+	credentials, err := AuthenticatorFromString("alice:local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := AuthChain{credentials, provider}
+	if _, err := chain.Authenticate("alice", "secret"); err == nil {
+		t.Errorf("Expected users of the credentials file not to be passed on to the LDAP server")
+	}
+	if identity, err := chain.Authenticate("carol", "secret"); err == nil {
+		t.Errorf("Expected ambiguous users to be rejected but was %+v", identity)
+	}
+	unconfigured := ldapProvider{settings: &currentSettings{settings: settings{config: &Config{}}}}
+	if _, err := unconfigured.Authenticate("alice", "secret"); errors.Cause(err) != ErrUnknownUser {
+		t.Errorf("Expected users to be unknown without an LDAP server: %v", err)
+	}
+	if err := chain.validate(&Config{}); err == nil {
+		t.Errorf("Expected the LDAP provider to require an LDAP server")
+	}
+}
+
+func TestLDAPConfig(t *testing.T) {
+	valid := LDAPConfig{URL: "ldap://ldap.example.com", StartTLS: true, BaseDN: "dc=example,dc=com", UserFilter: "(uid={user})"}
+	groups := map[string]GroupConfig{"partners": {}}
+	if err := valid.validate(groups); err != nil {
+		t.Error(err)
+	}
+	for name, modify := range map[string]func(c *LDAPConfig){
+		"scheme":   func(c *LDAPConfig) { c.URL = "http://ldap.example.com" },
+		"host":     func(c *LDAPConfig) { c.URL = "ldap://" },
+		"startTLS": func(c *LDAPConfig) { c.URL = "ldaps://ldap.example.com" },
+		"baseDN":   func(c *LDAPConfig) { c.BaseDN = "" },
+		"filter":   func(c *LDAPConfig) { c.UserFilter = "(uid=alice)" },
+		"syntax":   func(c *LDAPConfig) { c.UserFilter = "(uid={user}" },
+		"groupDN":  func(c *LDAPConfig) { c.Groups = map[string]string{"partners": "partners"} },
+		"group":    func(c *LDAPConfig) { c.Groups = map[string]string{"cn=staff,dc=example,dc=com": "staff"} },
+	} {
+		config := valid
+		modify(&config)
+		if err := config.validate(groups); err == nil {
+			t.Errorf("Expected the LDAP settings with an invalid %s to be rejected", name)
+		}
+	}
+	if filter := valid.userFilter("a*)(uid=b"); filter != `(uid=a\2a\29\28uid=b)` {
+		t.Errorf("Expected the user name to be escaped in the filter but was %q", filter)
+	}
+}
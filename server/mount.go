@@ -0,0 +1,126 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	pathpkg "path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
+	ftp "github.com/goftp/server"
+	"github.com/sirupsen/logrus"
+)
+
+// mount is a bucket, or a prefix of a bucket, which is served at a directory of the FTP namespace.
+// Its s3 client is shared by all sessions of a DriverFactory.
+type mount struct {
+	// path is the absolute FTP path of the mount point
+	path string
+	// prefix is the key prefix of the mounted directory, which may contain `{user}`, see homePrefix
+	prefix     string
+	bucketName string
+	bucketURL  *url.URL
+	s3         s3iface.S3API
+	uploader   s3manageriface.UploaderAPI
+}
+
+func (m MountConfig) validate() error {
+	if !strings.HasPrefix(m.Path, "/") || pathpkg.Clean(m.Path) != m.Path || m.Path == "/" {
+		return fmt.Errorf("mount point %q is not a clean absolute path below the root directory", m.Path)
+	}
+	bucketURL, err := url.Parse(m.Bucket)
+	if err != nil {
+		return err
+	}
+	if _, _, err := parseBucketURL(bucketURL); err != nil {
+		return err
+	}
+	if err := validateHome(bucketURL.Path); err != nil {
+		return err
+	}
+	if m.Endpoint != "" {
+		if _, err := url.Parse(m.Endpoint); err != nil {
+			return err
+		}
+	}
+	if m.Credentials != "" && !strings.Contains(m.Credentials, ":") {
+		return fmt.Errorf("Malformed credentials, not in format: 'access_key:secret_key'")
+	}
+	return nil
+}
+
+// parseBucketURL returns the bucket name and the endpoint of the bucket URL `bucketURL`,
+// which is either `s3://<bucket>`, whose endpoint is empty, or a fully qualified URL like `https://<bucket>.<endpoint>`.
+func parseBucketURL(bucketURL *url.URL) (string, string, error) {
+	if bucketURL.Scheme == "s3" && bucketURL.Host != "" {
+		return bucketURL.Host, "", nil
+	}
+	pair := strings.SplitN(bucketURL.Host, ".", 2)
+	if len(pair) != 2 || bucketURL.Scheme == "" {
+		return "", "", fmt.Errorf("Not a fully qualified bucket name (e.g. 'bucket.host.domain'): %q", bucketURL.String())
+	}
+	return pair[0], fmt.Sprintf("%s://%s", bucketURL.Scheme, pair[1]), nil
+}
+
+// mountOf returns the mount in which the absolute FTP path `p` is located, nil if it is located in the default bucket.
+// Mount points may be nested, the innermost mount wins.
+func (d *S3Driver) mountOf(p string) *mount {
+	var found *mount
+	for _, m := range d.mounts {
+		if (p == m.path || strings.HasPrefix(p, m.path+"/")) && (found == nil || len(m.path) > len(found.path)) {
+			found = m
+		}
+	}
+	return found
+}
+
+// enterMount switches the driver to the bucket of the mount in which the FTP path `p` is located
+// and returns the function which switches back to the default bucket.
+func (d *S3Driver) enterMount(p string) func() {
+	m := d.mountOf(d.resolvePath(p))
+	if m == nil {
+		return func() {}
+	}
+	s3Client, uploader, bucketName, bucketURL := d.s3, d.uploader, d.bucketName, d.bucketURL
+	d.mount, d.s3, d.uploader, d.bucketName, d.bucketURL = m, m.s3, m.uploader, m.bucketName, m.bucketURL
+	return func() {
+		d.mount, d.s3, d.uploader, d.bucketName, d.bucketURL = nil, s3Client, uploader, bucketName, bucketURL
+	}
+}
+
+// mountPath returns the FTP path of the mount point of the bucket the driver is switched to.
+func (d *S3Driver) mountPath() string {
+	if d.mount == nil {
+		return "/"
+	}
+	return d.mount.path
+}
+
+// mountPoints returns the names of the directories in the FTP directory `dir` which contain mount points.
+func (d *S3Driver) mountPoints(dir string) []string {
+	names := []string{}
+	for _, m := range d.mounts {
+		if rel := strings.TrimPrefix(m.path, strings.TrimSuffix(dir, "/")+"/"); rel != m.path {
+			if name := strings.SplitN(rel, "/", 2)[0]; !contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// listMountPoints calls `cb` for each directory in the FTP directory `dir` which contains mount points
+// and was not `listed` already.
+func (d *S3Driver) listMountPoints(dir string, listed map[string]bool, cb func(ftp.FileInfo) error) {
+	for _, name := range d.mountPoints(dir) {
+		if listed[name] {
+			continue
+		}
+		listed[name] = true
+		if err := cb(S3ObjectInfo{name: name, isPrefix: true, group: d.group, modTime: time.Now()}); err != nil {
+			logrus.WithFields(logrus.Fields{"error": err}).Errorf("Could not list mount point %q", pathpkg.Join(dir, name))
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/sirupsen/logrus"
+)
+
+func TestMountFactory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "f3-mounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "config.json")
+	config := `{"mounts": [
+		{"path": "/archive", "bucket": "s3://archive-bucket/ftp/", "region": "eu-west-1", "credentials": "archive:secret"},
+		{"path": "/incoming", "bucket": "https://landing.s3.example.com/"},
+		{"path": "/other", "bucket": "s3://other", "endpoint": "https://other.example.com"}
+	]}`
+	if err := ioutil.WriteFile(configFile, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	factory, err := NewDriverFactory(&FactoryConfig{
+		FtpFeatures:       DefaultFeatureSet,
+		S3Credentials:     "access:secret",
+		S3BucketURL:       "https://some-bucket.somewhere.com",
+		S3Region:          DefaultRegion,
+		ConfigFile:        configFile,
+		DisableCloudWatch: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mounts := factory.settings.get().mounts
+	if len(mounts) != 3 {
+		t.Fatalf("Expected 3 mounts but were %d", len(mounts))
+	}
+	for i, expected := range []struct {
+		path, prefix, bucketName, bucketURL, region, endpoint, accessKey string
+	}{
+		{"/archive", "/ftp/", "archive-bucket", "s3://archive-bucket", "eu-west-1", "https://somewhere.com", "archive"},
+		{"/incoming", "/", "landing", "https://landing.s3.example.com", DefaultRegion, "https://s3.example.com", "access"},
+		{"/other", "", "other", "s3://other", DefaultRegion, "https://other.example.com", "access"},
+	} {
+		m := mounts[i]
+		client := m.s3.(*s3.S3)
+		credentials, err := client.Config.Credentials.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual := []string{m.path, m.prefix, m.bucketName, m.bucketURL.String(), *client.Config.Region, client.Endpoint, credentials.AccessKeyID}
+		if expected := []string{expected.path, expected.prefix, expected.bucketName, expected.bucketURL, expected.region, expected.endpoint, expected.accessKey}; !reflect.DeepEqual(actual, expected) {
+			t.Errorf("Expected mount %v but was %v", expected, actual)
+		}
+	}
+
+	keyFile := filepath.Join(dir, "customer.key")
+	if err := ioutil.WriteFile(keyFile, []byte("0123456789abcdef0123456789abcdef"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for mountConfig, valid := range map[string]bool{
+		`{"path": "/secure", "bucket": "s3://secure", "endpoint": "https://s3.example.com"}`: true,
+		`{"path": "/secure", "bucket": "s3://secure"}`:                                       true,
+		`{"path": "/plain", "bucket": "http://plain.s3.example.com/"}`:                       false,
+		`{"path": "/plain", "bucket": "s3://plain", "endpoint": "http://s3.example.com"}`:    false,
+	} {
+		if err := ioutil.WriteFile(configFile, []byte(`{"mounts": [`+mountConfig+`]}`), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := NewDriverFactory(&FactoryConfig{
+			FtpFeatures:       DefaultFeatureSet,
+			S3Credentials:     "access:secret",
+			S3BucketURL:       "https://some-bucket.somewhere.com",
+			S3Region:          DefaultRegion,
+			S3Encryption:      "SSE-C",
+			S3CustomerKeyFile: keyFile,
+			ConfigFile:        configFile,
+			DisableCloudWatch: true,
+		})
+		if valid && err != nil {
+			t.Errorf("Expected SSE-C with the mount %s to be accepted: %v", mountConfig, err)
+		} else if !valid && err == nil {
+			t.Errorf("Expected SSE-C with the mount %s to be rejected", mountConfig)
+		}
+	}
+}
+
+func TestMounts(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	buckets := map[string]*bucketMock{}
+	for _, name := range []string{"default", "archive", "landing"} {
+		buckets[name] = newBucketMock(name)
+	}
+	buckets["default"].Put("alice/home.txt", objectMock{data: []byte("home"), lastMod: time.Now(), etag: "home"})
+	buckets["archive"].Put("ftp/2019/report.txt", objectMock{data: []byte("report"), lastMod: time.Now(), etag: "report"})
+	buckets["archive"].Put("outside.txt", objectMock{data: []byte("outside"), lastMod: time.Now(), etag: "outside"})
+	mounts := []*mount{}
+	for _, m := range []struct{ path, bucket, prefix string }{
+		{"/archive", "archive", "ftp/"},
+		{"/data/incoming", "landing", "{user}/"},
+	} {
+		bucket := buckets[m.bucket]
+		mounts = append(mounts, &mount{
+			path:       m.path,
+			prefix:     m.prefix,
+			bucketName: m.bucket,
+			bucketURL:  intoURL(fmt.Sprintf("s3://%s", m.bucket)),
+			s3:         &s3Mock{bucket: bucket},
+			uploader:   &s3UploaderMock{bucket: bucket},
+		})
+	}
+	credentials, err := AuthenticatorFromString("alice:secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := startFTPServer(t, func() *S3Driver {
+		return &S3Driver{
+			featureFlags: featureChangeDir | featureList | featureGet | featurePut | featureMove | featureRemove,
+			homeTemplate: DefaultHome,
+			s3:           &s3Mock{bucket: buckets["default"]},
+			uploader:     &s3UploaderMock{bucket: buckets["default"]},
+			metrics:      metricsSenderMock{},
+			bucketName:   "default",
+			bucketURL:    intoURL("https://default.my.s3.host.com"),
+			mounts:       mounts,
+		}
+	}, credentials)
+
+	c := dialFTP(t, addr, "alice", "secret")
+	for dir, expected := range map[string][]string{
+		"/":              {"archive", "data", "home.txt"},
+		"/archive":       {"2019"},
+		"/archive/2019":  {"report.txt"},
+		"/data":          {"incoming"},
+		"/data/incoming": {},
+	} {
+		listing, code := c.retrieve("LIST %s", dir)
+		if code != 226 {
+			t.Errorf("Listing %q failed with %d", dir, code)
+			continue
+		}
+		names := listedNames(listing)
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("Expected %q to contain %v but was %v", dir, expected, names)
+		}
+	}
+	if data, code := c.retrieve("RETR /archive/2019/report.txt"); code != 226 || data != "report" {
+		t.Errorf("Expected to download the report but got %d %q", code, data)
+	}
+	if _, code := c.retrieve("RETR /archive/../archive/outside.txt"); code == 226 {
+		t.Errorf("Expected objects outside of the mounted prefix to be inaccessible")
+	}
+	c.expect(250, "CWD /data/incoming")
+	if code := c.store("data", "STOR upload.txt"); code != 226 {
+		t.Errorf("Upload failed with %d", code)
+	}
+	if _, err := buckets["landing"].Get("alice/upload.txt"); err != nil {
+		t.Errorf("Expected the upload to be stored in the mounted bucket: %s", err)
+	}
+	c.expect(350, "RNFR upload.txt")
+	c.expect(550, "RNTO /archive/upload.txt")
+	c.expect(350, "RNFR upload.txt")
+	c.expect(250, "RNTO renamed.txt")
+	if _, err := buckets["landing"].Get("alice/renamed.txt"); err != nil {
+		t.Errorf("Expected the upload to be renamed in the mounted bucket: %s", err)
+	}
+	c.expect(550, "DELE /archive")
+	c.expect(250, "DELE /data/incoming/renamed.txt")
+	if len(buckets["default"].List()) != 1 {
+		t.Errorf("Expected the default bucket to be unchanged but was %v", buckets["default"].List())
+	}
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// temporaryPrefix is the prefix of objects which are uploaded before they are copied to their destination.
+const temporaryPrefix = ".f3-tmp/"
+
+// overwriteForbidden returns the error for a write to the existing object `fqdn` if no-overwrite is set.
+func overwriteForbidden(fqdn string) error {
+	return fmt.Errorf("object %q already exists and overwriting is forbidden", fqdn)
+}
+
+// ifNoneMatch makes PutObject, CopyObject and CompleteMultipartUpload requests fail if the object already exists.
+// Other requests, e.g. the ones uploading the parts of a multipart upload, are not affected.
+func ifNoneMatch(r *request.Request) {
+	switch r.Operation.Name {
+	case "PutObject", "CopyObject", "CompleteMultipartUpload":
+		r.HTTPRequest.Header.Set("If-None-Match", "*")
+	}
+}
+
+// isPreconditionFailed returns true if `err` was caused by a conditional write to an existing object.
+// Errors of the upload manager are wrapped, e.g. into a `MultipartUpload` error, thus all original errors are inspected.
+func isPreconditionFailed(err error) bool {
+	awsErr, ok := errors.Cause(err).(awserr.Error)
+	for ok {
+		switch awsErr.Code() {
+		case "PreconditionFailed", "ConditionalRequestConflict":
+			return true
+		}
+		awsErr, ok = awsErr.OrigErr().(awserr.Error)
+	}
+	return false
+}
+
+// writeOptions returns the request options of requests which create objects.
+// If no-overwrite is set and the endpoint supports conditional writes, objects are only created if they do not exist yet.
+func (d *S3Driver) writeOptions() []request.Option {
+	if d.preventOverwrite() && d.conditionalWrites {
+		return []request.Option{ifNoneMatch}
+	}
+	return nil
+}
+
+// keyReservations keeps track of the keys which are written by a session if no-overwrite is set,
+// so that concurrent sessions of the same server do not write the same object.
+// It is shared by all sessions of a DriverFactory.
+type keyReservations struct {
+	lock sync.Mutex
+	keys map[string]bool
+}
+
+func newKeyReservations() *keyReservations {
+	return &keyReservations{keys: map[string]bool{}}
+}
+
+// reserve returns false if `key` is already reserved, otherwise it reserves the key until it is released.
+func (r *keyReservations) reserve(key string) bool {
+	if r == nil {
+		return true
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.keys[key] {
+		return false
+	}
+	r.keys[key] = true
+	return true
+}
+
+// release releases the reservation of `key`.
+func (r *keyReservations) release(key string) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.keys, key)
+}
+
+// temporaryKey returns a new unique key below the temporary prefix.
+func temporaryKey() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", errors.Wrap(err, "Failed to generate a temporary key")
+	}
+	return temporaryPrefix + hex.EncodeToString(id), nil
+}
+
+// temporaryInput returns the upload request for the temporary object with key `key`.
+// Temporary objects are only encrypted like their destination, they get neither provenance nor tags nor upload rules.
+func (d *S3Driver) temporaryInput(key string) *s3manager.UploadInput {
+	return &s3manager.UploadInput{
+		Bucket:               aws.String(d.bucketName),
+		Key:                  aws.String(key),
+		Metadata:             map[string]*string{},
+		ServerSideEncryption: d.sse.serverSide(),
+		SSEKMSKeyId:          d.sse.kmsKey(),
+		SSECustomerAlgorithm: d.sse.customerAlgorithm(),
+		SSECustomerKey:       d.sse.customerKeyValue(),
+	}
+}
+
+// putGuarded stores `data` as object with key `key` if the object does not exist yet and returns its size.
+// It is used if the endpoint does not support conditional writes: the data is uploaded to a temporary object
+// which is only copied to its destination if that still does not exist, which narrows the window for
+// concurrent writers from the duration of the transfer to the one of the copy.
+// The copy itself is not conditional, thus only the sessions of one server, which reserve the keys they write,
+// can not overwrite each other. Several servers writing to the same bucket require conditional writes.
+func (d *S3Driver) putGuarded(key string, data io.Reader) (int64, error) {
+	if err := d.checkNotExists(key); err != nil {
+		return -1, err
+	}
+	tmpKey, err := temporaryKey()
+	if err != nil {
+		return -1, err
+	}
+	tmpInput := d.temporaryInput(tmpKey)
+	digest, _, err := d.uploadObject(tmpInput, data)
+	if err != nil {
+		return -1, err
+	}
+	defer func() {
+		_, err := d.s3.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(d.bucketName),
+			Key:    aws.String(tmpKey),
+		})
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"key": d.fqdn(tmpKey), "error": err}).Errorf("Failed to delete temporary object %q", d.fqdn(tmpKey))
+		}
+	}()
+
+	if err := d.checkNotExists(key); err != nil {
+		return -1, err
+	}
+	attributes := d.uploadInput(key)
+	// the metadata of the temporary object contains the encrypted data key, if any
+	for name, value := range tmpInput.Metadata {
+		attributes.Metadata[name] = value
+	}
+	if attributes.ContentType == nil {
+		attributes.ContentType = tmpInput.ContentType
+	}
+	d.applyUploadRules(attributes, digest.size)
+	digest.setMetadata(attributes.Metadata)
+	setUploadEnd(attributes.Metadata)
+	if err := d.copyObject(tmpKey, key, d.encryption.ciphertextSize(digest.size), attributes); err != nil {
+		return -1, err
+	}
+	return digest.size, nil
+}
+
+// deleteStaleTemporaryObjects deletes the temporary objects which were uploaded before `before` and returns their number.
+// Temporary objects are left behind if the server stops while it copies them to their destination.
+// Objects are only listed if `dryRun` is set.
+func (d *S3Driver) deleteStaleTemporaryObjects(before time.Time, dryRun bool) (int, error) {
+	count, err := d.deleteObjectsBefore(temporaryPrefix, before, dryRun)
+	if err != nil {
+		return count, errors.Wrapf(err, "Failed to delete the temporary objects of %q", d.bucketURL)
+	}
+	return count, nil
+}
+
+// checkNotExists returns an error if the object with key `key` exists or if that can not be determined.
+func (d *S3Driver) checkNotExists(key string) error {
+	exists, err := d.objectExists(key)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return overwriteForbidden(d.fqdn(key))
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/sirupsen/logrus"
+)
+
+// racingReader writes `object` to the bucket when the data was read completely,
+// like a concurrent session which stores the same object during the transfer.
+type racingReader struct {
+	io.Reader
+	bucket *bucketMock
+	key    string
+	object objectMock
+}
+
+func (r *racingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.EOF {
+		r.bucket.Put(r.key, r.object)
+	}
+	return n, err
+}
+
+func TestNoOverwrite(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	defer func(partSize int64) {
+		uploadPartSize = partSize
+	}(uploadPartSize)
+	uploadPartSize = 8
+
+	bucketName := "test-bucket"
+	existing := objectMock{data: []byte("existing"), lastMod: time.Now(), etag: "existing"}
+	for _, conditionalWrites := range []bool{true, false} {
+		for _, testData := range []struct {
+			name      string
+			data      string
+			appending bool
+			racing    bool
+			headErr   error
+			reserved  bool
+			expected  string
+		}{
+			{"new.txt", "new", false, false, nil, false, "new"},
+			{"new.txt", "more than one part", false, false, nil, false, "more than one part"},
+			{"new.txt", "more than one part", true, false, nil, false, "more than one part"},
+			{"existing.txt", "new", false, false, nil, false, "existing"},
+			{"existing.txt", "new", true, false, nil, false, "existing"},
+			{"existing.txt", "new", false, true, nil, false, "existing"},
+			{"existing.txt", "more than one part", false, true, nil, false, "existing"},
+			{"existing.txt", "more than one part", true, true, nil, false, "existing"},
+			{"new.txt", "new", false, false, awserr.New("AccessDenied", "Access Denied", nil), false, ""},
+			{"new.txt", "new", false, false, nil, true, ""},
+		} {
+			description := fmt.Sprintf("conditional writes: %v, %+v", conditionalWrites, testData)
+			expected := testData.expected
+			if conditionalWrites && testData.headErr != nil {
+				// conditional writes do not depend on HeadObject
+				expected = testData.data
+			}
+			bucket := newBucketMock(bucketName)
+			data := io.Reader(strings.NewReader(testData.data))
+			if testData.racing {
+				data = &racingReader{Reader: data, bucket: bucket, key: testData.name, object: existing}
+			} else if testData.name == "existing.txt" {
+				bucket.Put(testData.name, existing)
+			}
+			reservations := newKeyReservations()
+			if testData.reserved {
+				reservations.reserve(testData.name)
+			}
+			d := S3Driver{
+				featureFlags:      featurePut,
+				noOverwrite:       true,
+				conditionalWrites: conditionalWrites,
+				reservations:      reservations,
+				s3:                &s3Mock{bucket: bucket, headErr: testData.headErr},
+				uploader:          &s3UploaderMock{bucket: bucket},
+				metrics:           metricsSenderMock{},
+				bucketName:        bucketName,
+				bucketURL:         intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+			}
+
+			size, err := d.PutFile(testData.name, data, testData.appending)
+			if expected != testData.data {
+				if err == nil {
+					t.Errorf("%s: expected write to fail", description)
+				}
+			} else if err != nil {
+				t.Errorf("%s: %s", description, err)
+			} else if size != int64(len(testData.data)) {
+				t.Errorf("%s: expected size %d but was %d", description, len(testData.data), size)
+			}
+
+			object, err := bucket.Get(testData.name)
+			if expected == "" {
+				if err == nil {
+					t.Errorf("%s: object must not be written", description)
+				}
+			} else if err != nil || string(object.data) != expected {
+				t.Errorf("%s: expected %q but was %q", description, expected, object.data)
+			}
+			for key := range bucket.List() {
+				if strings.HasPrefix(key, temporaryPrefix) {
+					t.Errorf("%s: temporary object %q was not deleted", description, key)
+				}
+			}
+			if !reservations.reserve(testData.name) && !testData.reserved {
+				t.Errorf("%s: reservation was not released", description)
+			}
+		}
+	}
+}
+
+// recordingUploaderMock records the requests of the uploads.
+type recordingUploaderMock struct {
+	*s3UploaderMock
+	inputs []s3manager.UploadInput
+}
+
+func (u *recordingUploaderMock) Upload(input *s3manager.UploadInput, options ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	u.inputs = append(u.inputs, *input)
+	return u.s3UploaderMock.Upload(input, options...)
+}
+
+func TestGuardedUploadAttributes(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucket := newBucketMock(bucketName)
+	uploader := &recordingUploaderMock{s3UploaderMock: &s3UploaderMock{bucket: bucket}}
+	d := S3Driver{
+		featureFlags: featurePut,
+		noOverwrite:  true,
+		config: &Config{
+			ObjectTags:  map[string]string{"source": "ftp"},
+			UploadRules: []UploadRule{{Glob: "*.txt", StorageClass: "STANDARD_IA"}},
+		},
+		s3:         &s3Mock{bucket: bucket},
+		uploader:   uploader,
+		metrics:    metricsSenderMock{},
+		sessionID:  "0123456789abcdef",
+		cwd:        "/",
+		bucketName: bucketName,
+		bucketURL:  intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+	if _, err := d.PutFile("file.txt", strings.NewReader("data"), false); err != nil {
+		t.Fatal(err)
+	}
+	if len(uploader.inputs) != 1 || !strings.HasPrefix(aws.StringValue(uploader.inputs[0].Key), temporaryPrefix) {
+		t.Fatalf("Expected a single upload of a temporary object but were %d", len(uploader.inputs))
+	}
+	temporary := uploader.inputs[0]
+	if _, ok := temporary.Metadata[metadataSession]; ok || temporary.Tagging != nil || temporary.StorageClass != nil {
+		t.Errorf("Expected the temporary object to have neither provenance nor tags nor upload rules: %+v", temporary)
+	}
+	object, err := bucket.Get("file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadataValue(object.metadata, metadataSession) != "0123456789abcdef" || object.headers.tagging != "source=ftp" || object.headers.storageClass != "STANDARD_IA" {
+		t.Errorf("Expected the object to have provenance, tags and upload rules: %+v %+v", object.metadata, object.headers)
+	}
+}
+
+func TestObjectExistsFailsClosed(t *testing.T) {
+	bucketName := "test-bucket"
+	d := S3Driver{
+		s3:         &s3Mock{bucket: newBucketMock(bucketName), headErr: awserr.New("InternalError", "We encountered an internal error", nil)},
+		bucketName: bucketName,
+		bucketURL:  intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+	if exists, err := d.objectExists("some.txt"); err == nil {
+		t.Errorf("Expected an error but object was reported as existing: %v", exists)
+	}
+}
+
+// hidingS3Mock reports the object with key `hidden` as missing to HeadObject,
+// like an object which a concurrent session writes right after it was checked.
+type hidingS3Mock struct {
+	*s3Mock
+	hidden string
+}
+
+func (mock *hidingS3Mock) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	if aws.StringValue(input.Key) == mock.hidden {
+		return nil, awserr.New("NotFound", "Not Found", nil)
+	}
+	return mock.s3Mock.HeadObject(input)
+}
+
+func TestConditionalCopies(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	defer func(maxSize int64) {
+		maxCopyObjectSize = maxSize
+	}(maxCopyObjectSize)
+
+	bucketName := "test-bucket"
+	for _, maxSize := range []int64{maxCopyObjectSize, 4} {
+		maxCopyObjectSize = maxSize
+		bucket := newBucketMock(bucketName)
+		existing := objectMock{data: []byte("existing"), lastMod: time.Now(), etag: "existing"}
+		bucket.Put("existing.txt", existing)
+		bucket.Put("source.txt", objectMock{data: []byte("source"), lastMod: time.Now(), etag: "source"})
+		bucket.Put(trashKey("existing.txt", "", time.Now()), objectMock{data: []byte("deleted"), lastMod: time.Now(), etag: "deleted"})
+		d := S3Driver{
+			featureFlags:      featurePut | featureMove,
+			noOverwrite:       true,
+			conditionalWrites: true,
+			softDelete:        true,
+			s3:                &hidingS3Mock{s3Mock: &s3Mock{bucket: bucket}, hidden: "existing.txt"},
+			uploader:          &s3UploaderMock{bucket: bucket},
+			metrics:           metricsSenderMock{},
+			cwd:               "/",
+			bucketName:        bucketName,
+			bucketURL:         intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+		}
+
+		if err := d.Rename("source.txt", "existing.txt"); err == nil {
+			t.Errorf("Max copy size %d: expected the rename onto an existing object to fail", maxSize)
+		}
+		if err := d.Restore("existing.txt"); err == nil {
+			t.Errorf("Max copy size %d: expected the restore onto an existing object to fail", maxSize)
+		}
+		if object, err := bucket.Get("existing.txt"); err != nil || string(object.data) != "existing" {
+			t.Errorf("Max copy size %d: expected the existing object to be kept but was %q", maxSize, object.data)
+		}
+		if _, err := bucket.Get("source.txt"); err != nil {
+			t.Errorf("Max copy size %d: expected the source of the failed rename to be kept", maxSize)
+		}
+	}
+}
+
+func TestDeleteStaleTemporaryObjects(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucket := newBucketMock(bucketName)
+	now := time.Now()
+	for key, age := range map[string]time.Duration{
+		temporaryPrefix + "stale":   48 * time.Hour,
+		temporaryPrefix + "running": time.Minute,
+		"alice/old.txt":             48 * time.Hour,
+	} {
+		bucket.Put(key, objectMock{data: []byte(key), lastMod: now.Add(-age), etag: key})
+	}
+	d := &S3Driver{
+		s3:         &s3Mock{bucket: bucket},
+		bucketName: bucketName,
+		bucketURL:  intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+
+	if count, err := d.deleteStaleTemporaryObjects(now.Add(-24*time.Hour), true); err != nil || count != 1 || len(bucket.List()) != 3 {
+		t.Errorf("Expected a dry run to find 1 object without deleting it but found %d: %v", count, err)
+	}
+	if count, err := d.deleteStaleTemporaryObjects(now.Add(-24*time.Hour), false); err != nil || count != 1 {
+		t.Errorf("Expected to delete 1 object but deleted %d: %v", count, err)
+	}
+	for key, expected := range map[string]bool{temporaryPrefix + "stale": false, temporaryPrefix + "running": true, "alice/old.txt": true} {
+		if _, err := bucket.Get(key); (err == nil) != expected {
+			t.Errorf("Expected %s to exist: %v", key, expected)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Prefixes of the supported crypt-style password hashes.
+const (
+	prefixBcrypt    = "$2"
+	prefixArgon2id  = "$argon2id$"
+	prefixSHA512    = "$6$"
+	sha512MinRounds = 1000
+	sha512MaxRounds = 999999999
+	// sha512DefaultRounds is the number of rounds of a SHA-512 crypt hash without `rounds=` parameter
+	sha512DefaultRounds = 5000
+	sha512MaxSaltLength = 16
+)
+
+// Parameters of the argon2id hashes created by HashPassword, as recommended by OWASP.
+const (
+	argon2idMemory     = 19 * 1024
+	argon2idTime       = 2
+	argon2idThreads    = 1
+	argon2idSaltLength = 16
+	argon2idKeyLength  = 32
+)
+
+// isPasswordHash returns true if the stored password `stored` is a hash in one of the supported formats:
+// bcrypt (`$2a$`, `$2b$`, `$2y$`), argon2id (`$argon2id$`) and SHA-512 crypt (`$6$`).
+// Any other value is a legacy plaintext password.
+func isPasswordHash(stored string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$", prefixArgon2id, prefixSHA512} {
+		if strings.HasPrefix(stored, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// validatePasswordHash returns an error if the password hash `hash` is malformed.
+// The error never contains the hash itself.
+func validatePasswordHash(hash string) error {
+	var err error
+	switch {
+	case strings.HasPrefix(hash, prefixBcrypt):
+		_, err = bcrypt.Cost([]byte(hash))
+	case strings.HasPrefix(hash, prefixArgon2id):
+		_, err = parseArgon2id(hash)
+	case strings.HasPrefix(hash, prefixSHA512):
+		_, _, _, err = parseSHA512Crypt(hash)
+	}
+	if err != nil {
+		return fmt.Errorf("malformed password hash")
+	}
+	return nil
+}
+
+// verifyPassword returns true if `password` matches the stored password `stored`, which is either a hash (see isPasswordHash)
+// or a plaintext password. All comparisons take constant time with respect to the password.
+func verifyPassword(stored, password string) bool {
+	switch {
+	case !isPasswordHash(stored):
+		// hashing first makes the comparison independent of the length of the passwords
+		a, b := sha256.Sum256([]byte(stored)), sha256.Sum256([]byte(password))
+		return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+	case strings.HasPrefix(stored, prefixBcrypt):
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	case strings.HasPrefix(stored, prefixArgon2id):
+		params, err := parseArgon2id(stored)
+		if err != nil {
+			return false
+		}
+		key := argon2.IDKey([]byte(password), params.salt, params.time, params.memory, params.threads, uint32(len(params.key)))
+		return subtle.ConstantTimeCompare(key, params.key) == 1
+	default:
+		computed, err := sha512Crypt(password, stored)
+		if err != nil {
+			return false
+		}
+		return subtle.ConstantTimeCompare([]byte(computed), []byte(stored)) == 1
+	}
+}
+
+// dummyHash is a hash of the default algorithm which unknown users are verified against, see verifyUnknownUser.
+var dummyHash struct {
+	once sync.Once
+	hash string
+}
+
+// verifyUnknownUser verifies `password` against a dummy hash of the default algorithm,
+// so that rejecting an unknown user takes as long as rejecting a known user with a wrong password.
+// The response time thus does not reveal which users exist.
+func verifyUnknownUser(password string) {
+	dummyHash.once.Do(func() {
+		dummyHash.hash, _ = HashPassword("unknown user")
+	})
+	verifyPassword(dummyHash.hash, password)
+}
+
+// HashPassword returns the argon2id hash of `password` with a random salt in PHC string format,
+// which can be stored in the credentials file.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, argon2idSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, argon2idTime, argon2idMemory, argon2idThreads, argon2idKeyLength)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", prefixArgon2id, argon2.Version, argon2idMemory, argon2idTime, argon2idThreads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// argon2idParams are the parameters and the key of an argon2id hash.
+type argon2idParams struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+// parseArgon2id parses an argon2id hash in PHC string format, e.g. `$argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>`,
+// where salt and key are base64 encoded without padding.
+func parseArgon2id(hash string) (argon2idParams, error) {
+	params := argon2idParams{}
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return params, fmt.Errorf("unsupported argon2id hash")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+		return params, err
+	}
+	if params.memory == 0 || params.time == 0 || params.threads == 0 {
+		return params, fmt.Errorf("invalid argon2id parameters")
+	}
+	var err error
+	if params.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return params, err
+	}
+	if params.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return params, err
+	}
+	if len(params.key) == 0 {
+		return params, fmt.Errorf("empty argon2id key")
+	}
+	return params, nil
+}
+
+// parseSHA512Crypt returns the salt and number of rounds of the SHA-512 crypt hash or setting `hash`,
+// i.e. `$6$[rounds=<rounds>$]<salt>[$<hash>]`, and whether the number of rounds was given explicitly.
+// Like crypt(3), the salt is truncated to 16 characters and the number of rounds is clamped to the valid range.
+func parseSHA512Crypt(hash string) (string, int, bool, error) {
+	if !strings.HasPrefix(hash, prefixSHA512) {
+		return "", 0, false, fmt.Errorf("not a SHA-512 crypt hash")
+	}
+	parts := strings.Split(strings.TrimPrefix(hash, prefixSHA512), "$")
+	rounds, explicit := sha512DefaultRounds, false
+	if strings.HasPrefix(parts[0], "rounds=") {
+		n, err := strconv.ParseUint(strings.TrimPrefix(parts[0], "rounds="), 10, 32)
+		if err != nil || len(parts) < 2 {
+			return "", 0, false, fmt.Errorf("invalid rounds")
+		}
+		rounds, explicit, parts = int(n), true, parts[1:]
+		if rounds < sha512MinRounds {
+			rounds = sha512MinRounds
+		} else if rounds > sha512MaxRounds {
+			rounds = sha512MaxRounds
+		}
+	}
+	if len(parts) > 2 {
+		return "", 0, false, fmt.Errorf("invalid SHA-512 crypt hash")
+	}
+	salt := parts[0]
+	if len(salt) > sha512MaxSaltLength {
+		salt = salt[:sha512MaxSaltLength]
+	}
+	return salt, rounds, explicit, nil
+}
+
+// sha512Crypt returns the SHA-512 crypt hash of `password` with the salt and rounds of `setting`, which may be a hash,
+// as specified by https://www.akkadia.org/drepper/SHA-crypt.txt.
+func sha512Crypt(password, setting string) (string, error) {
+	salt, rounds, explicit, err := parseSHA512Crypt(setting)
+	if err != nil {
+		return "", err
+	}
+	p, s := []byte(password), []byte(salt)
+
+	digestB := sha512.New()
+	digestB.Write(p)
+	digestB.Write(s)
+	digestB.Write(p)
+	b := digestB.Sum(nil)
+
+	digestA := sha512.New()
+	digestA.Write(p)
+	digestA.Write(s)
+	digestA.Write(repeatBytes(b, len(p)))
+	for n := len(p); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			digestA.Write(b)
+		} else {
+			digestA.Write(p)
+		}
+	}
+	a := digestA.Sum(nil)
+
+	digestDP := sha512.New()
+	for i := 0; i < len(p); i++ {
+		digestDP.Write(p)
+	}
+	pSeq := repeatBytes(digestDP.Sum(nil), len(p))
+
+	digestDS := sha512.New()
+	for i := 0; i < 16+int(a[0]); i++ {
+		digestDS.Write(s)
+	}
+	sSeq := repeatBytes(digestDS.Sum(nil), len(s))
+
+	c := a
+	for i := 0; i < rounds; i++ {
+		digestC := sha512.New()
+		if i&1 != 0 {
+			digestC.Write(pSeq)
+		} else {
+			digestC.Write(c)
+		}
+		if i%3 != 0 {
+			digestC.Write(sSeq)
+		}
+		if i%7 != 0 {
+			digestC.Write(pSeq)
+		}
+		if i&1 != 0 {
+			digestC.Write(c)
+		} else {
+			digestC.Write(pSeq)
+		}
+		c = digestC.Sum(nil)
+	}
+
+	var result bytes.Buffer
+	result.WriteString(prefixSHA512)
+	if explicit {
+		fmt.Fprintf(&result, "rounds=%d$", rounds)
+	}
+	result.WriteString(salt)
+	result.WriteByte('$')
+	for _, group := range sha512CryptOrder {
+		encodeCrypt64(&result, uint(c[group[0]])<<16|uint(c[group[1]])<<8|uint(c[group[2]]), 4)
+	}
+	encodeCrypt64(&result, uint(c[63]), 2)
+	return result.String(), nil
+}
+
+// sha512CryptOrder is the order in which the bytes of the final digest are encoded, in groups of three.
+var sha512CryptOrder = [][3]int{
+	{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4}, {47, 5, 26}, {6, 27, 48},
+	{28, 49, 7}, {50, 8, 29}, {9, 30, 51}, {31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13},
+	{56, 14, 35}, {15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19}, {62, 20, 41},
+}
+
+// crypt64 is the alphabet of the base64 encoding of crypt(3).
+const crypt64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// encodeCrypt64 writes the lowest `n` 6 bit groups of `value`, least significant first.
+func encodeCrypt64(w *bytes.Buffer, value uint, n int) {
+	for i := 0; i < n; i++ {
+		w.WriteByte(crypt64[value&0x3f])
+		value >>= 6
+	}
+}
+
+// repeatBytes returns `length` bytes consisting of repetitions of `b`.
+func repeatBytes(b []byte, length int) []byte {
+	result := make([]byte, 0, length)
+	for len(result) < length {
+		n := length - len(result)
+		if n > len(b) {
+			n = len(b)
+		}
+		result = append(result, b[:n]...)
+	}
+	return result
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestSHA512Crypt(t *testing.T) {
+	for _, testData := range []struct {
+		setting, password, expected string
+	}{
+		// https://www.akkadia.org/drepper/SHA-crypt.txt
+		{"$6$saltstring", "Hello world!", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		{"$6$rounds=10000$saltstringsaltstring", "Hello world!", "$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v."},
+		{"$6$rounds=5000$toolongsaltstring", "This is just a test", "$6$rounds=5000$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0"},
+		{"$6$rounds=10$roundstoolow", "the minimum number is still observed", "$6$rounds=1000$roundstoolow$kUMsbe306n21p9R.FRkW3IGn.S9NPN0x50YhH1xhLsPuWGsUSklZt58jaTfF4ZEQpyUNGc0dqbpBYYBaHHrsX."},
+		// glibc crypt(3)
+		{"$6$xyz", "", "$6$xyz$jdHJneX6eYV7DP95OgtnE1J5bHq1yUumSdLXo09t/VEMjhG5QzsLETLqiWjslhYH9CihD0nXyST9wmd80QDa9/"},
+		{"$6$longpw", strings.Repeat("a", 100), "$6$longpw$BBqNtCUz..I.3nGiwIx777ynHeQVnuzgG5wYwl/7Jy2BI/5owlsOm9ZXEaAhnfcEwdfci.hwO60F0a.2eyy1o/"},
+	} {
+		actual, err := sha512Crypt(testData.password, testData.setting)
+		if err != nil {
+			t.Errorf("%s: %s", testData.setting, err)
+			continue
+		}
+		if actual != testData.expected {
+			t.Errorf("Expected hash %q but was %q", testData.expected, actual)
+		}
+	}
+}
+
+func TestVerifyPassword(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := []byte("0123456789abcdef")
+	argon2idHash := fmt.Sprintf("$argon2id$v=19$m=1024,t=2,p=1$%s$%s",
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("secret"), salt, 2, 1024, 1, 32)))
+
+	for _, stored := range []string{
+		"secret",
+		string(bcryptHash),
+		strings.Replace(string(bcryptHash), "$2a$", "$2y$", 1),
+		strings.Replace(string(bcryptHash), "$2a$", "$2b$", 1),
+		argon2idHash,
+		"$6$rounds=1000$abcdefgh$nhYjN017qxiYztzyUpZtPnUQcnLy62KsunSLHNeLahp2EHPlAKmFFlrjEwSXGo2kgY5hR2.peKEg2VGUqIJJu1",
+	} {
+		if err := validatePasswordHash(stored); err != nil {
+			t.Errorf("%s: %s", stored, err)
+		}
+		if !verifyPassword(stored, "secret") {
+			t.Errorf("Expected the password to match %q", stored)
+		}
+		for _, wrong := range []string{"", "Secret", "secret ", stored} {
+			if wrong != "secret" && verifyPassword(stored, wrong) {
+				t.Errorf("Expected %q not to match %q", wrong, stored)
+			}
+		}
+	}
+
+	for _, malformed := range []string{
+		"$2y$10$tooshort",
+		"$argon2id$v=19$m=1024,t=2,p=1$c2FsdA",
+		"$argon2id$v=16$m=1024,t=2,p=1$c2FsdA$c2FsdA",
+		"$argon2id$v=19$m=0,t=2,p=1$c2FsdA$c2FsdA",
+		"$argon2id$v=19$m=1024,t=2,p=1$c2FsdA$!!!",
+		"$6$rounds=many$salt$hash",
+		"$6$salt$hash$more",
+	} {
+		if err := validatePasswordHash(malformed); err == nil {
+			t.Errorf("Expected %q to be malformed", malformed)
+		} else if strings.Contains(err.Error(), malformed) {
+			t.Errorf("Expected the error not to contain the hash: %s", err)
+		}
+		if verifyPassword(malformed, "") {
+			t.Errorf("Expected no password to match %q", malformed)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"path"
+	"strings"
+)
+
+// resolvePath returns the normalized, absolute FTP path for `p`.
+// Relative paths are resolved against the session's current working directory,
+// `.` and `..` elements as well as duplicate slashes are removed.
+// A path can never point above the root directory, i.e. `/../foo` resolves to `/foo`.
+func (d *S3Driver) resolvePath(p string) string {
+	p = strings.Replace(p, "\\", "/", -1)
+	if !strings.HasPrefix(p, "/") {
+		cwd := d.cwd
+		if cwd == "" {
+			cwd = "/"
+		}
+		p = cwd + "/" + p
+	}
+	return path.Clean(p)
+}
+
+// relativePath returns the FTP path `p` relative to the mount point of the bucket the driver is switched to
+// (see enterMount), which is the root directory for the default bucket. The result has no leading slash.
+func (d *S3Driver) relativePath(p string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(d.resolvePath(p), d.mountPath()), "/")
+}
+
+// objectKey returns the s3 object key for the FTP path `p`, which is located in the user's home directory.
+// The root directory maps onto the home directory's prefix, which is empty if the home is the root of the bucket.
+// Files which were uploaded by the session under a key determined by the key template map onto that key.
+func (d *S3Driver) objectKey(p string) string {
+	if key, ok := d.uploadedNames[d.resolvePath(p)]; ok {
+		return key
+	}
+	return d.home() + d.relativePath(p)
+}
+
+// isRoot returns true if the FTP path `p` is the root directory, i.e. the user's home directory, or a mount point.
+func (d *S3Driver) isRoot(p string) bool {
+	return d.relativePath(p) == ""
+}
+
+// dirPrefix returns the object key prefix which contains all objects located in the FTP directory `dir`.
+// The root directory corresponds to the prefix of the user's home directory.
+func (d *S3Driver) dirPrefix(dir string) string {
+	if d.isRoot(dir) {
+		return d.home()
+	}
+	return d.home() + d.relativePath(dir) + "/"
+}
+
+// reservedPrefixes are the prefixes of the objects which are managed by the driver and are not accessible by users.
+var reservedPrefixes = []string{trashPrefix, temporaryPrefix}
+
+// isReserved returns true if the FTP path `p` is located in a directory which is reserved for the driver, e.g. the trash.
+func (d *S3Driver) isReserved(p string) bool {
+	key := d.objectKey(p)
+	for _, prefix := range reservedPrefixes {
+		if strings.HasPrefix(key+"/", prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestResolvePath(t *testing.T) {
+	testDataSet := []struct {
+		id     string
+		cwd    string
+		path   string
+		key    string
+		prefix string
+	}{
+		{"root", "/", "/", "", ""},
+		{"empty", "/", "", "", ""},
+		{"absolute", "/foo", "/bar/baz.txt", "bar/baz.txt", "bar/baz.txt/"},
+		{"relative", "/foo", "bar.txt", "foo/bar.txt", "foo/bar.txt/"},
+		{"relative-dot", "/foo", "./bar/./baz", "foo/bar/baz", "foo/bar/baz/"},
+		{"parent", "/foo/bar", "../baz", "foo/baz", "foo/baz/"},
+		{"escape-root", "/foo", "../../../etc/passwd", "etc/passwd", "etc/passwd/"},
+		{"duplicate-slashes", "/", "//foo///bar//", "foo/bar", "foo/bar/"},
+		{"unset-cwd", "", "foo", "foo", "foo/"},
+		{"backslashes", "/", "foo\\bar", "foo/bar", "foo/bar/"},
+	}
+	for _, testData := range testDataSet {
+		d := S3Driver{cwd: testData.cwd}
+		if key := d.objectKey(testData.path); key != testData.key {
+			t.Errorf("Test %s: expected key %q but was %q", testData.id, testData.key, key)
+		}
+		if prefix := d.dirPrefix(testData.path); prefix != testData.prefix {
+			t.Errorf("Test %s: expected prefix %q but was %q", testData.id, testData.prefix, prefix)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/errors"
+)
+
+const (
+	// metadataUser is the object metadata key of the URL encoded name of the FTP user who uploaded an object.
+	metadataUser = "f3-user"
+	// metadataClientIP is the object metadata key of the IP address of the FTP client which uploaded an object.
+	metadataClientIP = "f3-client-ip"
+	// metadataSession is the object metadata key of the URL encoded ID of the FTP session which uploaded an object.
+	metadataSession = "f3-session"
+	// metadataHost is the object metadata key of the URL encoded host name of the f3 server which received an object.
+	metadataHost = "f3-host"
+	// metadataUploadStart and metadataUploadEnd are the object metadata keys of the time (RFC 3339)
+	// when the upload of an object started and when all of its data was received.
+	metadataUploadStart = "f3-upload-start"
+	metadataUploadEnd   = "f3-upload-end"
+	// metadataFilename is the object metadata key of the URL encoded path of an object as sent by the FTP client.
+	metadataFilename = "f3-filename"
+)
+
+// maxObjectTags is the maximum number of tags of an object.
+const maxObjectTags = 10
+
+// uploadProvenance describes the upload which is currently received by a session.
+type uploadProvenance struct {
+	filename string
+	start    time.Time
+}
+
+// newSessionID returns a random ID which identifies an FTP session in logs and object metadata.
+func newSessionID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", errors.Wrap(err, "Failed to generate a session ID")
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// clientIP returns the IP address of the remote address `addr`.
+func clientIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// setProvenance stores who uploaded an object from where in the object metadata `metadata`.
+// Values which are not under the control of f3 are URL encoded, since metadata headers must be ASCII.
+func (d *S3Driver) setProvenance(metadata map[string]*string) {
+	set := func(name, value string) {
+		if value != "" {
+			metadata[name] = aws.String(value)
+		}
+	}
+	set(metadataUser, url.PathEscape(d.user()))
+	set(metadataClientIP, d.clientIP)
+	set(metadataSession, url.PathEscape(d.sessionID))
+	set(metadataHost, url.PathEscape(d.hostname))
+	if !d.upload.start.IsZero() {
+		set(metadataUploadStart, d.upload.start.UTC().Format(time.RFC3339))
+	}
+	set(metadataFilename, url.PathEscape(d.upload.filename))
+}
+
+// uploader returns the name of the FTP user who uploaded an object with the object metadata `metadata`,
+// or an empty string if it is unknown.
+func uploader(metadata map[string]*string) string {
+	user := metadataValue(metadata, metadataUser)
+	if unescaped, err := url.PathUnescape(user); err == nil {
+		return unescaped
+	}
+	// objects uploaded by earlier versions have unescaped user names
+	return user
+}
+
+// setUploadEnd stores the current time as the time when all data of an object was received in the object metadata `metadata`.
+func setUploadEnd(metadata map[string]*string) {
+	metadata[metadataUploadEnd] = aws.String(time.Now().UTC().Format(time.RFC3339))
+}
+
+// objectTags returns the URL encoded tags of uploaded objects.
+// The placeholders `{user}`, `{host}` and `{session}` in tag values are replaced by the FTP user,
+// the host name of the server and the session ID.
+func (d *S3Driver) objectTags() *string {
+	if d.config == nil || len(d.config.ObjectTags) == 0 {
+		return nil
+	}
+	replacer := strings.NewReplacer("{user}", d.user(), "{host}", d.hostname, "{session}", d.sessionID)
+	tags := url.Values{}
+	for key, value := range d.config.ObjectTags {
+		tags.Set(key, replacer.Replace(value))
+	}
+	return aws.String(tags.Encode())
+}
+
+// validateObjectTags returns an error if `tags` exceed the limits of object tags.
+func validateObjectTags(tags map[string]string) error {
+	if len(tags) > maxObjectTags {
+		return fmt.Errorf("at most %d object tags are allowed", maxObjectTags)
+	}
+	keys := []string{}
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if key == "" || len(key) > 128 {
+			return fmt.Errorf("object tag key %q must have 1 to 128 characters", key)
+		}
+		if len(tags[key]) > 256 {
+			return fmt.Errorf("value of object tag %q must have at most 256 characters", key)
+		}
+	}
+	return nil
+}
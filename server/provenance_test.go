@@ -0,0 +1,192 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	ftp "github.com/goftp/server"
+	"github.com/sirupsen/logrus"
+)
+
+func TestProvenance(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	defer func(partSize int64) {
+		uploadPartSize = partSize
+	}(uploadPartSize)
+	uploadPartSize = 8
+
+	bucketName := "test-bucket"
+	config := &Config{ObjectTags: map[string]string{"source": "ftp", "session": "{session}"}}
+	for _, mode := range []string{"plain", "resumable", "guarded", "conditional", "append"} {
+		for _, data := range []string{"small", "more than one part"} {
+			description := fmt.Sprintf("%s: %q", mode, data)
+			bucket := newBucketMock(bucketName)
+			d := S3Driver{
+				featureFlags: featurePut,
+				config:       config,
+				s3:           &s3Mock{bucket: bucket},
+				uploader:     &s3UploaderMock{bucket: bucket},
+				metrics:      metricsSenderMock{},
+				hostname:     "ftp.example.com",
+				sessionID:    "0123456789abcdef",
+				clientIP:     "192.0.2.1",
+				cwd:          "/",
+				bucketName:   bucketName,
+				bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+			}
+			switch mode {
+			case "resumable":
+				d.pendingUploads = newPendingUploads()
+			case "guarded":
+				d.noOverwrite = true
+			case "conditional":
+				d.noOverwrite = true
+				d.conditionalWrites = true
+			}
+
+			before := time.Now().UTC().Truncate(time.Second)
+			if _, err := d.PutFile("dir/my file.txt", strings.NewReader(data), mode == "append"); err != nil {
+				t.Errorf("%s: %s", description, err)
+				continue
+			}
+			after := time.Now().UTC()
+			object, err := bucket.Get("dir/my file.txt")
+			if err != nil {
+				t.Errorf("%s: %s", description, err)
+				continue
+			}
+
+			for name, expected := range map[string]string{
+				metadataClientIP: "192.0.2.1",
+				metadataSession:  "0123456789abcdef",
+				metadataHost:     "ftp.example.com",
+				metadataFilename: url.PathEscape("/dir/my file.txt"),
+			} {
+				if actual := metadataValue(object.metadata, name); actual != expected {
+					t.Errorf("%s: expected metadata %s to be %q but was %q", description, name, expected, actual)
+				}
+			}
+			start, err := time.Parse(time.RFC3339, metadataValue(object.metadata, metadataUploadStart))
+			if err != nil {
+				t.Errorf("%s: invalid start of upload: %s", description, err)
+			}
+			end, err := time.Parse(time.RFC3339, metadataValue(object.metadata, metadataUploadEnd))
+			if err != nil {
+				t.Errorf("%s: invalid end of upload: %s", description, err)
+			}
+			if start.Before(before) || end.Before(start) || end.After(after) {
+				t.Errorf("%s: upload from %s to %s is not within %s and %s", description, start, end, before, after)
+			}
+			if expected := "session=0123456789abcdef&source=ftp"; object.headers.tagging != expected {
+				t.Errorf("%s: expected tags %q but were %q", description, expected, object.headers.tagging)
+			}
+			if d.upload != (uploadProvenance{}) {
+				t.Errorf("%s: upload was not reset: %+v", description, d.upload)
+			}
+		}
+	}
+}
+
+func TestOwnerAndGroup(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucket := newBucketMock(bucketName)
+	bucket.Put("dir/a.txt", objectMock{data: []byte("a"), lastMod: time.Now(), etag: "a", metadata: map[string]*string{metadataUser: aws.String("alice")}})
+	bucket.Put("dir/b.txt", objectMock{data: []byte("b"), lastMod: time.Now(), etag: "b"})
+	bucket.Put("dir/sub/c.txt", objectMock{data: []byte("c"), lastMod: time.Now(), etag: "c"})
+
+	for _, showUploader := range []bool{false, true} {
+		d := S3Driver{
+			featureFlags: featureList,
+			s3:           &s3Mock{bucket: bucket},
+			metrics:      metricsSenderMock{},
+			group:        "uploads",
+			showUploader: showUploader,
+			cwd:          "/",
+			bucketName:   bucketName,
+			bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+		}
+
+		info, err := d.Stat("dir/a.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Owner() != "alice" || info.Group() != "uploads" {
+			t.Errorf("Expected owner alice and group uploads but were %s and %s", info.Owner(), info.Group())
+		}
+		info, err = d.Stat("dir/b.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Owner() != "Unknown" {
+			t.Errorf("Expected unknown owner but was %s", info.Owner())
+		}
+
+		expected := map[string]string{"a.txt": "Unknown", "b.txt": "Unknown", "sub": "Unknown"}
+		if showUploader {
+			expected["a.txt"] = "alice"
+		}
+		err = d.ListDir("dir", func(info ftp.FileInfo) error {
+			if info.Owner() != expected[info.Name()] {
+				t.Errorf("Show uploader: %v: expected owner %s of %q but was %s", showUploader, expected[info.Name()], info.Name(), info.Owner())
+			}
+			if info.Group() != "uploads" {
+				t.Errorf("Expected group uploads of %q but was %s", info.Name(), info.Group())
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestNonASCIIUploader(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucket := newBucketMock(bucketName)
+	credentials, err := AuthenticatorFromString("jürgen:secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := startFTPServer(t, func() *S3Driver {
+		return &S3Driver{
+			featureFlags: featureList | featurePut,
+			showUploader: true,
+			homeTemplate: "/",
+			s3:           &s3Mock{bucket: bucket},
+			uploader:     &s3UploaderMock{bucket: bucket},
+			metrics:      metricsSenderMock{},
+			hostname:     "ftp.exämple.com",
+			bucketName:   bucketName,
+			bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+		}
+	}, credentials)
+
+	c := dialFTP(t, addr, "jürgen", "secret")
+	if code := c.store("data", "STOR report.csv"); code != 226 {
+		t.Fatalf("Upload failed with %d", code)
+	}
+	object, err := bucket.Get("report.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range object.metadata {
+		for _, c := range aws.StringValue(value) {
+			if c > 0x7f {
+				t.Errorf("Expected metadata %s to be ASCII but was %q", name, aws.StringValue(value))
+				break
+			}
+		}
+	}
+	if user := metadataValue(object.metadata, metadataUser); user != url.PathEscape("jürgen") {
+		t.Errorf("Expected the URL encoded user name but was %q", user)
+	}
+	if listing, code := c.retrieve("LIST /"); code != 226 || !strings.Contains(listing, "jürgen") {
+		t.Errorf("Expected the uploader to be listed but was %d %q", code, listing)
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+)
+
+// settings are the settings of a DriverFactory which can be reloaded without restarting the server, see DriverFactory.Reload.
+// Sessions keep the settings they were started with.
+type settings struct {
+	// config is the content of the configuration file
+	config   *Config
+	mounts   []*mount
+	provider AuthProvider
+}
+
+// currentSettings holds the settings of a DriverFactory, which are replaced as a whole.
+type currentSettings struct {
+	mutex    sync.RWMutex
+	settings settings
+}
+
+func (c *currentSettings) get() settings {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.settings
+}
+
+func (c *currentSettings) set(s settings) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.settings = s
+}
+
+// SetAuthProvider sets the provider which authenticates the users logging in, see Auth.
+// The current provider is kept if the settings of its users are invalid.
+func (d DriverFactory) SetAuthProvider(provider AuthProvider) error {
+	return d.apply(d.settings.get().config, provider)
+}
+
+// Reload reloads the configuration file and sets the auth provider `provider`, see SetAuthProvider.
+// The current settings are kept if any of the new ones is invalid.
+// Sessions which have already started are not affected, the new settings apply to new sessions and logins.
+func (d DriverFactory) Reload(provider AuthProvider) error {
+	fileConfig := &Config{}
+	if d.configFile != "" {
+		var err error
+		if fileConfig, err = LoadConfig(d.configFile); err != nil {
+			return err
+		}
+	}
+	return d.apply(fileConfig, provider)
+}
+
+// apply validates the settings given by the configuration file `fileConfig` and the auth provider `provider`, and replaces the current ones.
+func (d DriverFactory) apply(fileConfig *Config, provider AuthProvider) error {
+	if p, ok := provider.(validatingProvider); ok {
+		if err := p.validate(fileConfig); err != nil {
+			return err
+		}
+	}
+	mounts, err := d.newMounts(fileConfig)
+	if err != nil {
+		return err
+	}
+	d.settings.set(settings{config: fileConfig, mounts: mounts, provider: provider})
+	return nil
+}
+
+// reloadableAuth checks credentials with the current auth provider of a DriverFactory.
+type reloadableAuth struct {
+	settings   *currentSettings
+	identities *identities
+	home       string
+}
+
+// CheckPasswd authenticates `username` with the current auth provider and keeps the user's identity for the user's session.
+// Users whose name can not be part of their home directory or of the prefix of a mount are rejected, see Config.checkUsername.
+// Users who log in with a name other than the one of their identity, e.g. in different case, are rejected,
+// since their settings and access rules apply to their identity's name only.
+func (a reloadableAuth) CheckPasswd(username, password string) (bool, error) {
+	current := a.settings.get()
+	if current.provider == nil {
+		return false, fmt.Errorf("No auth provider")
+	}
+	identity, err := current.provider.Authenticate(username, password)
+	if err != nil {
+		return false, err
+	}
+	if identity.User != username {
+		return false, fmt.Errorf("User %q must log in as %q", username, identity.User)
+	}
+	if err := current.config.withIdentity(identity).checkUsername(username, a.home); err != nil {
+		return false, err
+	}
+	a.identities.set(identity)
+	return true, nil
+}
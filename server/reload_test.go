@@ -0,0 +1,106 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "f3-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "config.json")
+	writeConfig := func(config string) {
+		if err := ioutil.WriteFile(configFile, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(`{"users": {"alice": {"features": "ls"}}}`)
+	factory, err := NewDriverFactory(&FactoryConfig{
+		FtpFeatures:       DefaultFeatureSet,
+		FtpHome:           DefaultHome,
+		S3Credentials:     "access:secret",
+		S3BucketURL:       "https://some-bucket.somewhere.com",
+		S3Region:          DefaultRegion,
+		ConfigFile:        configFile,
+		DisableCloudWatch: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := factory.Auth()
+	if ok, _ := auth.CheckPasswd("alice", "secret"); ok {
+		t.Errorf("Expected no user to be authenticated without credentials")
+	}
+	credentials, err := AuthenticatorFromString("alice:secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := factory.SetAuthProvider(credentials); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := auth.CheckPasswd("alice", "secret"); !ok {
+		t.Errorf("Expected alice to be authenticated: %v", err)
+	}
+	session, err := factory.NewDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeConfig(`{"users": {"alice": {"features": "ls,get"}}, "mounts": [{"path": "/archive", "bucket": "s3://archive"}]}`)
+	credentials, err = AuthenticatorFromString("alice:secret\nbob:secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := factory.Reload(credentials); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := auth.CheckPasswd("bob", "secret"); !ok {
+		t.Errorf("Expected the added user bob to be authenticated: %v", err)
+	}
+	if features := session.(*S3Driver).config.Users["alice"].Features; features != "ls" {
+		t.Errorf("Expected the started session to keep its settings but features were %q", features)
+	}
+	if mounts := session.(*S3Driver).mounts; len(mounts) != 0 {
+		t.Errorf("Expected the started session to keep its mounts but were %d", len(mounts))
+	}
+	newSession, err := factory.NewDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if features := newSession.(*S3Driver).config.Users["alice"].Features; features != "ls,get" {
+		t.Errorf("Expected a new session to use the reloaded settings but features were %q", features)
+	}
+	if mounts := newSession.(*S3Driver).mounts; len(mounts) != 1 {
+		t.Errorf("Expected a new session to use the reloaded mounts but were %d", len(mounts))
+	}
+
+	for _, config := range []string{`{"users": {"alice": {"features": "fly"}}}`, `{"users":`} {
+		writeConfig(config)
+		if err := factory.Reload(credentials); err == nil {
+			t.Errorf("Expected the invalid configuration %s to be rejected", config)
+		}
+	}
+	writeConfig(`{}`)
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalid, err := AuthenticatorFromString("carol:" + hash + ":groups=unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := factory.Reload(invalid); err == nil {
+		t.Errorf("Expected credentials with unknown groups to be rejected")
+	}
+	if ok, err := auth.CheckPasswd("bob", "secret"); !ok {
+		t.Errorf("Expected the settings to be kept after invalid reloads: %v", err)
+	}
+	if features := factory.settings.get().config.Users["alice"].Features; features != "ls,get" {
+		t.Errorf("Expected the configuration to be kept after invalid reloads but features were %q", features)
+	}
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	pathpkg "path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// storageClasses are the storage classes accepted by upload rules.
+var storageClasses = []string{
+	s3.StorageClassStandard,
+	s3.StorageClassReducedRedundancy,
+	s3.StorageClassStandardIa,
+	s3.StorageClassOnezoneIa,
+	s3.StorageClassIntelligentTiering,
+	s3.StorageClassGlacier,
+	"GLACIER_IR",
+	"DEEP_ARCHIVE",
+}
+
+// cannedACLs are the canned ACLs accepted by upload rules.
+var cannedACLs = []string{
+	s3.ObjectCannedACLPrivate,
+	s3.ObjectCannedACLPublicRead,
+	s3.ObjectCannedACLPublicReadWrite,
+	s3.ObjectCannedACLAuthenticatedRead,
+	s3.ObjectCannedACLAwsExecRead,
+	s3.ObjectCannedACLBucketOwnerRead,
+	s3.ObjectCannedACLBucketOwnerFullControl,
+}
+
+// sniffLen is the number of bytes inspected to detect the content type of an upload.
+const sniffLen = 512
+
+// UploadRule sets the attributes of uploaded objects which satisfy all of its conditions.
+// Rules are applied in order, the attributes of a later rule take precedence over the ones of earlier rules.
+type UploadRule struct {
+	// Prefix matches keys starting with it
+	Prefix string `json:"prefix,omitempty"`
+	// Glob matches keys with a shell pattern, a pattern without a slash is matched against the file name
+	Glob string `json:"glob,omitempty"`
+	// User matches uploads of the FTP user
+	User string `json:"user,omitempty"`
+	// MinSize and MaxSize match the size of uploads in bytes, zero is no limit
+	MinSize int64 `json:"minSize,omitempty"`
+	MaxSize int64 `json:"maxSize,omitempty"`
+
+	StorageClass       string `json:"storageClass,omitempty"`
+	ACL                string `json:"acl,omitempty"`
+	ContentType        string `json:"contentType,omitempty"`
+	CacheControl       string `json:"cacheControl,omitempty"`
+	ContentDisposition string `json:"contentDisposition,omitempty"`
+}
+
+func (r UploadRule) validate() error {
+	if r.Glob != "" {
+		if _, err := pathpkg.Match(r.Glob, ""); err != nil {
+			return fmt.Errorf("malformed glob %q", r.Glob)
+		}
+	}
+	if r.MinSize < 0 || r.MaxSize < 0 || (r.MaxSize > 0 && r.MaxSize < r.MinSize) {
+		return fmt.Errorf("invalid size range %d-%d", r.MinSize, r.MaxSize)
+	}
+	if r.StorageClass != "" && !contains(storageClasses, r.StorageClass) {
+		return fmt.Errorf("unknown storage class %q, expected one of %s", r.StorageClass, strings.Join(storageClasses, ", "))
+	}
+	if r.ACL != "" && !contains(cannedACLs, r.ACL) {
+		return fmt.Errorf("unknown canned ACL %q, expected one of %s", r.ACL, strings.Join(cannedACLs, ", "))
+	}
+	return nil
+}
+
+// matches returns true if the upload of the object with key `key` by `user` satisfies all conditions of the rule.
+// Rules with a size condition never match if the size is unknown (negative).
+func (r UploadRule) matches(key, user string, size int64) bool {
+	if !strings.HasPrefix(key, strings.TrimPrefix(r.Prefix, "/")) {
+		return false
+	}
+	if r.Glob != "" {
+		glob, name := strings.TrimPrefix(r.Glob, "/"), key
+		if !strings.Contains(glob, "/") {
+			name = pathpkg.Base(key)
+		}
+		if ok, _ := pathpkg.Match(glob, name); !ok {
+			return false
+		}
+	}
+	if r.User != "" && r.User != user {
+		return false
+	}
+	if r.MinSize > 0 || r.MaxSize > 0 {
+		if size < 0 || size < r.MinSize || (r.MaxSize > 0 && size > r.MaxSize) {
+			return false
+		}
+	}
+	return true
+}
+
+// apply sets the attributes of the rule on the upload `input`.
+func (r UploadRule) apply(input *s3manager.UploadInput) {
+	set := func(attribute **string, value string) {
+		if value != "" {
+			*attribute = aws.String(value)
+		}
+	}
+	set(&input.StorageClass, r.StorageClass)
+	set(&input.ACL, r.ACL)
+	set(&input.ContentType, r.ContentType)
+	set(&input.CacheControl, r.CacheControl)
+	set(&input.ContentDisposition, r.ContentDisposition)
+}
+
+// applyUploadRules sets the attributes of the upload `input` according to the upload rules
+// and the content type according to the file extension if no rule sets it.
+// The rules are matched against the key of the upload, the logged in user and `size`, which is negative if unknown.
+// They may be applied again once the size is known. Temporary objects are not subject to any rule.
+func (d *S3Driver) applyUploadRules(input *s3manager.UploadInput, size int64) {
+	key := aws.StringValue(input.Key)
+	if strings.HasPrefix(key, temporaryPrefix) {
+		return
+	}
+	if d.config != nil {
+		user := d.user()
+		for _, rule := range d.config.UploadRules {
+			if rule.matches(key, user, size) {
+				rule.apply(input)
+			}
+		}
+	}
+	if input.ContentType == nil {
+		if contentType := mime.TypeByExtension(pathpkg.Ext(key)); contentType != "" {
+			input.ContentType = aws.String(contentType)
+		}
+	}
+}
+
+// sniffContentType sets the content type of the upload `input` according to the first bytes of `data` if it is not set yet.
+// The returned reader must be read instead of `data`.
+func sniffContentType(input *s3manager.UploadInput, data io.Reader) io.Reader {
+	if input.ContentType != nil {
+		return data
+	}
+	reader := bufio.NewReaderSize(data, sniffLen)
+	// errors are returned by subsequent reads
+	head, _ := reader.Peek(sniffLen)
+	input.ContentType = aws.String(http.DetectContentType(head))
+	return reader
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestUploadRuleMatches(t *testing.T) {
+	for _, testData := range []struct {
+		rule     UploadRule
+		key      string
+		user     string
+		size     int64
+		expected bool
+	}{
+		{UploadRule{}, "any/thing.txt", "", -1, true},
+		{UploadRule{Prefix: "logs/"}, "logs/app.log", "", -1, true},
+		{UploadRule{Prefix: "/logs/"}, "logs/app.log", "", -1, true},
+		{UploadRule{Prefix: "logs/"}, "data/logs/app.log", "", -1, false},
+		{UploadRule{Glob: "*.csv"}, "reports/2019/sales.csv", "", -1, true},
+		{UploadRule{Glob: "*.csv"}, "reports/sales.csv.gz", "", -1, false},
+		{UploadRule{Glob: "reports/*/*.csv"}, "reports/2019/sales.csv", "", -1, true},
+		{UploadRule{Glob: "reports/*.csv"}, "reports/2019/sales.csv", "", -1, false},
+		{UploadRule{User: "alice"}, "file.txt", "alice", -1, true},
+		{UploadRule{User: "alice"}, "file.txt", "bob", -1, false},
+		{UploadRule{MinSize: 100}, "file.txt", "", 100, true},
+		{UploadRule{MinSize: 100}, "file.txt", "", 99, false},
+		{UploadRule{MinSize: 100}, "file.txt", "", -1, false},
+		{UploadRule{MaxSize: 100}, "file.txt", "", 100, true},
+		{UploadRule{MaxSize: 100}, "file.txt", "", 101, false},
+		{UploadRule{Prefix: "logs/", Glob: "*.log", User: "alice", MinSize: 1}, "logs/app.log", "alice", 1, true},
+		{UploadRule{Prefix: "logs/", Glob: "*.log", User: "alice", MinSize: 1}, "logs/app.txt", "alice", 1, false},
+	} {
+		if actual := testData.rule.matches(testData.key, testData.user, testData.size); actual != testData.expected {
+			t.Errorf("%+v: expected match of %q by %q with size %d to be %v", testData.rule, testData.key, testData.user, testData.size, testData.expected)
+		}
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	for _, testData := range []struct {
+		config string
+		valid  bool
+	}{
+		{`{}`, true},
+		{`{"uploadRules": [{"glob": "*.csv", "contentType": "text/csv", "cacheControl": "no-cache"}]}`, true},
+		{`{"uploadRules": [{"prefix": "archive/", "minSize": 1024, "storageClass": "GLACIER_IR", "acl": "bucket-owner-full-control"}]}`, true},
+		{`{"uploadRules": [{"glob": "[*.csv"}]}`, false},
+		{`{"uploadRules": [{"storageClass": "COLD"}]}`, false},
+		{`{"uploadRules": [{"acl": "everyone"}]}`, false},
+		{`{"uploadRules": [{"minSize": 10, "maxSize": 5}]}`, false},
+		{`{"uploadRules": {}}`, false},
+		{`{"keyTemplate": "incoming/{user}/{basename}-{unixtime}{ext}", "objectTags": {"uploader": "{user}"}}`, true},
+		{`{"keyTemplate": "{nope}"}`, false},
+		{`{"users": {"alice": {"groups": ["partners"], "features": "ls,get"}}, "groups": {"partners": {"features": "ls,put", "noOverwrite": true}}}`, true},
+		{`{"users": {"alice": {"groups": ["partners"]}}}`, false},
+		{`{"users": {"alice": {"features": "ls,fly"}}}`, false},
+		{`{"users": {"alice": {"password": "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"}}}`, true},
+		{`{"users": {"alice": {"password": "secret"}}}`, false},
+		{`{"users": {"alice": {"password": "$6$rounds=many$salt$hash"}}}`, false},
+		{`{"groups": {"partners": {"features": "ls,fly"}}}`, false},
+		{`{"mounts": [{"path": "/archive", "bucket": "s3://archive/ftp/", "region": "eu-west-1"}, {"path": "/in", "bucket": "https://landing.s3.example.com/{user}/"}]}`, true},
+		{`{"mounts": [{"path": "/archive", "bucket": "s3://archive"}, {"path": "/archive", "bucket": "s3://landing"}]}`, false},
+		{`{"mounts": [{"path": "/", "bucket": "s3://archive"}]}`, false},
+		{`{"mounts": [{"path": "archive", "bucket": "s3://archive"}]}`, false},
+		{`{"mounts": [{"path": "/archive/", "bucket": "s3://archive"}]}`, false},
+		{`{"mounts": [{"path": "/archive", "bucket": "archive"}]}`, false},
+		{`{"mounts": [{"path": "/archive", "bucket": "s3://archive/../x"}]}`, false},
+		{`{"mounts": [{"path": "/archive", "bucket": "s3://archive", "credentials": "secret"}]}`, false},
+	} {
+		_, err := ParseConfig([]byte(testData.config))
+		if testData.valid && err != nil {
+			t.Errorf("%s: %s", testData.config, err)
+		} else if !testData.valid && err == nil {
+			t.Errorf("%s: expected an error", testData.config)
+		}
+	}
+}
+
+func TestUploadRules(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	defer func(partSize int64) {
+		uploadPartSize = partSize
+	}(uploadPartSize)
+	uploadPartSize = 8
+
+	config := &Config{UploadRules: []UploadRule{
+		{Glob: "*.csv", ContentType: "text/csv", CacheControl: "no-cache"},
+		{Prefix: "archive/", MinSize: 10, StorageClass: "GLACIER_IR"},
+		{Prefix: "public/", ACL: "public-read", ContentDisposition: "attachment"},
+		{Prefix: "public/", Glob: "*.csv", CacheControl: "max-age=60"},
+	}}
+	png := "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"
+
+	bucketName := "test-bucket"
+	for _, mode := range []string{"plain", "resumable", "guarded", "conditional"} {
+		for _, testData := range []struct {
+			key      string
+			data     string
+			expected objectHeaders
+		}{
+			{"data.csv", "a,b", objectHeaders{contentType: "text/csv", cacheControl: "no-cache"}},
+			{"archive/big", "more than one part", objectHeaders{contentType: "text/plain; charset=utf-8", storageClass: "GLACIER_IR"}},
+			{"archive/small", "tiny", objectHeaders{contentType: "text/plain; charset=utf-8"}},
+			{"archive/image", png, objectHeaders{contentType: "image/png", storageClass: "GLACIER_IR"}},
+			{"archive/image.png", png, objectHeaders{contentType: mime.TypeByExtension(".png"), storageClass: "GLACIER_IR"}},
+			{"public/index.html", "<html></html>", objectHeaders{contentType: mime.TypeByExtension(".html"), acl: "public-read", contentDisposition: "attachment"}},
+			{"public/data.csv", "a,b", objectHeaders{contentType: "text/csv", cacheControl: "max-age=60", acl: "public-read", contentDisposition: "attachment"}},
+		} {
+			description := fmt.Sprintf("%s: %s", mode, testData.key)
+			bucket := newBucketMock(bucketName)
+			d := S3Driver{
+				featureFlags: featurePut,
+				config:       config,
+				s3:           &s3Mock{bucket: bucket},
+				uploader:     &s3UploaderMock{bucket: bucket},
+				metrics:      metricsSenderMock{},
+				bucketName:   bucketName,
+				bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+			}
+			switch mode {
+			case "resumable":
+				d.pendingUploads = newPendingUploads()
+			case "guarded":
+				d.noOverwrite = true
+			case "conditional":
+				d.noOverwrite = true
+				d.conditionalWrites = true
+			}
+
+			if _, err := d.PutFile(testData.key, strings.NewReader(testData.data), false); err != nil {
+				t.Errorf("%s: %s", description, err)
+				continue
+			}
+			object, err := bucket.Get(testData.key)
+			if err != nil {
+				t.Errorf("%s: %s", description, err)
+				continue
+			}
+			if object.headers != testData.expected {
+				t.Errorf("%s: expected headers %+v but were %+v", description, testData.expected, object.headers)
+			}
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// maxCopyObjectSize is the size limit of objects which can be copied with a single CopyObject request.
+	// Larger objects are copied part by part.
+	maxCopyObjectSize int64 = 5 * 1024 * 1024 * 1024
+	// copyPartSize is the size of the parts of a multipart copy.
+	copyPartSize int64 = 512 * 1024 * 1024
+)
+
+// byteRange returns an HTTP byte range of `length` bytes starting at `offset`.
+func byteRange(offset, length int64) string {
+	return fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+}
+
+// copySource returns the URL encoded copy source of the object with key `key`.
+func (d *S3Driver) copySource(key string) string {
+	u := url.URL{Path: d.bucketName + "/" + key}
+	return u.EscapedPath()
+}
+
+// copyObject copies the object with key `srcKey` and size `size` to `dstKey` on the server side.
+// The copy keeps the metadata and headers of the source object unless `attributes` is given,
+// in which case they are replaced by the ones of `attributes`.
+// The copy is encrypted like any object written by the driver, not like its source.
+// The request options `options` apply to the requests which create the copy, see writeOptions.
+func (d *S3Driver) copyObject(srcKey, dstKey string, size int64, attributes *s3manager.UploadInput, options ...request.Option) error {
+	if size <= maxCopyObjectSize {
+		input := &s3.CopyObjectInput{
+			ServerSideEncryption: d.sse.serverSide(),
+			SSEKMSKeyId:          d.sse.kmsKey(),
+			SSECustomerAlgorithm: d.sse.customerAlgorithm(),
+			SSECustomerKey:       d.sse.customerKeyValue(),
+		}
+		if attributes != nil {
+			input = copyObjectInput(attributes)
+		}
+		input.Bucket = aws.String(d.bucketName)
+		input.Key = aws.String(dstKey)
+		input.CopySource = aws.String(d.copySource(srcKey))
+		input.CopySourceSSECustomerAlgorithm = d.sse.customerAlgorithm()
+		input.CopySourceSSECustomerKey = d.sse.customerKeyValue()
+		_, err := d.s3.CopyObjectWithContext(aws.BackgroundContext(), input, options...)
+		if isPreconditionFailed(err) {
+			return overwriteForbidden(d.fqdn(dstKey))
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Failed to copy %q to %q", d.fqdn(srcKey), d.fqdn(dstKey))
+		}
+		return nil
+	}
+	return d.multipartCopyObject(srcKey, dstKey, size, attributes, options...)
+}
+
+// copyObjectInput returns a copy request which replaces metadata and headers by the ones of the upload `input`.
+func copyObjectInput(input *s3manager.UploadInput) *s3.CopyObjectInput {
+	return &s3.CopyObjectInput{
+		MetadataDirective:    aws.String(s3.MetadataDirectiveReplace),
+		Metadata:             input.Metadata,
+		ACL:                  input.ACL,
+		CacheControl:         input.CacheControl,
+		ContentDisposition:   input.ContentDisposition,
+		ContentEncoding:      input.ContentEncoding,
+		ContentLanguage:      input.ContentLanguage,
+		ContentType:          input.ContentType,
+		Expires:              input.Expires,
+		ServerSideEncryption: input.ServerSideEncryption,
+		SSEKMSKeyId:          input.SSEKMSKeyId,
+		SSECustomerAlgorithm: input.SSECustomerAlgorithm,
+		SSECustomerKey:       input.SSECustomerKey,
+		StorageClass:         input.StorageClass,
+		Tagging:              input.Tagging,
+		TaggingDirective:     taggingDirective(input.Tagging),
+	}
+}
+
+// taggingDirective replaces the tags of a copied object if `tagging` is set, otherwise the tags are copied.
+func taggingDirective(tagging *string) *string {
+	if tagging == nil {
+		return nil
+	}
+	return aws.String(s3.TaggingDirectiveReplace)
+}
+
+// createMultipartUploadInput returns the request to start a multipart upload with the metadata and headers of the upload `input`.
+func createMultipartUploadInput(input *s3manager.UploadInput) *s3.CreateMultipartUploadInput {
+	return &s3.CreateMultipartUploadInput{
+		Metadata:             input.Metadata,
+		ACL:                  input.ACL,
+		CacheControl:         input.CacheControl,
+		ContentDisposition:   input.ContentDisposition,
+		ContentEncoding:      input.ContentEncoding,
+		ContentLanguage:      input.ContentLanguage,
+		ContentType:          input.ContentType,
+		Expires:              input.Expires,
+		ServerSideEncryption: input.ServerSideEncryption,
+		SSEKMSKeyId:          input.SSEKMSKeyId,
+		SSECustomerAlgorithm: input.SSECustomerAlgorithm,
+		SSECustomerKey:       input.SSECustomerKey,
+		StorageClass:         input.StorageClass,
+		Tagging:              input.Tagging,
+	}
+}
+
+// multipartCopyObject copies the object with key `srcKey` and size `size` to `dstKey` with a multipart upload
+// whose parts are copied from ranges of the source object.
+// The multipart upload is aborted if any part could not be copied.
+func (d *S3Driver) multipartCopyObject(srcKey, dstKey string, size int64, attributes *s3manager.UploadInput, options ...request.Option) error {
+	input := &s3.CreateMultipartUploadInput{
+		ServerSideEncryption: d.sse.serverSide(),
+		SSEKMSKeyId:          d.sse.kmsKey(),
+		SSECustomerAlgorithm: d.sse.customerAlgorithm(),
+		SSECustomerKey:       d.sse.customerKeyValue(),
+	}
+	if attributes != nil {
+		input = createMultipartUploadInput(attributes)
+	} else {
+		// unlike CopyObject, a multipart upload does not inherit the metadata of the source object
+		head, err := d.s3.HeadObject(&s3.HeadObjectInput{
+			Bucket:               aws.String(d.bucketName),
+			Key:                  aws.String(srcKey),
+			SSECustomerAlgorithm: d.sse.customerAlgorithm(),
+			SSECustomerKey:       d.sse.customerKeyValue(),
+		})
+		if err != nil {
+			return errors.Wrapf(err, "Failed to get metadata of %q", d.fqdn(srcKey))
+		}
+		input.Metadata = head.Metadata
+		input.CacheControl = head.CacheControl
+		input.ContentDisposition = head.ContentDisposition
+		input.ContentEncoding = head.ContentEncoding
+		input.ContentLanguage = head.ContentLanguage
+		input.ContentType = head.ContentType
+		input.StorageClass = head.StorageClass
+	}
+	input.Bucket = aws.String(d.bucketName)
+	input.Key = aws.String(dstKey)
+	upload, err := d.s3.CreateMultipartUpload(input)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to start multipart copy of %q", d.fqdn(srcKey))
+	}
+
+	parts := []*s3.CompletedPart{}
+	for offset, partNumber := int64(0), int64(1); offset < size; offset, partNumber = offset+copyPartSize, partNumber+1 {
+		length := copyPartSize
+		if offset+length > size {
+			length = size - offset
+		}
+		resp, err := d.s3.UploadPartCopy(&s3.UploadPartCopyInput{
+			Bucket:          aws.String(d.bucketName),
+			Key:             aws.String(dstKey),
+			CopySource:      aws.String(d.copySource(srcKey)),
+			CopySourceRange: aws.String(byteRange(offset, length)),
+			PartNumber:      aws.Int64(partNumber),
+			UploadId:        upload.UploadId,
+			// the source object and the parts are encrypted with the same key
+			CopySourceSSECustomerAlgorithm: d.sse.customerAlgorithm(),
+			CopySourceSSECustomerKey:       d.sse.customerKeyValue(),
+			SSECustomerAlgorithm:           d.sse.customerAlgorithm(),
+			SSECustomerKey:                 d.sse.customerKeyValue(),
+		})
+		if err != nil {
+			d.abortMultipartUpload(dstKey, aws.StringValue(upload.UploadId))
+			return errors.Wrapf(err, "Failed to copy part %d of %q", partNumber, d.fqdn(srcKey))
+		}
+		parts = append(parts, &s3.CompletedPart{
+			ETag:       resp.CopyPartResult.ETag,
+			PartNumber: aws.Int64(partNumber),
+		})
+	}
+
+	_, err = d.s3.CompleteMultipartUploadWithContext(aws.BackgroundContext(), &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(d.bucketName),
+		Key:             aws.String(dstKey),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	}, options...)
+	if err != nil {
+		d.abortMultipartUpload(dstKey, aws.StringValue(upload.UploadId))
+		if isPreconditionFailed(err) {
+			return overwriteForbidden(d.fqdn(dstKey))
+		}
+		return errors.Wrapf(err, "Failed to complete multipart copy of %q", d.fqdn(srcKey))
+	}
+	return nil
+}
+
+// abortMultipartUpload aborts the multipart upload with id `uploadID` and logs failures.
+func (d *S3Driver) abortMultipartUpload(key, uploadID string) {
+	_, err := d.s3.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(d.bucketName),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"key": d.fqdn(key), "upload": uploadID, "error": err}).Errorf("Failed to abort multipart upload of %q", d.fqdn(key))
+	}
+}
+
+// moveObject copies the object with key `srcKey` to `dstKey` and deletes the source afterwards.
+// The copy keeps the metadata and headers of the source object unless `attributes` is given, see copyObject.
+func (d *S3Driver) moveObject(srcKey, dstKey string, size int64, attributes *s3manager.UploadInput, options ...request.Option) error {
+	if err := d.copyObject(srcKey, dstKey, size, attributes, options...); err != nil {
+		return err
+	}
+	_, err := d.s3.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(d.bucketName),
+		Key:    aws.String(srcKey),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Copied %q to %q but failed to delete the source", d.fqdn(srcKey), d.fqdn(dstKey))
+	}
+	return nil
+}
+
+// movePrefix moves all objects located under `srcPrefix` to `dstPrefix`.
+// Objects which can not be moved are skipped, the returned error lists all of them.
+// The request options `options` apply to the copies, see copyObject.
+func (d *S3Driver) movePrefix(srcPrefix, dstPrefix string, options ...request.Option) error {
+	moved, failed := 0, []string{}
+	err := d.walkPrefix(srcPrefix, "", func(page *s3.ListObjectsV2Output) error {
+		for _, object := range page.Contents {
+			srcKey := aws.StringValue(object.Key)
+			dstKey := dstPrefix + strings.TrimPrefix(srcKey, srcPrefix)
+			if err := d.moveObject(srcKey, dstKey, aws.Int64Value(object.Size), nil, options...); err != nil {
+				logrus.WithFields(logrus.Fields{"key": d.fqdn(srcKey), "error": err}).Errorf("Failed to move %q", d.fqdn(srcKey))
+				failed = append(failed, srcKey)
+				continue
+			}
+			moved++
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to list %q after moving %d objects", d.fqdn(srcPrefix), moved)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("moved %d objects but failed to move %d: %s", moved, len(failed), strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -1,18 +1,20 @@
 package server
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/url"
-	"path/filepath"
+	pathpkg "path"
 	"reflect"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
 	ftp "github.com/goftp/server"
 	"github.com/pkg/errors"
@@ -24,17 +26,55 @@ func notEnabled(op string) error {
 }
 
 // S3Driver is a filesystem FTP driver.
+// A driver is created per FTP connection and holds the state of its session, e.g. the current working directory.
 // Implements https://godoc.org/github.com/goftp/server#Driver
 type S3Driver struct {
-	featureFlags int
-	noOverwrite  bool
-	s3           s3iface.S3API
-	uploader     s3manageriface.UploaderAPI
-	metrics      MetricsSender
-	hostname     string
-	bucketName   string
-	bucketURL    *url.URL
-	cwd          string
+	// featureFlags and noOverwrite apply to users without own settings, see features and preventOverwrite
+	featureFlags       int
+	noOverwrite        bool
+	conditionalWrites  bool
+	recursiveRemoveDir bool
+	softDelete         bool
+	pendingUploads     *pendingUploads
+	reservations       *keyReservations
+	sse                *serverSideEncryption
+	encryption         *envelopeEncryption
+	config             *Config
+	s3                 s3iface.S3API
+	uploader           s3manageriface.UploaderAPI
+	metrics            MetricsSender
+	hostname           string
+	bucketName         string
+	bucketURL          *url.URL
+	// mounts are the buckets served at directories of the FTP namespace besides the default bucket, see enterMount
+	mounts []*mount
+	// identities holds the identities of the users at login, see takeIdentity
+	identities *identities
+	// identityUser is the user whose identity has been added to config
+	identityUser string
+	// mount is the mount the driver is switched to while serving an operation, nil for the default bucket
+	mount     *mount
+	conn      *ftp.Conn
+	sessionID string
+	clientIP  string
+	// group is reported as group of all files and directories
+	group string
+	// showUploader lists the uploading FTP user as owner of objects, which requires a HEAD request per object
+	showUploader bool
+	// upload is the upload which is currently received
+	upload uploadProvenance
+	// uploadedNames maps the FTP paths of files uploaded by the session onto their keys if these differ
+	uploadedNames map[string]string
+	cwd           string
+	hashAlgo      string
+	// homeTemplate is the default home directory of users, see home
+	homeTemplate string
+	// announcedSize is the size of the next upload announced by `ALLO`, zero if unknown
+	announcedSize int64
+	// restOffset is the offset given by `REST` at which the next `STOR` resumes the file, nil without `REST`
+	restOffset *int64
+	// staleAppend is set if a resuming `STOR` was rejected, for which goftp still passes append mode to the next `STOR`
+	staleAppend bool
 }
 
 func intoAwsError(err error) awserr.Error {
@@ -45,8 +85,19 @@ func logAwsError(err awserr.Error) {
 	logrus.Errorf("AWS Error: Code=%q Message=%q", err.Code(), err.Message())
 }
 
+// isNotFound returns true if `err` was caused by a missing object.
+func isNotFound(err error) bool {
+	if err, ok := errors.Cause(err).(awserr.Error); ok {
+		switch err.Code() {
+		case "NotFound", "NoSuchKey":
+			return true
+		}
+	}
+	return false
+}
+
 // bucketCheck checks if the bucket is accessible
-func (d S3Driver) bucketCheck() error {
+func (d *S3Driver) bucketCheck() error {
 	_, err := d.s3.HeadBucket(&s3.HeadBucketInput{
 		Bucket: aws.String(d.bucketName),
 	})
@@ -59,124 +110,336 @@ func (d S3Driver) bucketCheck() error {
 	return nil
 }
 
-// Init initializes the FTP connection.
-func (d S3Driver) Init(conn *ftp.Conn) {
-	conn.Serve()
+// Init binds the driver to its FTP connection.
+// The connection is served by the FTP server after the driver was initialized.
+func (d *S3Driver) Init(conn *ftp.Conn) {
+	d.conn = conn
+	d.cwd = "/"
 }
 
-// Stat returns information about the object with key `key`.
-func (d S3Driver) Stat(key string) (ftp.FileInfo, error) {
+// Stat returns information about the object or directory located at `path`.
+// An object is reported as file, a prefix which contains at least one object (or a directory marker) as directory.
+// An error is returned if neither exists or if the access rules allow no operation on `path`.
+func (d *S3Driver) Stat(path string) (ftp.FileInfo, error) {
+	defer d.enterMount(path)()
+	if !d.accessible(path) {
+		return S3ObjectInfo{}, fmt.Errorf("%q: access denied", d.resolvePath(path))
+	}
 	if err := d.bucketCheck(); err != nil {
 		return S3ObjectInfo{}, errors.Wrapf(err, "Bucket check failed")
 	}
 
+	key := d.objectKey(path)
+	// files and directories are named like the requested path, which may differ from the key, e.g. for uploads with a key template
+	name := pathpkg.Base(d.resolvePath(path))
+	if d.isRoot(path) {
+		// the root directory is not an object
+		return S3ObjectInfo{
+			name:     name,
+			isPrefix: true,
+			group:    d.group,
+			modTime:  time.Now(),
+		}, nil
+	}
+
 	fqdn := d.fqdn(key)
 	resp, err := d.s3.HeadObject(&s3.HeadObjectInput{
-		Bucket: aws.String(d.bucketName),
-		Key:    aws.String(key),
+		Bucket:               aws.String(d.bucketName),
+		Key:                  aws.String(key),
+		SSECustomerAlgorithm: d.sse.customerAlgorithm(),
+		SSECustomerKey:       d.sse.customerKeyValue(),
 	})
-	if err != nil {
-		err := intoAwsError(err)
-		if err.Code() == "NotFound" {
-			// If a client calls `ls` for a prefix (path) then `stat` is called for this prefix which will fail
-			// in cases where the prefix is not an object key.
-			// Returning an error would cause `ls` to fail, thus an ObjectInfo is returned which simulates a `stat` on a directory.
-			return S3ObjectInfo{
-				name:     key,
-				isPrefix: true,
-				size:     0,
-				modTime:  time.Now(),
-			}, nil
-		}
-		logrus.WithFields(logrus.Fields{"time": time.Now(), "object": fqdn}).Errorf("Stat for %q failed.\nCode: %s", fqdn, err.Code())
+	if err == nil {
+		logrus.WithFields(logrus.Fields{"time": time.Now(), "key": fqdn, "action": "STAT"}).Infof("File information for %q", fqdn)
+		return S3ObjectInfo{
+			name:    name,
+			size:    d.encryption.plaintextSize(aws.Int64Value(resp.ContentLength), resp.Metadata),
+			owner:   uploader(resp.Metadata),
+			group:   d.group,
+			modTime: aws.TimeValue(resp.LastModified),
+		}, nil
+	}
+	if !isNotFound(err) {
+		logrus.WithFields(logrus.Fields{"time": time.Now(), "object": fqdn, "error": err}).Errorf("Stat for %q failed.", fqdn)
 		return S3ObjectInfo{}, err
 	}
 
-	size := int64(0)
-	if resp.ContentLength != nil {
-		size = *resp.ContentLength
+	if size, ok := d.pendingUploads.size(d.bucketName, key, d.user()); ok {
+		// an interrupted upload is reported as file, so that the client can resume it
+		return S3ObjectInfo{
+			name:    name,
+			size:    size,
+			owner:   d.user(),
+			group:   d.group,
+			modTime: time.Now(),
+		}, nil
 	}
-	modTime := time.Now()
-	if resp.LastModified != nil {
-		modTime = *resp.LastModified
+
+	info, exists, err := d.statPrefix(key + "/")
+	info.name = name
+	info.group = d.group
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"time": time.Now(), "object": fqdn, "error": err}).Errorf("Stat for %q failed.", fqdn)
+		return S3ObjectInfo{}, err
 	}
+	if !exists && len(d.mountPoints(d.resolvePath(path))) > 0 {
+		// a directory which contains mount points exists even if there is no object in it
+		return S3ObjectInfo{name: name, isPrefix: true, group: d.group, modTime: time.Now()}, nil
+	}
+	if !exists {
+		return S3ObjectInfo{}, fmt.Errorf("%q: no such file or directory", d.resolvePath(path))
+	}
+	logrus.WithFields(logrus.Fields{"time": time.Now(), "key": fqdn, "action": "STAT"}).Infof("Directory information for %q", fqdn)
+	return info, nil
+}
 
-	logrus.WithFields(logrus.Fields{"time": time.Now(), "key": fqdn, "action": "STAT"}).Infof("File information for %q", fqdn)
-	return S3ObjectInfo{
-		name:     key,
+// statPrefix returns information about the directory represented by `prefix` and whether it exists.
+// The modification time of a directory is the one of its marker or, if there is none, the one of its newest direct child.
+func (d *S3Driver) statPrefix(prefix string) (S3ObjectInfo, bool, error) {
+	info := S3ObjectInfo{
+		name:     pathpkg.Base(prefix),
 		isPrefix: true,
-		size:     size,
-		modTime:  modTime,
-	}, nil
+	}
+	probe, err := d.s3.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket:  aws.String(d.bucketName),
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int64(1),
+	})
+	if err != nil {
+		return info, false, err
+	}
+	if len(probe.Contents) == 0 {
+		return info, false, nil
+	}
+	if marker := probe.Contents[0]; aws.StringValue(marker.Key) == prefix {
+		info.modTime = aws.TimeValue(marker.LastModified)
+		return info, true, nil
+	}
+
+	children, err := d.s3.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket:    aws.String(d.bucketName),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	})
+	if err != nil {
+		return info, true, err
+	}
+	for _, object := range children.Contents {
+		if modTime := aws.TimeValue(object.LastModified); modTime.After(info.modTime) {
+			info.modTime = modTime
+		}
+	}
+	if info.modTime.IsZero() {
+		// there are only subdirectories
+		info.modTime = time.Now()
+	}
+	return info, true, nil
 }
 
-// ChangeDir will always return an error because there is no such operation for a cloud object storage.
+// ChangeDir changes the session's current working directory.
 //
-// To allow uploading into "subdirectories" of a bucket a path change is simulated by keeping track of `CD` calls.
-// In FTP only a single directory level will be changed at a time, i.e. `CD /foo/bar` will result in two calls, `CD /foo` and `CD /foo/bar`.
-// There is no server side logic to be implement because relative paths are handled by the client, at least is how lftp and Filezilla operated.
-func (d S3Driver) ChangeDir(path string) error {
-	d.cwd = path
+// There is no such operation for a cloud object storage, thus a path change is simulated by keeping track of `CD` calls.
+// Relative paths of subsequent operations are resolved against the current working directory.
+func (d *S3Driver) ChangeDir(path string) error {
+	defer d.enterMount(path)()
+	if d.features()&featureChangeDir == 0 {
+		return notEnabled("CD")
+	}
+	if err := d.checkAccess(featureChangeDir, path); err != nil {
+		return err
+	}
+
+	d.cwd = d.resolvePath(path)
 	logrus.Debugf("Changed into path: %q", d.cwd)
 	return nil
 }
 
-// ListDir call the callback function with object metadata for each object located under prefix `key`.
-func (d S3Driver) ListDir(key string, cb func(ftp.FileInfo) error) error {
-	if d.featureFlags&featureList == 0 {
+// ListDir call the callback function with object metadata for each object located under `path`.
+// Objects are listed with `/` as delimiter, i.e. common prefixes are reported as directories.
+// Files which the session uploaded to the directory under keys determined by the key template are listed by their names.
+func (d *S3Driver) ListDir(path string, cb func(ftp.FileInfo) error) error {
+	defer d.enterMount(path)()
+	if d.features()&featureList == 0 {
 		return notEnabled("LS")
 	}
+	if err := d.checkAccess(featureList, path); err != nil {
+		return err
+	}
 
 	if err := d.bucketCheck(); err != nil {
 		return errors.Wrapf(err, "Bucket check failed")
 	}
 
-	// TODO: Prefix and delimiter
-	resp, err := d.s3.ListObjects(&s3.ListObjectsInput{
-		Bucket: aws.String(d.bucketName),
+	prefix := d.dirPrefix(path)
+	listed := map[string]bool{}
+	err := d.walkPrefix(prefix, "/", func(page *s3.ListObjectsV2Output) error {
+		for _, commonPrefix := range page.CommonPrefixes {
+			if aws.StringValue(commonPrefix.Prefix) == temporaryPrefix || aws.StringValue(commonPrefix.Prefix) == trashPrefix {
+				// objects which are not yet copied to their destination and deleted objects
+				continue
+			}
+			name := strings.TrimSuffix(strings.TrimPrefix(aws.StringValue(commonPrefix.Prefix), prefix), "/")
+			listed[name] = true
+			err := cb(S3ObjectInfo{
+				name:     name,
+				isPrefix: true,
+				group:    d.group,
+				modTime:  time.Now(),
+			})
+			if err != nil {
+				logrus.WithFields(logrus.Fields{"time": time.Now(), "error": err}).Errorf("Could not list %q", d.fqdn(aws.StringValue(commonPrefix.Prefix)))
+			}
+		}
+		for _, object := range page.Contents {
+			key := aws.StringValue(object.Key)
+			if key == prefix {
+				// the prefix itself is a directory marker and not part of its contents
+				continue
+			}
+			listed[strings.TrimPrefix(key, prefix)] = true
+			metadata := d.listedMetadata(key)
+			owner := ""
+			if d.showUploader {
+				owner = uploader(metadata)
+			}
+			if owner == "" && object.Owner != nil {
+				owner = aws.StringValue(object.Owner.DisplayName)
+			}
+			size := d.encryption.listedSize(aws.Int64Value(object.Size))
+			if metadata != nil {
+				size = d.encryption.plaintextSize(aws.Int64Value(object.Size), metadata)
+			}
+			err := cb(S3ObjectInfo{
+				name:    strings.TrimPrefix(key, prefix),
+				size:    size,
+				owner:   owner,
+				group:   d.group,
+				modTime: aws.TimeValue(object.LastModified),
+			})
+			if err != nil {
+				logrus.WithFields(logrus.Fields{"time": time.Now(), "error": err}).Errorf("Could not list %q", d.fqdn(key))
+			}
+		}
+		return nil
 	})
 	if err != nil {
-		err := intoAwsError(err)
-		fqdn := d.fqdn(key)
-		logAwsError(err)
+		fqdn := d.fqdn(prefix)
+		if awsErr, ok := err.(awserr.Error); ok {
+			logAwsError(awsErr)
+		}
 		logrus.Errorf("Could not list %q.", fqdn)
 		return err
 	}
+	d.listMountPoints(d.resolvePath(path), listed, cb)
+	return d.listUploadedNames(d.resolvePath(path), listed, cb)
+}
+
+// listedMetadata returns the metadata of the listed object with key `key` if the listing needs it, i.e. for the uploader
+// (see showUploader) or to tell encrypted objects apart (see plaintextSize), which requires a HEAD request per object.
+// It returns nil otherwise or if the request fails.
+func (d *S3Driver) listedMetadata(key string) map[string]*string {
+	if !d.showUploader && d.encryption == nil {
+		return nil
+	}
+	head, err := d.headObject(key)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"key": d.fqdn(key), "error": err}).Warnf("Failed to get metadata of %q", d.fqdn(key))
+		return nil
+	}
+	if head.Metadata == nil {
+		return map[string]*string{}
+	}
+	return head.Metadata
+}
+
+// DeleteDir deletes the directory located at `path`.
+// Directories which contain objects other than their directory marker are only deleted if recursive removal is enabled,
+// in which case all objects located under the directory's prefix are deleted, or moved to the trash if soft delete is enabled.
+func (d *S3Driver) DeleteDir(path string) error {
+	defer d.enterMount(path)()
+	if d.features()&featureRemoveDir == 0 {
+		logrus.Warn("RemoveDir (RMDIR) is not enabled.")
+		return notEnabled("RMDIR")
+	}
+	if err := d.checkAccess(featureRemoveDir, path); err != nil {
+		return err
+	}
+
+	prefix := d.dirPrefix(path)
+	if d.isRoot(path) {
+		// NOTE: Bucket removal will not be implemented
+		return fmt.Errorf("can not remove the root directory")
+	}
+	fqdn := d.fqdn(prefix)
+	timestamp := time.Now()
 
-	for _, object := range resp.Contents {
-		key := *object.Key
-		owner := ""
-		if object.Owner != nil {
-			owner = object.Owner.String()
+	resp, err := d.s3.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket:  aws.String(d.bucketName),
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int64(2),
+	})
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "error": err}).Errorf("Could not list %q", fqdn)
+		return errors.Wrapf(err, "Failed to list %q", fqdn)
+	}
+	if len(resp.Contents) == 0 {
+		return fmt.Errorf("directory %q does not exist", fqdn)
+	}
+	empty := len(resp.Contents) == 1 && aws.StringValue(resp.Contents[0].Key) == prefix
+	if !empty && !d.recursiveRemoveDir {
+		err := fmt.Errorf("directory %q is not empty", fqdn)
+		logrus.WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "error": err}).Error(err)
+		return err
+	}
+	// access rules may deny removing files or directories below the directory
+	err = d.checkPrefixAccess(prefix, func(relative string, dir bool) error {
+		if dir {
+			return d.checkAccess(featureRemoveDir, pathpkg.Join(path, relative))
 		}
-		err = cb(S3ObjectInfo{
-			name:    key,
-			size:    *object.Size,
-			owner:   owner,
-			modTime: *object.LastModified,
-		})
-		if err != nil {
-			logrus.WithFields(logrus.Fields{"time": time.Now(), "error": err}).Errorf("Could not list %q", d.fqdn(key))
+		return d.checkAccess(featureRemove, pathpkg.Join(path, relative))
+	})
+	if err != nil {
+		return err
+	}
+
+	if d.softDelete {
+		if err := d.trashObjects(prefix); err != nil {
+			logrus.WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "action": "RMDIR", "error": err}).Errorf("Failed to move directory %q to the trash", fqdn)
+			return err
 		}
+		logrus.WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "action": "RMDIR"}).Infof("Moved directory %q to the trash", fqdn)
+		return nil
 	}
+	if err := d.deletePrefix(prefix); err != nil {
+		logrus.WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "action": "RMDIR", "error": err}).Errorf("Failed to delete directory %q", fqdn)
+		return err
+	}
+	logrus.WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "action": "RMDIR"}).Infof("Deleted directory %q", fqdn)
 	return nil
 }
 
-// DeleteDir will always return an error because there is no such operation for a cloud object storage.
-func (d S3Driver) DeleteDir(key string) error {
-	// NOTE: Bucket removal will not be implemented
-	logrus.Warn("RemoveDir (RMDIR) is not supported.")
-	return notEnabled("RMDIR")
-}
-
-// DeleteFile will delete the object with key `key`.
-func (d S3Driver) DeleteFile(key string) error {
-	if d.featureFlags&featureRemove == 0 {
+// DeleteFile will delete the object located at `path`.
+func (d *S3Driver) DeleteFile(path string) error {
+	defer d.enterMount(path)()
+	if d.features()&featureRemove == 0 {
 		logrus.Warn("Remove (RM) is not enabled.")
 		return notEnabled("RM")
 	}
+	if err := d.checkAccess(featureRemove, path); err != nil {
+		return err
+	}
 
+	key := d.objectKey(path)
 	fqdn := d.fqdn(key)
+	if d.softDelete {
+		if err := d.trashObject(key); err != nil {
+			logrus.WithFields(logrus.Fields{"time": time.Now(), "key": fqdn, "error": err}).Errorf("Failed to move %q to the trash.", fqdn)
+			return err
+		}
+		d.forgetUpload(path)
+		logrus.WithFields(logrus.Fields{"time": time.Now(), "key": fqdn, "action": "DELETE"}).Infof("Moved %q to the trash", fqdn)
+		return nil
+	}
 	_, err := d.s3.DeleteObject(&s3.DeleteObjectInput{
 		Bucket: aws.String(d.bucketName),
 		Key:    aws.String(key),
@@ -188,46 +451,227 @@ func (d S3Driver) DeleteFile(key string) error {
 		return err
 	}
 
+	d.forgetUpload(path)
 	logrus.WithFields(logrus.Fields{"time": time.Now(), "key": fqdn, "action": "DELETE"}).Infof("Deleted %q", fqdn)
 	return nil
 }
 
-// Rename will always return an error because there is no such operation for a cloud object storage.
-func (d S3Driver) Rename(oldKey string, newKey string) error {
-	// TODO: there is no direct method for s3, must be copied and removed
-	logrus.Warn("Rename (MV) is not supported.")
-	return notEnabled("MV")
+// Rename moves the object or directory located at `oldPath` to `newPath`.
+// There is no rename operation for a cloud object storage, thus objects are copied on the server side and deleted afterwards.
+// Renaming a directory moves all objects located under its prefix.
+func (d *S3Driver) Rename(oldPath string, newPath string) error {
+	if d.features()&featureMove == 0 {
+		logrus.Warn("Rename (MV) is not enabled.")
+		return notEnabled("MV")
+	}
+	if d.mountOf(d.resolvePath(oldPath)) != d.mountOf(d.resolvePath(newPath)) {
+		return fmt.Errorf("can not move %q to another mount", d.resolvePath(oldPath))
+	}
+	defer d.enterMount(oldPath)()
+	if err := d.checkAccess(featureMove, oldPath); err != nil {
+		return err
+	}
+	if err := d.checkAccess(featureMove, newPath); err != nil {
+		return err
+	}
+
+	srcKey, dstKey := d.objectKey(oldPath), d.objectKey(newPath)
+	if d.isRoot(oldPath) || d.isRoot(newPath) {
+		return fmt.Errorf("can not rename the root directory")
+	}
+	if srcKey == dstKey {
+		return nil
+	}
+	srcFqdn, dstFqdn := d.fqdn(srcKey), d.fqdn(dstKey)
+	timestamp := time.Now()
+
+	if d.preventOverwrite() {
+		if !d.reservations.reserve(dstKey) {
+			return fmt.Errorf("%q is being written by another session", dstFqdn)
+		}
+		defer d.reservations.release(dstKey)
+	}
+
+	size, err := d.objectSize(srcKey)
+	if err == nil {
+		if d.preventOverwrite() {
+			if err := d.checkNotExists(dstKey); err != nil {
+				logrus.WithFields(logrus.Fields{"time": timestamp, "key": dstFqdn, "error": err}).Error(err)
+				return err
+			}
+		}
+		if err := d.moveObject(srcKey, dstKey, size, nil, d.writeOptions()...); err != nil {
+			logrus.WithFields(logrus.Fields{"time": timestamp, "key": srcFqdn, "action": "MV", "error": err}).Errorf("Failed to move %q to %q", srcFqdn, dstFqdn)
+			return err
+		}
+		d.forgetUpload(oldPath)
+		d.forgetUpload(newPath)
+		logrus.WithFields(logrus.Fields{"time": timestamp, "key": srcFqdn, "action": "MV"}).Infof("Moved %q to %q", srcFqdn, dstFqdn)
+		return nil
+	}
+	if !isNotFound(err) {
+		return err
+	}
+
+	srcPrefix, dstPrefix := srcKey+"/", dstKey+"/"
+	if strings.HasPrefix(dstPrefix, srcPrefix) {
+		return fmt.Errorf("can not move %q into itself", srcFqdn)
+	}
+	exists, err := d.prefixExists(srcPrefix)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to check prefix %q", srcFqdn)
+	}
+	if !exists {
+		return fmt.Errorf("%q does not exist", srcFqdn)
+	}
+	// access rules may deny moving files or directories below the directory or to their new location
+	err = d.checkPrefixAccess(srcPrefix, func(relative string, dir bool) error {
+		if err := d.checkAccess(featureMove, pathpkg.Join(oldPath, relative)); err != nil {
+			return err
+		}
+		return d.checkAccess(featureMove, pathpkg.Join(newPath, relative))
+	})
+	if err != nil {
+		return err
+	}
+	if d.preventOverwrite() {
+		exists, err := d.prefixExists(dstPrefix)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to check prefix %q", dstFqdn)
+		}
+		if exists {
+			err := fmt.Errorf("%q already exists and overwriting is forbidden", dstFqdn)
+			logrus.WithFields(logrus.Fields{"time": timestamp, "key": dstFqdn, "error": err}).Error(err)
+			return err
+		}
+		if err := d.checkNotExists(dstKey); err != nil {
+			logrus.WithFields(logrus.Fields{"time": timestamp, "key": dstFqdn, "error": err}).Error(err)
+			return err
+		}
+	}
+	if err := d.movePrefix(srcPrefix, dstPrefix, d.writeOptions()...); err != nil {
+		logrus.WithFields(logrus.Fields{"time": timestamp, "key": srcFqdn, "action": "MV", "error": err}).Errorf("Failed to move %q to %q", srcFqdn, dstFqdn)
+		return err
+	}
+	logrus.WithFields(logrus.Fields{"time": timestamp, "key": srcFqdn, "action": "MV"}).Infof("Moved %q to %q", srcFqdn, dstFqdn)
+	return nil
 }
 
-// MakeDir will always return an error because there is no such operation for a cloud object storage.
-func (d S3Driver) MakeDir(key string) error {
-	// There is no s3 equivalent
-	logrus.Warn("MakeDir (MkDir) is not supported.")
-	return notEnabled("MKDIR")
+// MakeDir creates the directory located at `path`.
+// Directories are represented by an empty marker object whose key is the directory's prefix, e.g. `some/dir/`,
+// hence empty directories survive and show up in listings.
+func (d *S3Driver) MakeDir(path string) error {
+	defer d.enterMount(path)()
+	if d.features()&featureMakeDir == 0 {
+		logrus.Warn("MakeDir (MKDIR) is not enabled.")
+		return notEnabled("MKDIR")
+	}
+	if err := d.checkAccess(featureMakeDir, path); err != nil {
+		return err
+	}
+
+	key := d.objectKey(path)
+	if d.isRoot(path) {
+		return fmt.Errorf("the root directory already exists")
+	}
+	prefix := key + "/"
+	fqdn := d.fqdn(prefix)
+	timestamp := time.Now()
+
+	exists, err := d.prefixExists(prefix)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to check prefix %q", fqdn)
+	}
+	if exists {
+		return fmt.Errorf("directory %q already exists", fqdn)
+	}
+	exists, err = d.objectExists(key)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("object %q already exists", d.fqdn(key))
+	}
+
+	// the marker is encrypted like any other object, so that it can be copied when the directory is renamed
+	_, err = d.s3.PutObject(&s3.PutObjectInput{
+		Bucket:               aws.String(d.bucketName),
+		Key:                  aws.String(prefix),
+		Body:                 bytes.NewReader(nil),
+		ServerSideEncryption: d.sse.serverSide(),
+		SSEKMSKeyId:          d.sse.kmsKey(),
+		SSECustomerAlgorithm: d.sse.customerAlgorithm(),
+		SSECustomerKey:       d.sse.customerKeyValue(),
+	})
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "action": "MKDIR", "error": err}).Errorf("Failed to create directory %q", fqdn)
+		return errors.Wrapf(err, "Failed to create directory %q", fqdn)
+	}
+	logrus.WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "action": "MKDIR"}).Infof("Created directory %q", fqdn)
+	return nil
 }
 
-// GetFile returns the object with key `key`.
-func (d S3Driver) GetFile(key string, offset int64) (int64, io.ReadCloser, error) {
-	if d.featureFlags&featureGet == 0 {
+// GetFile returns the object located at `path` starting at byte `offset` and the number of bytes remaining.
+// A non-zero offset, e.g. from a `REST` command of a resumed download, is served with a ranged request.
+// Objects are decrypted if client-side encryption is enabled.
+func (d *S3Driver) GetFile(path string, offset int64) (int64, io.ReadCloser, error) {
+	defer d.enterMount(path)()
+	if d.features()&featureGet == 0 {
 		return -1, nil, notEnabled("GET")
 	}
+	if err := d.checkAccess(featureGet, path); err != nil {
+		return -1, nil, err
+	}
+	if offset < 0 {
+		return -1, nil, fmt.Errorf("invalid offset %d", offset)
+	}
 
+	key := d.objectKey(path)
 	fqdn := d.fqdn(key)
 	timestamp := time.Now()
-	resp, err := d.s3.GetObject(&s3.GetObjectInput{
-		Bucket: aws.String(d.bucketName),
-		Key:    aws.String(key),
-	})
+	if d.encryption != nil {
+		size, body, err := d.getDecrypted(key, offset)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"time": timestamp, "Object": fqdn, "offset": offset, "error": err}).Errorf("Failed to get object: %q", fqdn)
+			return 0, nil, err
+		}
+		logrus.WithFields(logrus.Fields{"time": timestamp, "operation": "GET", "object": fqdn, "offset": offset}).Infof("Serving decrypted object: %s", fqdn)
+
+		err = d.metrics.SendGet(size, timestamp)
+		if err != nil {
+			logrus.Errorf("Sending GET metrics failed: %s", err)
+		}
+		return size, body, nil
+	}
+	input := &s3.GetObjectInput{
+		Bucket:               aws.String(d.bucketName),
+		Key:                  aws.String(key),
+		SSECustomerAlgorithm: d.sse.customerAlgorithm(),
+		SSECustomerKey:       d.sse.customerKeyValue(),
+	}
+	if offset > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := d.s3.GetObject(input)
 	if err != nil {
 		err := intoAwsError(err)
+		if err.Code() == "InvalidRange" {
+			// the range is not satisfiable if the offset points to the end of the object, i.e. nothing remains to be sent
+			if size, sizeErr := d.objectSize(key); sizeErr == nil && size == offset {
+				logrus.WithFields(logrus.Fields{"time": timestamp, "operation": "GET", "object": fqdn, "offset": offset}).Infof("Nothing left to serve of object: %s", fqdn)
+				return 0, ioutil.NopCloser(bytes.NewReader(nil)), nil
+			}
+			logrus.WithFields(logrus.Fields{"time": timestamp, "Object": fqdn, "offset": offset}).Errorf("Offset %d is beyond the end of object %q", offset, fqdn)
+			return 0, nil, err
+		}
 		logAwsError(err)
-		if err.Code() == "NotFound" {
+		if isNotFound(err) {
 			logrus.WithFields(logrus.Fields{"time": timestamp, "Object": fqdn}).Errorf("Failed to get object: %q", fqdn)
 		}
 		return 0, nil, err
 	}
-	size := *resp.ContentLength
-	logrus.WithFields(logrus.Fields{"time": timestamp, "operation": "GET", "object": fqdn}).Infof("Serving object: %s", fqdn)
+	size := aws.Int64Value(resp.ContentLength)
+	logrus.WithFields(logrus.Fields{"time": timestamp, "operation": "GET", "object": fqdn, "offset": offset}).Infof("Serving object: %s", fqdn)
 
 	err = d.metrics.SendGet(size, timestamp)
 	if err != nil {
@@ -237,46 +681,83 @@ func (d S3Driver) GetFile(key string, offset int64) (int64, io.ReadCloser, error
 	return size, resp.Body, nil
 }
 
-// PutFile stores the object with key `key`.
-// The method returns an error with no-overwrite was set and the object already exists or appendMode was specified.
-func (d S3Driver) PutFile(key string, data io.Reader, appendMode bool) (int64, error) {
-	if d.featureFlags&featurePut == 0 {
+// PutFile stores the object located at `path` and returns its size.
+// In append mode, i.e. for `APPE` or `REST` followed by `STOR`, the data is appended to the existing object
+// (or to an interrupted upload of the same user) and the number of appended bytes is returned.
+// The offset given by `REST` must be the size of the existing data, see handleCommand.
+// The method returns an error if no-overwrite was set and the object already exists or can not be checked.
+// An interrupted transfer, i.e. one which fails or ends before the size announced by `ALLO` was received,
+// never results in an object: multipart uploads are aborted (or suspended if resumable uploads are enabled).
+func (d *S3Driver) PutFile(path string, data io.Reader, appendMode bool) (int64, error) {
+	defer d.enterMount(path)()
+	if d.features()&featurePut == 0 {
 		return -1, notEnabled("PUT")
 	}
+	if err := d.checkAccess(featurePut, path); err != nil {
+		return -1, err
+	}
 	if data == nil || reflect.ValueOf(data).IsNil() {
 		logrus.Warn("PutFile was called with a nil valued io.Reader")
 		return -1, fmt.Errorf("PUT with empty data")
 	}
 
-	fqdn := d.fqdn(key)
-	if appendMode {
-		err := fmt.Errorf("can not append to object %q because the backend does not support appending", fqdn)
-		logrus.Error(err)
+	timestamp := time.Now()
+	key, err := d.uploadKey(path, appendMode, timestamp)
+	if err != nil {
 		return -1, err
 	}
+	fqdn := d.fqdn(key)
+	d.upload = uploadProvenance{filename: d.resolvePath(path), start: timestamp}
+	defer func() {
+		d.upload = uploadProvenance{}
+	}()
+	if d.announcedSize > 0 {
+		data = &announcedReader{Reader: data, remaining: d.announcedSize}
+		d.announcedSize = 0
+	}
+	if d.preventOverwrite() {
+		if !d.reservations.reserve(key) {
+			err := fmt.Errorf("object %q is being written by another session", fqdn)
+			logrus.WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "error": err}).Error(err)
+			return -1, err
+		}
+		defer d.reservations.release(key)
+	}
+	restOffset, staleAppend := d.restOffset, d.staleAppend
+	d.restOffset, d.staleAppend = nil, false
+	if staleAppend || restOffset != nil && *restOffset == 0 {
+		// `REST 0` restarts the transfer from the beginning
+		appendMode = false
+	}
+	offset := int64(-1)
+	if appendMode && restOffset != nil {
+		offset = *restOffset
+	}
+	if appendMode && d.encryption != nil {
+		return -1, fmt.Errorf("appending to %q is not supported for encrypted objects", fqdn)
+	}
+	if appendMode {
+		size, err := d.appendObject(key, data, offset)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "action": "APPEND", "error": err}).Errorf("Failed to append to %q", fqdn)
+			return -1, err
+		}
+		d.rememberUpload(path, key)
+		logrus.WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "action": "APPEND"}).Infof("Appended %d bytes to %q", size, fqdn)
 
-	timestamp := time.Now()
-	if d.noOverwrite && d.objectExists(key) {
-		err := fmt.Errorf("object %q already exists and overwriting is forbidden", fqdn)
-		logrus.WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "error": err}).Error(err)
-		return -1, err
+		err = d.metrics.SendPut(size, timestamp)
+		if err != nil {
+			logrus.Errorf("Sending PUT metrics failed: %s", err)
+		}
+		return size, nil
 	}
 
-	_, err := d.uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(d.bucketName),
-		Key:    aws.String(key),
-		Body:   data,
-	})
+	size, err := d.putObject(key, data)
 	if err != nil {
-		err := fmt.Errorf("Failed to put object %q because reading from source failed", fqdn)
-		logrus.WithFields(logrus.Fields{"time": timestamp, "object": fqdn, "action": "PUT", "error": err}).Error(err)
+		logrus.WithFields(logrus.Fields{"time": timestamp, "object": fqdn, "action": "PUT", "error": err}).Errorf("Failed to put object %q", fqdn)
 		return -1, err
 	}
-	size, err := d.objectSize(key)
-	if err != nil {
-		logrus.WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "action": "PUT", "error": err}).Errorf("Could not determine size of %q", fqdn)
-		return size, err
-	}
+	d.rememberUpload(path, key)
 	logrus.WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "action": "PUT"}).Infof("Put %q", fqdn)
 
 	err = d.metrics.SendPut(size, timestamp)
@@ -288,36 +769,128 @@ func (d S3Driver) PutFile(key string, data io.Reader, appendMode bool) (int64, e
 }
 
 // fqdn returns the fully qualified name for a object with key `key`.
-func (d S3Driver) fqdn(key string) string {
-	u := d.bucketURL
-	u.Path = filepath.Join(d.cwd, key)
+func (d *S3Driver) fqdn(key string) string {
+	u := *d.bucketURL
+	u.Path = "/" + key
 	return u.String()
 }
 
+// walkPrefix calls `fn` for each page of objects (and common prefixes) located under `prefix`.
+// Pages are fetched until the listing is complete by following the continuation token.
+func (d *S3Driver) walkPrefix(prefix, delimiter string, fn func(*s3.ListObjectsV2Output) error) error {
+	input := &s3.ListObjectsV2Input{
+		Bucket:     aws.String(d.bucketName),
+		Prefix:     aws.String(prefix),
+		FetchOwner: aws.Bool(true),
+	}
+	if delimiter != "" {
+		input.Delimiter = aws.String(delimiter)
+	}
+	for {
+		page, err := d.s3.ListObjectsV2(input)
+		if err != nil {
+			return err
+		}
+		if err := fn(page); err != nil {
+			return err
+		}
+		if !aws.BoolValue(page.IsTruncated) || aws.StringValue(page.NextContinuationToken) == "" {
+			return nil
+		}
+		input.ContinuationToken = page.NextContinuationToken
+	}
+}
+
+// deleteBatchSize is the maximum number of objects which can be deleted with a single request.
+const deleteBatchSize = 1000
+
+// deletePrefix deletes all objects located under `prefix` in batches.
+func (d *S3Driver) deletePrefix(prefix string) error {
+	batch := []*s3.ObjectIdentifier{}
+	err := d.walkPrefix(prefix, "", func(page *s3.ListObjectsV2Output) error {
+		for _, object := range page.Contents {
+			batch = append(batch, &s3.ObjectIdentifier{Key: object.Key})
+			if len(batch) == deleteBatchSize {
+				if err := d.deleteObjects(batch); err != nil {
+					return err
+				}
+				batch = batch[:0]
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(batch) > 0 {
+		return d.deleteObjects(batch)
+	}
+	return nil
+}
+
+// deleteObjects deletes the given objects with a single request.
+func (d *S3Driver) deleteObjects(objects []*s3.ObjectIdentifier) error {
+	resp, err := d.s3.DeleteObjects(&s3.DeleteObjectsInput{
+		Bucket: aws.String(d.bucketName),
+		Delete: &s3.Delete{
+			Objects: objects,
+			Quiet:   aws.Bool(true),
+		},
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to delete %d objects", len(objects))
+	}
+	if len(resp.Errors) > 0 {
+		failed := []string{}
+		for _, e := range resp.Errors {
+			failed = append(failed, fmt.Sprintf("%s (%s)", aws.StringValue(e.Key), aws.StringValue(e.Code)))
+		}
+		return fmt.Errorf("failed to delete %d of %d objects: %s", len(failed), len(objects), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// prefixExists returns true if at least one object is located under `prefix`.
+func (d *S3Driver) prefixExists(prefix string) (bool, error) {
+	resp, err := d.s3.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket:  aws.String(d.bucketName),
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int64(1),
+	})
+	if err != nil {
+		return false, err
+	}
+	return len(resp.Contents) > 0 || len(resp.CommonPrefixes) > 0, nil
+}
+
 // objectExists returns true if the object exists.
-func (d S3Driver) objectExists(key string) bool {
+// An error is returned if that can not be determined, e.g. because the bucket is not accessible.
+func (d *S3Driver) objectExists(key string) (bool, error) {
 	logrus.Debugf("Trying to check if object %q exists.", d.fqdn(key))
 	_, err := d.s3.HeadObject(&s3.HeadObjectInput{
-		Bucket: aws.String(d.bucketName),
-		Key:    aws.String(key),
+		Bucket:               aws.String(d.bucketName),
+		Key:                  aws.String(key),
+		SSECustomerAlgorithm: d.sse.customerAlgorithm(),
+		SSECustomerKey:       d.sse.customerKeyValue(),
 	})
 	if err != nil {
-		err := intoAwsError(err)
-		if err.Code() == "NotFound" {
-			return false
+		if isNotFound(err) {
+			return false, nil
 		}
 		logrus.Debugf("Failed to check object %q", d.fqdn(key))
-		return false
+		return false, errors.Wrapf(err, "Failed to check object %q", d.fqdn(key))
 	}
-	return true
+	return true, nil
 }
 
 // objectSize returns the size of the object.
-func (d S3Driver) objectSize(key string) (int64, error) {
+func (d *S3Driver) objectSize(key string) (int64, error) {
 	logrus.Debugf("Trying to get size of object %q.", d.fqdn(key))
 	resp, err := d.s3.HeadObject(&s3.HeadObjectInput{
-		Bucket: aws.String(d.bucketName),
-		Key:    aws.String(key),
+		Bucket:               aws.String(d.bucketName),
+		Key:                  aws.String(key),
+		SSECustomerAlgorithm: d.sse.customerAlgorithm(),
+		SSECustomerKey:       d.sse.customerKeyValue(),
 	})
 	if err != nil {
 		logrus.Debugf("Failed to check size of object %q", d.fqdn(key))
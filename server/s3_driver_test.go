@@ -2,11 +2,16 @@ package server
 
 import (
 	"bytes"
+	"crypto/md5"
 	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"net/url"
+	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"testing"
@@ -14,6 +19,7 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
@@ -70,9 +76,12 @@ func (b *bucketMock) List() map[string]objectMock {
 	m := map[string]objectMock{}
 	for key, object := range b.objects {
 		m[key] = objectMock{
-			data:    object.data, // should be deep copied, but hey ...
-			lastMod: object.lastMod,
-			etag:    object.etag,
+			data:        object.data, // should be deep copied, but hey ...
+			lastMod:     object.lastMod,
+			etag:        object.etag,
+			metadata:    object.metadata,
+			encryption:  object.encryption,
+			customerKey: object.customerKey,
 		}
 	}
 	return m
@@ -99,16 +108,32 @@ func (s *s3UploaderMock) Upload(input *s3manager.UploadInput, options ...func(*s
 		return nil, fmt.Errorf("Wrong bucket, expected %q but was %q", bucketName, s.bucket.Name())
 	}
 	key := aws.StringValue(input.Key)
+	uploader := &s3manager.Uploader{}
+	for _, option := range options {
+		option(uploader)
+	}
 	data, err := ioutil.ReadAll(input.Body)
 	if err != nil {
-		return nil, awserr.New("FailedToReadBody", fmt.Sprintf("Could not read data for key: %s", key), nil)
+		return nil, awserr.New("FailedToReadBody", fmt.Sprintf("Could not read data for key: %s", key), err)
+	}
+	if err := checkPrecondition(s.bucket, "PutObject", key, uploader.RequestOptions); err != nil {
+		return nil, err
+	}
+	if input.ContentMD5 != nil {
+		sum := md5.Sum(data)
+		if base64.StdEncoding.EncodeToString(sum[:]) != aws.StringValue(input.ContentMD5) {
+			return nil, awserr.New("BadDigest", "The Content-MD5 you specified did not match what we received.", nil)
+		}
 	}
 	etag := fmt.Sprintf("%s", sha256.Sum256(append([]byte(key), data...)))
-	s.bucket.Put(key, objectMock{
-		data,
-		time.Now(),
-		etag,
-	})
+	s.bucket.Put(key, objectMock{data: data, lastMod: time.Now(), etag: etag, metadata: input.Metadata, encryption: aws.StringValue(input.ServerSideEncryption), customerKey: aws.StringValue(input.SSECustomerKey), headers: objectHeaders{
+		contentType:        aws.StringValue(input.ContentType),
+		cacheControl:       aws.StringValue(input.CacheControl),
+		contentDisposition: aws.StringValue(input.ContentDisposition),
+		storageClass:       aws.StringValue(input.StorageClass),
+		acl:                aws.StringValue(input.ACL),
+		tagging:            aws.StringValue(input.Tagging),
+	}})
 	return &s3manager.UploadOutput{}, nil
 }
 
@@ -118,27 +143,89 @@ func (s *s3UploaderMock) UploadWithContext(aws.Context, *s3manager.UploadInput,
 
 type s3Mock struct {
 	s3iface.S3API
-	bucket *bucketMock
+	bucket   *bucketMock
+	pageSize int
+	// headErr is returned by HeadObject if set
+	headErr error
+
+	deleteRequests int
+
+	uploadsLock sync.Mutex
+	uploads     map[string]*multipartUploadMock
+	uploadCount int
+}
+
+type multipartUploadMock struct {
+	key         string
+	parts       map[int64][]byte
+	metadata    map[string]*string
+	initiated   time.Time
+	encryption  string
+	customerKey string
+	headers     objectHeaders
+}
+
+// objectHeaders are the attributes of an object which are set on upload.
+type objectHeaders struct {
+	contentType        string
+	cacheControl       string
+	contentDisposition string
+	storageClass       string
+	acl                string
+	tagging            string
 }
 
 type objectMock struct {
-	data    []byte
-	lastMod time.Time
-	etag    string
+	data     []byte
+	lastMod  time.Time
+	etag     string
+	metadata map[string]*string
+	// encryption is the server-side encryption requested on upload
+	encryption string
+	// customerKey is the SSE-C key of the object, which must be sent along with every request
+	customerKey string
+	headers     objectHeaders
+}
+
+// optionalString returns nil for an empty header `value` like a response of s3.
+func optionalString(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return aws.String(value)
+}
+
+// checkCustomerKey fails like a request of an object encrypted with SSE-C without the object's key.
+func checkCustomerKey(customerKey string, key *string) error {
+	if customerKey != aws.StringValue(key) {
+		return awserr.New("BadRequest", "The SSE-C key does not match the key of the object", nil)
+	}
+	return nil
 }
 
 func (mock *s3Mock) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
 	if err := input.Validate(); err != nil {
 		return nil, err
 	}
+	if mock.headErr != nil {
+		return nil, mock.headErr
+	}
 
 	object, err := mock.bucket.Get(aws.StringValue(input.Key))
 	if err != nil {
-		return nil, awserr.New("NoSuchObject", err.Error(), err)
+		return nil, awserr.New("NotFound", err.Error(), err)
+	}
+	if err := checkCustomerKey(object.customerKey, input.SSECustomerKey); err != nil {
+		return nil, err
 	}
 	return &s3.HeadObjectOutput{
-		ContentLength: aws.Int64(int64(len(object.data))),
-		LastModified:  aws.Time(object.lastMod),
+		ContentLength:      aws.Int64(int64(len(object.data))),
+		LastModified:       aws.Time(object.lastMod),
+		Metadata:           object.metadata,
+		ContentType:        optionalString(object.headers.contentType),
+		CacheControl:       optionalString(object.headers.cacheControl),
+		ContentDisposition: optionalString(object.headers.contentDisposition),
+		StorageClass:       optionalString(object.headers.storageClass),
 	}, nil
 }
 
@@ -153,25 +240,63 @@ func (mock *s3Mock) HeadBucket(input *s3.HeadBucketInput) (*s3.HeadBucketOutput,
 	return &s3.HeadBucketOutput{}, nil
 }
 
-func (mock *s3Mock) ListObjects(input *s3.ListObjectsInput) (*s3.ListObjectsOutput, error) {
+func (mock *s3Mock) ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
 	if err := input.Validate(); err != nil {
 		return nil, err
 	}
 
-	contents := []*s3.Object{}
 	prefix := aws.StringValue(input.Prefix)
-	for key, object := range mock.bucket.List() {
+	delimiter := aws.StringValue(input.Delimiter)
+	objects := mock.bucket.List()
+	keys := []string{}
+	for key := range objects {
 		if strings.HasPrefix(key, prefix) {
-			contents = append(contents, &s3.Object{
-				ETag:         aws.String(object.etag),
-				Key:          aws.String(key),
-				LastModified: &object.lastMod,
-				Size:         aws.Int64(int64(len(object.data))),
-			})
+			keys = append(keys, key)
 		}
 	}
+	sort.Strings(keys)
 
-	return &s3.ListObjectsOutput{Contents: contents}, nil
+	pageSize := mock.pageSize
+	if pageSize <= 0 {
+		pageSize = 1000
+	}
+	if maxKeys := int(aws.Int64Value(input.MaxKeys)); maxKeys > 0 && maxKeys < pageSize {
+		pageSize = maxKeys
+	}
+	start := aws.StringValue(input.ContinuationToken)
+	resp := &s3.ListObjectsV2Output{IsTruncated: aws.Bool(false)}
+	count := 0
+	for _, key := range keys {
+		if key <= start {
+			continue
+		}
+		if count == pageSize {
+			resp.IsTruncated = aws.Bool(true)
+			resp.NextContinuationToken = aws.String(start)
+			break
+		}
+		if delimiter != "" {
+			if idx := strings.Index(key[len(prefix):], delimiter); idx >= 0 {
+				commonPrefix := key[:len(prefix)+idx+len(delimiter)]
+				// skip all remaining keys of this common prefix
+				start = commonPrefix + "\xff"
+				resp.CommonPrefixes = append(resp.CommonPrefixes, &s3.CommonPrefix{Prefix: aws.String(commonPrefix)})
+				count++
+				continue
+			}
+		}
+		object := objects[key]
+		resp.Contents = append(resp.Contents, &s3.Object{
+			ETag:         aws.String(object.etag),
+			Key:          aws.String(key),
+			LastModified: aws.Time(object.lastMod),
+			Size:         aws.Int64(int64(len(object.data))),
+		})
+		start = key
+		count++
+	}
+	resp.KeyCount = aws.Int64(int64(count))
+	return resp, nil
 }
 
 func (mock *s3Mock) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
@@ -181,14 +306,34 @@ func (mock *s3Mock) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, er
 
 	object, err := mock.bucket.Get(aws.StringValue(input.Key))
 	if err != nil {
-		return nil, awserr.New("NoSuchObject", err.Error(), err)
+		return nil, awserr.New("NoSuchKey", err.Error(), err)
 	}
-	return &s3.GetObjectOutput{
-		Body:          ioutil.NopCloser(bytes.NewReader(object.data)),
-		ContentLength: aws.Int64(int64(len(object.data))),
-		ETag:          aws.String(object.etag),
-		LastModified:  &object.lastMod,
-	}, nil
+	if err := checkCustomerKey(object.customerKey, input.SSECustomerKey); err != nil {
+		return nil, err
+	}
+	data := object.data
+	resp := &s3.GetObjectOutput{
+		ETag:         aws.String(object.etag),
+		LastModified: &object.lastMod,
+		Metadata:     object.metadata,
+	}
+	if objectRange := aws.StringValue(input.Range); objectRange != "" {
+		first, last := 0, len(data)-1
+		if _, err := fmt.Sscanf(objectRange, "bytes=%d-%d", &first, &last); err != nil && !strings.HasSuffix(objectRange, "-") {
+			return nil, awserr.New("InvalidArgument", fmt.Sprintf("Bad range %q", objectRange), err)
+		}
+		if first >= len(data) {
+			return nil, awserr.New("InvalidRange", "The requested range is not satisfiable", nil)
+		}
+		if last >= len(data) {
+			last = len(data) - 1
+		}
+		resp.ContentRange = aws.String(fmt.Sprintf("bytes %d-%d/%d", first, last, len(data)))
+		data = data[first : last+1]
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+	resp.ContentLength = aws.Int64(int64(len(data)))
+	return resp, nil
 }
 
 func (mock *s3Mock) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
@@ -200,6 +345,303 @@ func (mock *s3Mock) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectO
 	return &s3.DeleteObjectOutput{}, err
 }
 
+func (mock *s3Mock) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+
+	data := []byte{}
+	if input.Body != nil {
+		var err error
+		data, err = ioutil.ReadAll(input.Body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	etag := fmt.Sprintf("%x", sha256.Sum256(data))
+	mock.bucket.Put(aws.StringValue(input.Key), objectMock{data: data, lastMod: time.Now(), etag: etag, metadata: input.Metadata, encryption: aws.StringValue(input.ServerSideEncryption), customerKey: aws.StringValue(input.SSECustomerKey)})
+	return &s3.PutObjectOutput{ETag: aws.String(etag)}, nil
+}
+
+func (mock *s3Mock) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, options ...request.Option) (*s3.PutObjectOutput, error) {
+	if err := mock.checkPrecondition("PutObject", aws.StringValue(input.Key), options); err != nil {
+		return nil, err
+	}
+	return mock.PutObject(input)
+}
+
+// checkPrecondition fails like a conditional write to an existing object if the request options set `If-None-Match: *`.
+func (mock *s3Mock) checkPrecondition(operation, key string, options []request.Option) error {
+	return checkPrecondition(mock.bucket, operation, key, options)
+}
+
+func checkPrecondition(bucket *bucketMock, operation, key string, options []request.Option) error {
+	r := &request.Request{
+		Operation:   &request.Operation{Name: operation},
+		HTTPRequest: &http.Request{Header: http.Header{}},
+	}
+	r.ApplyOptions(options...)
+	if r.HTTPRequest.Header.Get("If-None-Match") != "*" {
+		return nil
+	}
+	if _, err := bucket.Get(key); err == nil {
+		return awserr.New("PreconditionFailed", "At least one of the pre-conditions you specified did not hold", nil)
+	}
+	return nil
+}
+
+func (mock *s3Mock) DeleteObjects(input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+	if len(input.Delete.Objects) > 1000 {
+		return nil, awserr.New("MalformedXML", "Too many objects", nil)
+	}
+
+	mock.deleteRequests++
+	resp := &s3.DeleteObjectsOutput{}
+	for _, object := range input.Delete.Objects {
+		if err := mock.bucket.Delete(aws.StringValue(object.Key)); err != nil {
+			resp.Errors = append(resp.Errors, &s3.Error{Key: object.Key, Code: aws.String("NoSuchKey")})
+		}
+	}
+	return resp, nil
+}
+
+func (mock *s3Mock) copySource(copySource string) (objectMock, error) {
+	source, err := url.PathUnescape(copySource)
+	if err != nil {
+		return objectMock{}, err
+	}
+	parts := strings.SplitN(source, "/", 2)
+	if len(parts) != 2 || parts[0] != mock.bucket.Name() {
+		return objectMock{}, awserr.New("NoSuchBucket", fmt.Sprintf("Bad copy source %q", copySource), nil)
+	}
+	object, err := mock.bucket.Get(parts[1])
+	if err != nil {
+		return objectMock{}, awserr.New("NoSuchKey", err.Error(), err)
+	}
+	return object, nil
+}
+
+func (mock *s3Mock) CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+
+	object, err := mock.copySource(aws.StringValue(input.CopySource))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCustomerKey(object.customerKey, input.CopySourceSSECustomerKey); err != nil {
+		return nil, err
+	}
+	metadata, headers := object.metadata, object.headers
+	if aws.StringValue(input.MetadataDirective) == s3.MetadataDirectiveReplace {
+		metadata = input.Metadata
+		headers = objectHeaders{
+			contentType:        aws.StringValue(input.ContentType),
+			cacheControl:       aws.StringValue(input.CacheControl),
+			contentDisposition: aws.StringValue(input.ContentDisposition),
+			storageClass:       aws.StringValue(input.StorageClass),
+			acl:                aws.StringValue(input.ACL),
+			tagging:            aws.StringValue(input.Tagging),
+		}
+	}
+	if aws.StringValue(input.TaggingDirective) != s3.TaggingDirectiveReplace {
+		headers.tagging = object.headers.tagging
+	}
+	mock.bucket.Put(aws.StringValue(input.Key), objectMock{data: object.data, lastMod: time.Now(), etag: object.etag, metadata: metadata, encryption: aws.StringValue(input.ServerSideEncryption), customerKey: aws.StringValue(input.SSECustomerKey), headers: headers})
+	return &s3.CopyObjectOutput{CopyObjectResult: &s3.CopyObjectResult{ETag: aws.String(object.etag)}}, nil
+}
+
+func (mock *s3Mock) CopyObjectWithContext(ctx aws.Context, input *s3.CopyObjectInput, options ...request.Option) (*s3.CopyObjectOutput, error) {
+	if err := mock.checkPrecondition("CopyObject", aws.StringValue(input.Key), options); err != nil {
+		return nil, err
+	}
+	return mock.CopyObject(input)
+}
+
+func (mock *s3Mock) CreateMultipartUpload(input *s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+
+	mock.uploadsLock.Lock()
+	defer mock.uploadsLock.Unlock()
+	if mock.uploads == nil {
+		mock.uploads = map[string]*multipartUploadMock{}
+	}
+	mock.uploadCount++
+	uploadID := fmt.Sprintf("upload-%d", mock.uploadCount)
+	mock.uploads[uploadID] = &multipartUploadMock{
+		key:         aws.StringValue(input.Key),
+		parts:       map[int64][]byte{},
+		metadata:    input.Metadata,
+		initiated:   time.Now(),
+		encryption:  aws.StringValue(input.ServerSideEncryption),
+		customerKey: aws.StringValue(input.SSECustomerKey),
+		headers: objectHeaders{
+			contentType:        aws.StringValue(input.ContentType),
+			cacheControl:       aws.StringValue(input.CacheControl),
+			contentDisposition: aws.StringValue(input.ContentDisposition),
+			storageClass:       aws.StringValue(input.StorageClass),
+			acl:                aws.StringValue(input.ACL),
+			tagging:            aws.StringValue(input.Tagging),
+		},
+	}
+	return &s3.CreateMultipartUploadOutput{
+		Bucket:   input.Bucket,
+		Key:      input.Key,
+		UploadId: aws.String(uploadID),
+	}, nil
+}
+
+func (mock *s3Mock) ListMultipartUploads(input *s3.ListMultipartUploadsInput) (*s3.ListMultipartUploadsOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+
+	mock.uploadsLock.Lock()
+	defer mock.uploadsLock.Unlock()
+	uploadIDs := []string{}
+	for uploadID := range mock.uploads {
+		if uploadID > aws.StringValue(input.UploadIdMarker) {
+			uploadIDs = append(uploadIDs, uploadID)
+		}
+	}
+	sort.Strings(uploadIDs)
+	truncated := mock.pageSize > 0 && len(uploadIDs) > mock.pageSize
+	if truncated {
+		uploadIDs = uploadIDs[:mock.pageSize]
+	}
+	output := &s3.ListMultipartUploadsOutput{IsTruncated: aws.Bool(truncated)}
+	for _, uploadID := range uploadIDs {
+		upload := mock.uploads[uploadID]
+		output.Uploads = append(output.Uploads, &s3.MultipartUpload{
+			Key:       aws.String(upload.key),
+			UploadId:  aws.String(uploadID),
+			Initiated: aws.Time(upload.initiated),
+		})
+		output.NextKeyMarker = aws.String(upload.key)
+		output.NextUploadIdMarker = aws.String(uploadID)
+	}
+	return output, nil
+}
+
+func (mock *s3Mock) upload(uploadID string) (*multipartUploadMock, error) {
+	upload, ok := mock.uploads[uploadID]
+	if !ok {
+		return nil, awserr.New("NoSuchUpload", fmt.Sprintf("Upload %q not found", uploadID), nil)
+	}
+	return upload, nil
+}
+
+func (mock *s3Mock) UploadPartCopy(input *s3.UploadPartCopyInput) (*s3.UploadPartCopyOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+
+	object, err := mock.copySource(aws.StringValue(input.CopySource))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCustomerKey(object.customerKey, input.CopySourceSSECustomerKey); err != nil {
+		return nil, err
+	}
+	data := object.data
+	if copyRange := aws.StringValue(input.CopySourceRange); copyRange != "" {
+		var first, last int
+		if _, err := fmt.Sscanf(copyRange, "bytes=%d-%d", &first, &last); err != nil || last >= len(data) || first > last {
+			return nil, awserr.New("InvalidRange", fmt.Sprintf("Bad range %q", copyRange), err)
+		}
+		data = data[first : last+1]
+	}
+
+	mock.uploadsLock.Lock()
+	defer mock.uploadsLock.Unlock()
+	upload, err := mock.upload(aws.StringValue(input.UploadId))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCustomerKey(upload.customerKey, input.SSECustomerKey); err != nil {
+		return nil, err
+	}
+	upload.parts[aws.Int64Value(input.PartNumber)] = data
+	etag := fmt.Sprintf("%x", sha256.Sum256(data))
+	return &s3.UploadPartCopyOutput{CopyPartResult: &s3.CopyPartResult{ETag: aws.String(etag)}}, nil
+}
+
+func (mock *s3Mock) UploadPart(input *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	mock.uploadsLock.Lock()
+	defer mock.uploadsLock.Unlock()
+	upload, err := mock.upload(aws.StringValue(input.UploadId))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCustomerKey(upload.customerKey, input.SSECustomerKey); err != nil {
+		return nil, err
+	}
+	upload.parts[aws.Int64Value(input.PartNumber)] = data
+	return &s3.UploadPartOutput{ETag: aws.String(fmt.Sprintf("%x", sha256.Sum256(data)))}, nil
+}
+
+func (mock *s3Mock) CompleteMultipartUpload(input *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+
+	mock.uploadsLock.Lock()
+	defer mock.uploadsLock.Unlock()
+	uploadID := aws.StringValue(input.UploadId)
+	upload, err := mock.upload(uploadID)
+	if err != nil {
+		return nil, err
+	}
+	data := []byte{}
+	for _, part := range input.MultipartUpload.Parts {
+		partData, ok := upload.parts[aws.Int64Value(part.PartNumber)]
+		if !ok {
+			return nil, awserr.New("InvalidPart", fmt.Sprintf("Part %d not found", aws.Int64Value(part.PartNumber)), nil)
+		}
+		data = append(data, partData...)
+	}
+	delete(mock.uploads, uploadID)
+	etag := fmt.Sprintf("%x-%d", sha256.Sum256(data), len(input.MultipartUpload.Parts))
+	mock.bucket.Put(upload.key, objectMock{data: data, lastMod: time.Now(), etag: etag, metadata: upload.metadata, encryption: upload.encryption, customerKey: upload.customerKey, headers: upload.headers})
+	return &s3.CompleteMultipartUploadOutput{Key: aws.String(upload.key), ETag: aws.String(etag)}, nil
+}
+
+func (mock *s3Mock) CompleteMultipartUploadWithContext(ctx aws.Context, input *s3.CompleteMultipartUploadInput, options ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+	if err := mock.checkPrecondition("CompleteMultipartUpload", aws.StringValue(input.Key), options); err != nil {
+		return nil, err
+	}
+	return mock.CompleteMultipartUpload(input)
+}
+
+func (mock *s3Mock) AbortMultipartUpload(input *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+
+	mock.uploadsLock.Lock()
+	defer mock.uploadsLock.Unlock()
+	uploadID := aws.StringValue(input.UploadId)
+	if _, err := mock.upload(uploadID); err != nil {
+		return nil, err
+	}
+	delete(mock.uploads, uploadID)
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
 func TestIfPutFileChecksForNilReader(t *testing.T) {
 	bucketName := "test-bucket"
 	bucketMock := newBucketMock(bucketName)
@@ -235,11 +677,34 @@ func TestIfPutFileChecksForNilReader(t *testing.T) {
 }
 
 func TestChangeDirectory(t *testing.T) {
-	// I can't test the value of the drivers 'cwd'
-	// because its methods need to be defined on a value receiver,
-	// i.e. that sideffect changes, like setting the cwd on a change-dir call,
-	// are not reflected in the test struct.
-	t.Log("ToDo")
+	logrus.SetLevel(logrus.PanicLevel)
+	d := S3Driver{featureFlags: featureList}
+	if err := d.ChangeDir("/foo"); err == nil {
+		t.Fatal("Changing the directory succeeded although CD is not enabled")
+	}
+
+	d = S3Driver{featureFlags: featureChangeDir}
+	for _, step := range []struct {
+		path string
+		cwd  string
+	}{
+		{"/foo", "/foo"},
+		{"bar", "/foo/bar"},
+		{"..", "/foo"},
+		{"/", "/"},
+		{"../..", "/"},
+		{"baz//qux/", "/baz/qux"},
+	} {
+		if err := d.ChangeDir(step.path); err != nil {
+			t.Fatalf("Changing into %q failed: %s", step.path, err)
+		}
+		if d.cwd != step.cwd {
+			t.Fatalf("Changing into %q: expected cwd %q but was %q", step.path, step.cwd, d.cwd)
+		}
+	}
+	if key := d.objectKey("some-key"); key != "baz/qux/some-key" {
+		t.Fatalf("Key is not relative to the current directory: %q", key)
+	}
 }
 
 func TestS3Driver(t *testing.T) {
@@ -267,13 +732,8 @@ func TestS3Driver(t *testing.T) {
 	content := bytes.NewBufferString("The contents of some-key.")
 	contentLen := int64(content.Len())
 
-	// Fails: put with append
-	_, err := d.PutFile(key, content, true)
-	if err == nil {
-		t.Fatalf("Unsupported operation without error: PUT in append mode")
-	}
 	// valid put
-	_, err = d.PutFile(key, content, false)
+	_, err := d.PutFile(key, content, false)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -282,6 +742,11 @@ func TestS3Driver(t *testing.T) {
 	if err == nil && noOverwrite {
 		t.Fatal("Overwrite is not allowed but succeeded")
 	}
+	// Fails: append to existing key without overwrite
+	_, err = d.PutFile(key, content, true)
+	if err == nil && noOverwrite {
+		t.Fatal("Appending to an existing object is not allowed without overwrite but succeeded")
+	}
 	// get object
 	respLen, respReader, err := d.GetFile(key, 0)
 	if err != nil {
@@ -319,6 +784,515 @@ func TestS3Driver(t *testing.T) {
 	}
 }
 
+func TestListDir(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	for _, key := range []string{"a.txt", "foo/", "foo/b.txt", "foo/bar/c.txt", "foo/bar/d.txt", "foo/baz/e.txt", "foobar.txt"} {
+		bucketMock.Put(key, objectMock{data: []byte(key), lastMod: time.Now(), etag: key})
+	}
+	for i := 0; i < 25; i++ {
+		key := fmt.Sprintf("many/object-%02d", i)
+		bucketMock.Put(key, objectMock{data: []byte(key), lastMod: time.Now(), etag: key})
+	}
+	d := S3Driver{
+		featureFlags: featureList,
+		s3: &s3Mock{
+			bucket:   bucketMock,
+			pageSize: 2,
+		},
+		metrics:    metricsSenderMock{},
+		bucketName: bucketName,
+		bucketURL:  intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+
+	testDataSet := []struct {
+		id      string
+		dir     string
+		entries map[string]bool // name -> isDir
+	}{
+		{"root", "/", map[string]bool{"a.txt": false, "foo": true, "foobar.txt": false, "many": true}},
+		{"sub-directory", "/foo", map[string]bool{"b.txt": false, "bar": true, "baz": true}},
+		{"nested", "foo/bar/", map[string]bool{"c.txt": false, "d.txt": false}},
+		{"missing", "/nothing", map[string]bool{}},
+	}
+	for _, testData := range testDataSet {
+		listed := map[string]bool{}
+		err := d.ListDir(testData.dir, func(info ftp.FileInfo) error {
+			if _, ok := listed[info.Name()]; ok {
+				t.Errorf("Test %s: %q listed twice", testData.id, info.Name())
+			}
+			listed[info.Name()] = info.IsDir()
+			return nil
+		})
+		if err != nil {
+			t.Errorf("Test %s: listing failed: %s", testData.id, err)
+			continue
+		}
+		if !reflect.DeepEqual(listed, testData.entries) {
+			t.Errorf("Test %s: expected %v but was %v", testData.id, testData.entries, listed)
+		}
+	}
+
+	count := 0
+	err := d.ListDir("/many", func(info ftp.FileInfo) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 25 {
+		t.Fatalf("Paginated listing is incomplete: expected 25 objects but was %d", count)
+	}
+}
+
+func TestStat(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	older, newer := time.Now().Add(-2*time.Hour), time.Now().Add(-1*time.Hour)
+	bucketMock.Put("file.txt", objectMock{data: []byte("some data"), lastMod: older, etag: "file"})
+	bucketMock.Put("marked/", objectMock{data: []byte{}, lastMod: older, etag: "marker"})
+	bucketMock.Put("marked/file.txt", objectMock{data: []byte("a"), lastMod: newer, etag: "a"})
+	bucketMock.Put("unmarked/a.txt", objectMock{data: []byte("a"), lastMod: older, etag: "a"})
+	bucketMock.Put("unmarked/b.txt", objectMock{data: []byte("b"), lastMod: newer, etag: "b"})
+	bucketMock.Put("unmarked/sub/c.txt", objectMock{data: []byte("c"), lastMod: time.Now(), etag: "c"})
+	d := S3Driver{
+		s3:         &s3Mock{bucket: bucketMock},
+		metrics:    metricsSenderMock{},
+		bucketName: bucketName,
+		bucketURL:  intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+		// paths which are stored under other keys, e.g. uploads with a key template
+		uploadedNames: map[string]string{"/report.txt": "file.txt", "/latest": "unmarked"},
+	}
+
+	testDataSet := []struct {
+		id      string
+		path    string
+		name    string
+		isDir   bool
+		size    int64
+		modTime time.Time
+	}{
+		{"file", "/file.txt", "file.txt", false, 9, older},
+		{"marked-directory", "/marked", "marked", true, 0, older},
+		{"unmarked-directory", "/unmarked/", "unmarked", true, 0, newer},
+		{"file-by-uploaded-name", "/report.txt", "report.txt", false, 9, older},
+		{"directory-by-other-name", "/latest", "latest", true, 0, newer},
+		{"root", "/", "/", true, 0, time.Time{}},
+	}
+	for _, testData := range testDataSet {
+		info, err := d.Stat(testData.path)
+		if err != nil {
+			t.Errorf("Test %s: %s", testData.id, err)
+			continue
+		}
+		if info.Name() != testData.name || info.IsDir() != testData.isDir || info.Size() != testData.size {
+			t.Errorf("Test %s: unexpected name=%q dir=%v size=%d", testData.id, info.Name(), info.IsDir(), info.Size())
+		}
+		if !testData.modTime.IsZero() && !info.ModTime().Equal(testData.modTime) {
+			t.Errorf("Test %s: expected modification time %s but was %s", testData.id, testData.modTime, info.ModTime())
+		}
+	}
+
+	for _, missing := range []string{"/missing", "/unmark", "/marked/missing"} {
+		if _, err := d.Stat(missing); err == nil {
+			t.Errorf("Stat for missing %q succeeded", missing)
+		}
+	}
+}
+
+func TestGetFileWithOffset(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	content := "0123456789abcdefghijklmnopqrstuvwxyz"
+	bucketMock.Put("some-key", objectMock{data: []byte(content), lastMod: time.Now(), etag: "etag"})
+	d := S3Driver{
+		featureFlags: featureGet,
+		s3:           &s3Mock{bucket: bucketMock},
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+
+	for _, offset := range []int64{0, 1, 10, 35, 36} {
+		size, reader, err := d.GetFile("/some-key", offset)
+		if err != nil {
+			t.Fatalf("Offset %d: %s", offset, err)
+		}
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("Offset %d: could not read response data: %s", offset, err)
+		}
+		reader.Close()
+		expected := content[offset:]
+		if size != int64(len(expected)) {
+			t.Fatalf("Offset %d: expected remaining length %d but was %d", offset, len(expected), size)
+		}
+		if string(data) != expected {
+			t.Fatalf("Offset %d: expected %q but was %q", offset, expected, data)
+		}
+	}
+
+	// Fails: offset beyond the end of the object
+	if _, _, err := d.GetFile("/some-key", 37); err == nil {
+		t.Fatal("Offset beyond the end of the object was not rejected")
+	}
+	// Fails: negative offset
+	if _, _, err := d.GetFile("/some-key", -1); err == nil {
+		t.Fatal("Negative offset was not rejected")
+	}
+}
+
+// interruptedReader returns its data and fails afterwards like a broken data connection.
+type interruptedReader struct {
+	data io.Reader
+}
+
+func (r *interruptedReader) Read(p []byte) (int, error) {
+	n, err := r.data.Read(p)
+	if err == io.EOF {
+		return n, fmt.Errorf("connection reset by peer")
+	}
+	return n, err
+}
+
+func TestAppendFile(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	defer func(partSize, copySize int64) {
+		uploadPartSize, copyPartSize = partSize, copySize
+	}(uploadPartSize, copyPartSize)
+	uploadPartSize, copyPartSize = 4, 6
+
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	bucketMock.Put("small.txt", objectMock{data: []byte("abc"), lastMod: time.Now(), etag: "small"})
+	bucketMock.Put("large.txt", objectMock{data: []byte("0123456789abcdefghij"), lastMod: time.Now(), etag: "large"})
+	mock := &s3Mock{bucket: bucketMock}
+	d := S3Driver{
+		featureFlags: featurePut | featureGet,
+		s3:           mock,
+		uploader:     &s3UploaderMock{bucket: bucketMock},
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+
+	testDataSet := []struct {
+		id       string
+		key      string
+		data     string
+		expected string
+	}{
+		{"small-object", "small.txt", "defghijkl", "abcdefghijkl"},
+		{"large-object", "large.txt", "KLMNOPQ", "0123456789abcdefghijKLMNOPQ"},
+		{"missing-object", "new.txt", "created", "created"},
+		{"empty-data", "empty.txt", "", ""},
+	}
+	for _, testData := range testDataSet {
+		size, err := d.PutFile(testData.key, strings.NewReader(testData.data), true)
+		if err != nil {
+			t.Errorf("Test %s: %s", testData.id, err)
+			continue
+		}
+		if size != int64(len(testData.data)) {
+			t.Errorf("Test %s: expected %d appended bytes but were %d", testData.id, len(testData.data), size)
+		}
+		object, err := bucketMock.Get(testData.key)
+		if err != nil {
+			t.Errorf("Test %s: %s", testData.id, err)
+			continue
+		}
+		if string(object.data) != testData.expected {
+			t.Errorf("Test %s: expected %q but was %q", testData.id, testData.expected, object.data)
+		}
+	}
+
+	// interrupted uploads are aborted by default
+	_, err := d.PutFile("broken.txt", &interruptedReader{strings.NewReader("0123456789")}, false)
+	if err == nil {
+		t.Fatal("Interrupted upload succeeded")
+	}
+	if _, err := bucketMock.Get("broken.txt"); err == nil {
+		t.Fatal("Interrupted upload was stored")
+	}
+	if len(mock.uploads) != 0 {
+		t.Fatalf("Interrupted upload was not aborted")
+	}
+
+	// interrupted uploads can be resumed if enabled
+	d.pendingUploads = newPendingUploads()
+	_, err = d.PutFile("resumed.txt", &interruptedReader{strings.NewReader("0123456789")}, false)
+	if err == nil {
+		t.Fatal("Interrupted upload succeeded")
+	}
+	info, err := d.Stat("resumed.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name() != "resumed.txt" || info.IsDir() || info.Size() != 8 {
+		t.Fatalf("Expected the interrupted upload to be reported as file resumed.txt of 8 bytes, but was: name=%q dir=%v size=%d", info.Name(), info.IsDir(), info.Size())
+	}
+	_, err = d.PutFile("resumed.txt", strings.NewReader("89abc"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	object, err := bucketMock.Get("resumed.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(object.data) != "0123456789abc" {
+		t.Fatalf("Resumed upload has unexpected contents %q", object.data)
+	}
+	if len(mock.uploads) != 0 {
+		t.Fatalf("%d multipart uploads were not completed", len(mock.uploads))
+	}
+
+	// data which fits into a single part is uploaded as a whole even if resumable uploads are enabled
+	uploadCount := mock.uploadCount
+	if _, err := d.PutFile("tiny.txt", strings.NewReader("abc"), false); err != nil {
+		t.Fatal(err)
+	}
+	object, err = bucketMock.Get("tiny.txt")
+	if err != nil || string(object.data) != "abc" || metadataValue(object.metadata, metadataSHA256) == "" {
+		t.Fatalf("Expected the small upload to be stored with its digest: %q %v", object.data, err)
+	}
+	if mock.uploadCount != uploadCount {
+		t.Fatalf("Expected the small upload not to start a multipart upload")
+	}
+}
+
+func TestTruncatedUpload(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	defer func(partSize int64) {
+		uploadPartSize = partSize
+	}(uploadPartSize)
+	uploadPartSize = 4
+
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	mock := &s3Mock{bucket: bucketMock}
+	d := S3Driver{
+		featureFlags: featurePut,
+		s3:           mock,
+		uploader:     &s3UploaderMock{bucket: bucketMock},
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+
+	for _, testData := range []struct {
+		key        string
+		data       string
+		announced  string
+		appendMode bool
+		truncated  bool
+	}{
+		{"single-part.txt", "abc", "10", false, true},
+		{"multipart.txt", "0123456789", "20", false, true},
+		{"append.txt", "0123456789", "20", true, true},
+		{"complete.txt", "0123456789", "10", false, false},
+		{"empty.txt", "", "0", false, false},
+	} {
+		if code, _, handled := d.handleCommand("ALLO", testData.announced); !handled || code != 200 {
+			t.Fatalf("%s: ALLO %s was not accepted: %d", testData.key, testData.announced, code)
+		}
+		_, err := d.PutFile(testData.key, strings.NewReader(testData.data), testData.appendMode)
+		_, getErr := bucketMock.Get(testData.key)
+		if testData.truncated {
+			if err == nil || !strings.Contains(err.Error(), errTruncated.Error()) {
+				t.Errorf("%s: expected truncated upload to fail but was: %v", testData.key, err)
+			}
+			if getErr == nil {
+				t.Errorf("%s: truncated upload was stored", testData.key)
+			}
+		} else if err != nil || getErr != nil {
+			t.Errorf("%s: upload failed: %v, %v", testData.key, err, getErr)
+		}
+		if len(mock.uploads) != 0 {
+			t.Errorf("%s: multipart upload was not aborted", testData.key)
+		}
+	}
+
+	// the announced size only applies to the next upload
+	if _, err := d.PutFile("next.txt", strings.NewReader("abc"), false); err != nil {
+		t.Errorf("Upload after ALLO failed: %s", err)
+	}
+	if code, _, _ := d.handleCommand("ALLO", "many"); code != 501 {
+		t.Errorf("Invalid size was accepted")
+	}
+}
+
+func TestRename(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	for _, key := range []string{"a.txt", "b.txt", "big.bin", "dir/one.txt", "dir/sub/two.txt", "other/three.txt"} {
+		bucketMock.Put(key, objectMock{data: []byte("contents of " + key), lastMod: time.Now(), etag: key})
+	}
+	mock := &s3Mock{bucket: bucketMock}
+	d := S3Driver{
+		featureFlags: featureMove,
+		noOverwrite:  true,
+		s3:           mock,
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+
+	// Fails: destination exists
+	if err := d.Rename("/a.txt", "/b.txt"); err == nil {
+		t.Fatal("Overwrite is not allowed but succeeded")
+	}
+	// Fails: source does not exist
+	if err := d.Rename("/missing.txt", "/c.txt"); err == nil {
+		t.Fatal("Renaming a missing object succeeded")
+	}
+	// Fails: directory into itself
+	if err := d.Rename("/dir", "/dir/sub/dir"); err == nil {
+		t.Fatal("Moving a directory into itself succeeded")
+	}
+	// Fails: directory onto existing directory
+	if err := d.Rename("/dir", "/other"); err == nil {
+		t.Fatal("Overwrite of a directory is not allowed but succeeded")
+	}
+
+	if err := d.Rename("/a.txt", "/c.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Rename("/dir", "/moved/dir"); err != nil {
+		t.Fatal(err)
+	}
+
+	// force a multipart copy
+	defer func(maxSize, partSize int64) {
+		maxCopyObjectSize, copyPartSize = maxSize, partSize
+	}(maxCopyObjectSize, copyPartSize)
+	maxCopyObjectSize, copyPartSize = 4, 3
+	if err := d.Rename("/big.bin", "/huge.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if mock.uploadCount != 1 || len(mock.uploads) != 0 {
+		t.Fatalf("Expected a single completed multipart copy but %d were started and %d not completed", mock.uploadCount, len(mock.uploads))
+	}
+
+	expected := map[string]string{
+		"b.txt":                 "contents of b.txt",
+		"c.txt":                 "contents of a.txt",
+		"huge.bin":              "contents of big.bin",
+		"moved/dir/one.txt":     "contents of dir/one.txt",
+		"moved/dir/sub/two.txt": "contents of dir/sub/two.txt",
+		"other/three.txt":       "contents of other/three.txt",
+	}
+	objects := bucketMock.List()
+	if len(objects) != len(expected) {
+		t.Fatalf("Expected %d objects but found %d", len(expected), len(objects))
+	}
+	for key, data := range expected {
+		object, ok := objects[key]
+		if !ok {
+			t.Fatalf("Object %q is missing", key)
+		}
+		if string(object.data) != data {
+			t.Fatalf("Object %q has unexpected contents %q", key, object.data)
+		}
+	}
+
+	d.featureFlags = featureList
+	if err := d.Rename("/b.txt", "/d.txt"); err == nil {
+		t.Fatal("Rename succeeded although MV is not enabled")
+	}
+}
+
+func TestMakeAndDeleteDir(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	bucketMock.Put("file.txt", objectMock{data: []byte("file"), lastMod: time.Now(), etag: "file"})
+	for i := 0; i < 2500; i++ {
+		key := fmt.Sprintf("full/sub-%d/object-%04d", i%3, i)
+		bucketMock.Put(key, objectMock{data: []byte(key), lastMod: time.Now(), etag: key})
+	}
+	mock := &s3Mock{bucket: bucketMock}
+	d := S3Driver{
+		featureFlags: featureList | featureMakeDir | featureRemoveDir,
+		s3:           mock,
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+		cwd:          "/",
+	}
+
+	if err := d.MakeDir("/empty"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bucketMock.Get("empty/"); err != nil {
+		t.Fatalf("Directory marker was not created: %s", err)
+	}
+	// Fails: directory exists
+	if err := d.MakeDir("empty"); err == nil {
+		t.Fatal("Creating an existing directory succeeded")
+	}
+	// Fails: object exists
+	if err := d.MakeDir("file.txt"); err == nil {
+		t.Fatal("Creating a directory on top of an object succeeded")
+	}
+
+	found := false
+	err := d.ListDir("/", func(info ftp.FileInfo) error {
+		if info.Name() == "empty" {
+			found = info.IsDir()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatal("Empty directory is not listed")
+	}
+	err = d.ListDir("/empty", func(info ftp.FileInfo) error {
+		return fmt.Errorf("Unexpected entry %q", info.Name())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fails: not empty
+	if err := d.DeleteDir("/full"); err == nil {
+		t.Fatal("Deleting a non-empty directory succeeded")
+	}
+	// Fails: missing
+	if err := d.DeleteDir("/missing"); err == nil {
+		t.Fatal("Deleting a missing directory succeeded")
+	}
+	if err := d.DeleteDir("/empty"); err != nil {
+		t.Fatal(err)
+	}
+
+	d.recursiveRemoveDir = true
+	mock.deleteRequests = 0
+	if err := d.DeleteDir("/full"); err != nil {
+		t.Fatal(err)
+	}
+	if objects := bucketMock.List(); len(objects) != 1 {
+		t.Fatalf("Expected a single remaining object but found %d", len(objects))
+	}
+	if mock.deleteRequests != 3 {
+		t.Fatalf("Expected 3 batch deletions but were %d", mock.deleteRequests)
+	}
+
+	d.featureFlags = featureList
+	if err := d.MakeDir("/new"); err == nil {
+		t.Fatal("MakeDir succeeded although MKDIR is not enabled")
+	}
+	if err := d.DeleteDir("/new"); err == nil {
+		t.Fatal("DeleteDir succeeded although RMDIR is not enabled")
+	}
+}
+
 func intoURL(s string) *url.URL {
 	u, err := url.Parse(s)
 	if err != nil {
@@ -10,11 +10,12 @@ type S3ObjectInfo struct {
 	name     string
 	size     int64
 	owner    string
+	group    string
 	modTime  time.Time
 	isPrefix bool
 }
 
-// Name returns an s3 objects fully qualified identifier, e.g. `https://my-bucket.s3.amazonaws.com/some/prefix/objectKey`.
+// Name returns an s3 objects name, i.e. its key relative to the listed prefix.
 func (s S3ObjectInfo) Name() string {
 	return s.name
 }
@@ -24,8 +25,11 @@ func (s S3ObjectInfo) Size() int64 {
 	return s.size
 }
 
-// Mode returns `o644` for all objects because there is no file mode equivalent for s3 objects.
+// Mode returns `o644` for all objects and `o755` for prefixes because there is no file mode equivalent for s3 objects.
 func (s S3ObjectInfo) Mode() os.FileMode {
+	if s.isPrefix {
+		return os.ModeDir | os.FileMode(0755)
+	}
 	return os.FileMode(0644)
 }
 
@@ -52,7 +56,11 @@ func (s S3ObjectInfo) Owner() string {
 	return s.owner
 }
 
-// Group returns always "Unknown" because there is no corresponding attribute for an s3 object.
+// Group returns the configured group name if any, otherwise "Unknown" is returned
+// because there is no corresponding attribute for an s3 object.
 func (s S3ObjectInfo) Group() string {
-	return "Unknown"
+	if s.group == "" {
+		return "Unknown"
+	}
+	return s.group
 }
@@ -0,0 +1,520 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// uploadPartSize is the size of the parts of multipart uploads which are created by the driver.
+	// All parts but the last one must be at least 5 MiB.
+	uploadPartSize int64 = 5 * 1024 * 1024
+)
+
+// errTruncated is returned if a transfer ends before the announced number of bytes was received.
+var errTruncated = errors.New("transfer ended before all announced bytes were received")
+
+// announcedReader reads the data of a transfer whose size was announced by the client.
+// It fails instead of returning EOF if fewer bytes are received, so that a truncated upload is never completed.
+// Transfers without announced size end with EOF when the data connection is closed, complete or not.
+type announcedReader struct {
+	io.Reader
+	remaining int64
+}
+
+func (r *announcedReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.remaining -= int64(n)
+	if err == io.EOF && r.remaining > 0 {
+		return n, errors.Wrapf(errTruncated, "%d bytes missing", r.remaining)
+	}
+	return n, err
+}
+
+// multipartUpload is an in-progress multipart upload created by the driver.
+type multipartUpload struct {
+	bucket   string
+	key      string
+	uploadID string
+	user     string
+	parts    []*s3.CompletedPart
+	size     int64
+	// digest of the uploaded parts, nil if the upload does not start with the first byte of the object
+	digest *digest
+}
+
+// nextPartNumber returns the part number of the next part to upload.
+func (u *multipartUpload) nextPartNumber() int64 {
+	return int64(len(u.parts) + 1)
+}
+
+// pendingUploads keeps track of interrupted multipart uploads which can be resumed by the user who started them.
+// It is shared by all sessions of a DriverFactory, uploads are identified by their bucket and key.
+type pendingUploads struct {
+	lock    sync.Mutex
+	uploads map[string]*multipartUpload
+}
+
+func newPendingUploads() *pendingUploads {
+	return &pendingUploads{uploads: map[string]*multipartUpload{}}
+}
+
+// put registers the interrupted upload `upload` and returns an upload of the same key which was replaced, if any.
+func (p *pendingUploads) put(upload *multipartUpload) *multipartUpload {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	id := upload.bucket + "/" + upload.key
+	replaced := p.uploads[id]
+	p.uploads[id] = upload
+	return replaced
+}
+
+// take removes and returns the interrupted upload of `key` in `bucket` if it was started by `user`.
+func (p *pendingUploads) take(bucket, key, user string) *multipartUpload {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	upload, ok := p.uploads[bucket+"/"+key]
+	if !ok || upload.user != user {
+		return nil
+	}
+	delete(p.uploads, bucket+"/"+key)
+	return upload
+}
+
+// size returns the number of bytes which were already uploaded for the interrupted upload of `key` in `bucket`
+// if it was started by `user`.
+func (p *pendingUploads) size(bucket, key, user string) (int64, bool) {
+	if p == nil {
+		return 0, false
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	upload, ok := p.uploads[bucket+"/"+key]
+	if !ok || upload.user != user {
+		return 0, false
+	}
+	return upload.size, true
+}
+
+// user returns the name of the logged in FTP user.
+func (d *S3Driver) user() string {
+	if d.conn == nil {
+		return ""
+	}
+	user := d.conn.LoginUser()
+	d.takeIdentity(user)
+	return user
+}
+
+// appendObject appends `data` to the object with key `key` and returns the number of bytes appended.
+//
+// There is no append operation for a cloud object storage, thus a new object is built by a multipart upload.
+// An interrupted upload of the same user is continued, otherwise the existing object is copied on the server side
+// (or prepended to the data if it is smaller than the minimum part size) and the data is uploaded as additional parts.
+// Unless `expectedOffset` is negative, the append fails if the size of the existing data differs from it.
+func (d *S3Driver) appendObject(key string, data io.Reader, expectedOffset int64) (int64, error) {
+	fqdn := d.fqdn(key)
+	var upload *multipartUpload
+	// input is the upload request of a new upload, which determines the attributes of the object
+	var input *s3manager.UploadInput
+	if d.pendingUploads != nil {
+		upload = d.pendingUploads.take(d.bucketName, key, d.user())
+	}
+	// offset is the size of the existing data
+	var offset int64
+	if upload != nil {
+		offset = upload.size
+		if expectedOffset >= 0 && offset != expectedOffset {
+			d.pendingUploads.put(upload)
+			return -1, invalidOffset(fqdn, expectedOffset, offset)
+		}
+		logrus.WithFields(logrus.Fields{"key": fqdn, "upload": upload.uploadID, "offset": offset}).Infof("Resuming upload of %q", fqdn)
+	} else {
+		size, err := d.objectSize(key)
+		if err != nil && !isNotFound(err) {
+			return -1, err
+		}
+		exists := err == nil
+		if exists {
+			offset = size
+		}
+		if expectedOffset >= 0 && offset != expectedOffset {
+			return -1, invalidOffset(fqdn, expectedOffset, offset)
+		}
+		if exists && d.preventOverwrite() {
+			return -1, overwriteForbidden(fqdn)
+		}
+
+		input = d.uploadInput(key)
+		upload, err = d.createMultipartUpload(input)
+		if err != nil {
+			return -1, err
+		}
+		if !exists {
+			upload.digest = newDigest()
+		}
+		if exists && size >= uploadPartSize {
+			err = d.copyParts(upload, key, size)
+		} else if exists && size > 0 {
+			var head io.ReadCloser
+			head, err = d.objectReader(key)
+			if err == nil {
+				defer head.Close()
+				data = io.MultiReader(head, data)
+			}
+		}
+		if err != nil {
+			d.abortMultipartUpload(key, upload.uploadID)
+			return -1, err
+		}
+	}
+
+	if err := d.uploadParts(upload, data); err != nil {
+		d.suspendMultipartUpload(upload)
+		return -1, err
+	}
+	if err := d.completeMultipartUpload(upload); err != nil {
+		d.abortMultipartUpload(key, upload.uploadID)
+		return -1, err
+	}
+	if upload.digest != nil {
+		if input == nil {
+			input = d.uploadInput(key)
+		}
+		d.storeDigest(input, upload.digest)
+	}
+	return upload.size - offset, nil
+}
+
+// invalidOffset returns the error of resuming the object `fqdn` of `size` bytes at the offset `offset`.
+func invalidOffset(fqdn string, offset, size int64) error {
+	return fmt.Errorf("invalid offset %d to resume %q, which has %d bytes", offset, fqdn, size)
+}
+
+// appendOffset returns the size of the data to which appendObject appends for the object with key `key`,
+// i.e. the size of an interrupted upload of the user or else of the object, zero if neither exists.
+func (d *S3Driver) appendOffset(key string) (int64, error) {
+	if size, ok := d.pendingUploads.size(d.bucketName, key, d.user()); ok {
+		return size, nil
+	}
+	size, err := d.objectSize(key)
+	if isNotFound(err) {
+		return 0, nil
+	}
+	return size, err
+}
+
+// restOffsetValid returns false if the offset `offset` given by `REST` does not match the size of the existing data of
+// the FTP path `p`, i.e. if the upload to `p` can not be resumed at the offset.
+// It returns true if the size can not be determined or the upload is not permitted, so that PutFile reports the error.
+func (d *S3Driver) restOffsetValid(p string, offset int64) bool {
+	defer d.enterMount(p)()
+	if d.features()&featurePut == 0 || d.isReserved(p) || !d.accessAllowed(featurePut, d.resolvePath(p)) {
+		return true
+	}
+	key, err := d.uploadKey(p, true, time.Now())
+	if err != nil {
+		return true
+	}
+	size, err := d.appendOffset(key)
+	return err != nil || size == offset
+}
+
+// uploadInput returns the upload request for the object with key `key`, with the attributes of the upload rules
+// which do not depend on the size of the object.
+func (d *S3Driver) uploadInput(key string) *s3manager.UploadInput {
+	input := &s3manager.UploadInput{
+		Bucket:               aws.String(d.bucketName),
+		Key:                  aws.String(key),
+		Metadata:             map[string]*string{},
+		ServerSideEncryption: d.sse.serverSide(),
+		SSEKMSKeyId:          d.sse.kmsKey(),
+		SSECustomerAlgorithm: d.sse.customerAlgorithm(),
+		SSECustomerKey:       d.sse.customerKeyValue(),
+		Tagging:              d.objectTags(),
+	}
+	d.setProvenance(input.Metadata)
+	d.applyUploadRules(input, -1)
+	return input
+}
+
+// putObject stores `data` as object with key `key` and returns its size.
+// If no-overwrite is set, the object is only created if it does not exist yet.
+func (d *S3Driver) putObject(key string, data io.Reader) (int64, error) {
+	if d.preventOverwrite() && !d.conditionalWrites {
+		return d.putGuarded(key, data)
+	}
+	if d.pendingUploads != nil && d.encryption == nil {
+		return d.putResumable(key, data)
+	}
+	input := d.uploadInput(key)
+	digest, stored, err := d.uploadObject(input, data)
+	if err != nil {
+		return -1, err
+	}
+	if !stored {
+		d.storeDigest(input, digest)
+	}
+	return digest.size, nil
+}
+
+// uploadObject uploads `data` as the object `input` and returns its digest.
+//
+// The data is hashed while it is streamed to the bucket. Objects which fit into a single part are uploaded
+// with their `Content-MD5` and their digests as metadata (`stored`). Larger objects are uploaded in parts,
+// each with its own checksum, and their digests must be stored afterwards because metadata can only be set
+// when an upload is started.
+// If client-side encryption is enabled, the digests are the ones of the plaintext and the metadata of `input`
+// is extended by the encrypted data key.
+func (d *S3Driver) uploadObject(input *s3manager.UploadInput, data io.Reader) (*digest, bool, error) {
+	key := aws.StringValue(input.Key)
+	digest := newDigest()
+	data = io.TeeReader(sniffContentType(input, data), digest)
+	if d.encryption != nil {
+		var err error
+		data, err = d.encryption.encrypt(data, input.Metadata)
+		if err != nil {
+			return nil, false, errors.Wrapf(err, "Failed to encrypt %q", d.fqdn(key))
+		}
+	}
+	head := make([]byte, uploadPartSize)
+	n, err := io.ReadFull(data, head)
+	complete := err == io.EOF || err == io.ErrUnexpectedEOF
+	if err != nil && !complete {
+		return nil, false, errors.Wrapf(err, "Failed to read data of %q", d.fqdn(key))
+	}
+	if complete {
+		d.applyUploadRules(input, digest.size)
+		digest.setMetadata(input.Metadata)
+		setUploadEnd(input.Metadata)
+		input.ContentMD5 = contentMD5(head[:n])
+		input.Body = bytes.NewReader(head[:n])
+	} else {
+		input.Body = io.MultiReader(bytes.NewReader(head), data)
+	}
+
+	if _, err := d.uploader.Upload(input, s3manager.WithUploaderRequestOptions(d.writeOptions()...)); err != nil {
+		if isPreconditionFailed(err) {
+			return nil, false, overwriteForbidden(d.fqdn(key))
+		}
+		return nil, false, errors.Wrapf(err, "Failed to upload %q", d.fqdn(key))
+	}
+	return digest, complete, nil
+}
+
+// storeDigest adds the digests to the metadata of the uploaded object `input` by replacing it with a copy of itself.
+// The object remains without digests if the copy fails.
+func (d *S3Driver) storeDigest(input *s3manager.UploadInput, digest *digest) {
+	key := aws.StringValue(input.Key)
+	d.applyUploadRules(input, digest.size)
+	digest.setMetadata(input.Metadata)
+	setUploadEnd(input.Metadata)
+	if err := d.copyObject(key, key, d.encryption.ciphertextSize(digest.size), input); err != nil {
+		logrus.WithFields(logrus.Fields{"key": d.fqdn(key), "error": err}).Errorf("Failed to store digests of %q", d.fqdn(key))
+	}
+}
+
+// objectReader returns the contents of the object with key `key`, decrypted if client-side encryption is enabled.
+func (d *S3Driver) objectReader(key string) (io.ReadCloser, error) {
+	if d.encryption != nil {
+		_, body, err := d.getDecrypted(key, 0)
+		return body, err
+	}
+	resp, err := d.s3.GetObject(&s3.GetObjectInput{
+		Bucket:               aws.String(d.bucketName),
+		Key:                  aws.String(key),
+		SSECustomerAlgorithm: d.sse.customerAlgorithm(),
+		SSECustomerKey:       d.sse.customerKeyValue(),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to get object %q", d.fqdn(key))
+	}
+	return resp.Body, nil
+}
+
+// createMultipartUpload starts a new multipart upload for the object `input`.
+func (d *S3Driver) createMultipartUpload(input *s3manager.UploadInput) (*multipartUpload, error) {
+	key := aws.StringValue(input.Key)
+	request := createMultipartUploadInput(input)
+	request.Bucket = input.Bucket
+	request.Key = input.Key
+	resp, err := d.s3.CreateMultipartUpload(request)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to start multipart upload of %q", d.fqdn(key))
+	}
+	return &multipartUpload{
+		bucket:   aws.StringValue(input.Bucket),
+		key:      key,
+		uploadID: aws.StringValue(resp.UploadId),
+		user:     d.user(),
+	}, nil
+}
+
+// copyParts adds the first `size` bytes of the object with key `srcKey` as parts to the upload.
+// No part is smaller than the minimum part size because the upload is continued afterwards.
+func (d *S3Driver) copyParts(upload *multipartUpload, srcKey string, size int64) error {
+	for offset := int64(0); offset < size; {
+		length := copyPartSize
+		if size-offset-length < uploadPartSize {
+			// merge the remainder into this part
+			length = size - offset
+		}
+		partNumber := upload.nextPartNumber()
+		resp, err := d.s3.UploadPartCopy(&s3.UploadPartCopyInput{
+			Bucket:          aws.String(d.bucketName),
+			Key:             aws.String(upload.key),
+			CopySource:      aws.String(d.copySource(srcKey)),
+			CopySourceRange: aws.String(byteRange(offset, length)),
+			PartNumber:      aws.Int64(partNumber),
+			UploadId:        aws.String(upload.uploadID),
+			// the source object and the parts are encrypted with the same key
+			CopySourceSSECustomerAlgorithm: d.sse.customerAlgorithm(),
+			CopySourceSSECustomerKey:       d.sse.customerKeyValue(),
+			SSECustomerAlgorithm:           d.sse.customerAlgorithm(),
+			SSECustomerKey:                 d.sse.customerKeyValue(),
+		})
+		if err != nil {
+			return errors.Wrapf(err, "Failed to copy part %d of %q", partNumber, d.fqdn(srcKey))
+		}
+		upload.parts = append(upload.parts, &s3.CompletedPart{
+			ETag:       resp.CopyPartResult.ETag,
+			PartNumber: aws.Int64(partNumber),
+		})
+		upload.size += length
+		offset += length
+	}
+	return nil
+}
+
+// uploadParts reads `data` until EOF and uploads it in parts of `uploadPartSize` bytes.
+// If reading fails, e.g. because the data connection was interrupted, the incomplete part is discarded,
+// thus all parts of the upload remain of full size and the upload can be continued later on.
+func (d *S3Driver) uploadParts(upload *multipartUpload, data io.Reader) error {
+	buf := make([]byte, uploadPartSize)
+	for {
+		n, err := io.ReadFull(data, buf)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return errors.Wrapf(err, "Failed to read part %d of %q", upload.nextPartNumber(), d.fqdn(upload.key))
+		}
+
+		partNumber := upload.nextPartNumber()
+		resp, uploadErr := d.s3.UploadPart(&s3.UploadPartInput{
+			Bucket:     aws.String(d.bucketName),
+			Key:        aws.String(upload.key),
+			Body:       bytes.NewReader(buf[:n]),
+			PartNumber: aws.Int64(partNumber),
+			UploadId:   aws.String(upload.uploadID),
+			// parts are encrypted with the key of the upload
+			SSECustomerAlgorithm: d.sse.customerAlgorithm(),
+			SSECustomerKey:       d.sse.customerKeyValue(),
+		})
+		if uploadErr != nil {
+			return errors.Wrapf(uploadErr, "Failed to upload part %d of %q", partNumber, d.fqdn(upload.key))
+		}
+		upload.parts = append(upload.parts, &s3.CompletedPart{
+			ETag:       resp.ETag,
+			PartNumber: aws.Int64(partNumber),
+		})
+		upload.size += int64(n)
+		if upload.digest != nil {
+			upload.digest.Write(buf[:n])
+		}
+		if err == io.ErrUnexpectedEOF {
+			return nil
+		}
+	}
+}
+
+// completeMultipartUpload completes the upload, i.e. the object becomes visible.
+// An upload without any part results in an empty object.
+// If no-overwrite is set, the upload is only completed if the object does not exist yet.
+func (d *S3Driver) completeMultipartUpload(upload *multipartUpload) error {
+	if d.preventOverwrite() && !d.conditionalWrites {
+		if err := d.checkNotExists(upload.key); err != nil {
+			return err
+		}
+	}
+	var err error
+	if len(upload.parts) == 0 {
+		d.abortMultipartUpload(upload.key, upload.uploadID)
+		_, err = d.s3.PutObjectWithContext(aws.BackgroundContext(), &s3.PutObjectInput{
+			Bucket:               aws.String(d.bucketName),
+			Key:                  aws.String(upload.key),
+			Body:                 bytes.NewReader(nil),
+			ServerSideEncryption: d.sse.serverSide(),
+			SSEKMSKeyId:          d.sse.kmsKey(),
+			SSECustomerAlgorithm: d.sse.customerAlgorithm(),
+			SSECustomerKey:       d.sse.customerKeyValue(),
+		}, d.writeOptions()...)
+	} else {
+		_, err = d.s3.CompleteMultipartUploadWithContext(aws.BackgroundContext(), &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(d.bucketName),
+			Key:             aws.String(upload.key),
+			UploadId:        aws.String(upload.uploadID),
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: upload.parts},
+		}, d.writeOptions()...)
+	}
+	if isPreconditionFailed(err) {
+		return overwriteForbidden(d.fqdn(upload.key))
+	}
+	return errors.Wrapf(err, "Failed to complete upload of %q", d.fqdn(upload.key))
+}
+
+// suspendMultipartUpload keeps an interrupted upload alive so that it can be resumed by the same user
+// if resumable uploads are enabled, otherwise the upload is aborted.
+func (d *S3Driver) suspendMultipartUpload(upload *multipartUpload) {
+	if d.pendingUploads == nil {
+		d.abortMultipartUpload(upload.key, upload.uploadID)
+		return
+	}
+	logrus.WithFields(logrus.Fields{"key": d.fqdn(upload.key), "upload": upload.uploadID, "size": upload.size}).Infof("Suspended interrupted upload of %q", d.fqdn(upload.key))
+	if replaced := d.pendingUploads.put(upload); replaced != nil {
+		d.abortMultipartUpload(replaced.key, replaced.uploadID)
+	}
+}
+
+// putResumable stores `data` as object with key `key` with a multipart upload which is suspended if it gets interrupted.
+// Data which fits into a single part is uploaded as a whole instead, there is nothing to resume if its transfer fails.
+func (d *S3Driver) putResumable(key string, data io.Reader) (int64, error) {
+	input := d.uploadInput(key)
+	head := make([]byte, uploadPartSize)
+	n, err := io.ReadFull(data, head)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		digest, _, err := d.uploadObject(input, bytes.NewReader(head[:n]))
+		if err != nil {
+			return -1, err
+		}
+		return digest.size, nil
+	}
+	if err != nil {
+		return -1, errors.Wrapf(err, "Failed to read data of %q", d.fqdn(key))
+	}
+	data = sniffContentType(input, io.MultiReader(bytes.NewReader(head), data))
+	upload, err := d.createMultipartUpload(input)
+	if err != nil {
+		return -1, err
+	}
+	upload.digest = newDigest()
+	if err := d.uploadParts(upload, data); err != nil {
+		d.suspendMultipartUpload(upload)
+		return -1, err
+	}
+	if err := d.completeMultipartUpload(upload); err != nil {
+		d.abortMultipartUpload(key, upload.uploadID)
+		return -1, err
+	}
+	d.storeDigest(input, upload.digest)
+	return upload.size, nil
+}
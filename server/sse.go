@@ -0,0 +1,123 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+const (
+	// SSEBucketDefault leaves the encryption of uploaded objects to the bucket's default encryption.
+	SSEBucketDefault = ""
+	// SSES3 encrypts uploaded objects with keys managed by s3.
+	SSES3 = "SSE-S3"
+	// SSEKMS encrypts uploaded objects with a key managed by the AWS Key Management Service.
+	SSEKMS = "SSE-KMS"
+	// SSEC encrypts objects with a key provided by the customer, which must be sent along with every request.
+	SSEC = "SSE-C"
+)
+
+// keySize is the size of SSE-C keys and the master key of the client-side encryption (AES-256).
+const keySize = 32
+
+// serverSideEncryption holds the settings of the server-side encryption of the objects which are written by the driver.
+// A nil value leaves the encryption to the bucket's defaults.
+type serverSideEncryption struct {
+	// algorithm is the value of `x-amz-server-side-encryption`, empty for SSE-C
+	algorithm string
+	kmsKeyID  string
+	// customerKey is the raw SSE-C key, the SDK encodes it and adds its MD5 digest
+	customerKey string
+}
+
+// newServerSideEncryption returns the encryption settings for mode `mode` (one of SSES3, SSEKMS and SSEC).
+// The KMS key ID is optional for SSE-KMS, the default key of the account is used if it is empty.
+// The SSE-C key is read from `customerKeyFile` which contains the key as 32 raw bytes or base64 encoded.
+func newServerSideEncryption(mode, kmsKeyID, customerKeyFile string) (*serverSideEncryption, error) {
+	switch strings.ToUpper(mode) {
+	case SSEBucketDefault:
+		if kmsKeyID != "" || customerKeyFile != "" {
+			return nil, fmt.Errorf("encryption keys require a server-side encryption mode")
+		}
+		return nil, nil
+	case SSES3:
+		if kmsKeyID != "" || customerKeyFile != "" {
+			return nil, fmt.Errorf("%s does not use a KMS key or customer key", SSES3)
+		}
+		return &serverSideEncryption{algorithm: s3.ServerSideEncryptionAes256}, nil
+	case SSEKMS:
+		if customerKeyFile != "" {
+			return nil, fmt.Errorf("%s does not use a customer key", SSEKMS)
+		}
+		return &serverSideEncryption{algorithm: s3.ServerSideEncryptionAwsKms, kmsKeyID: kmsKeyID}, nil
+	case SSEC:
+		if kmsKeyID != "" {
+			return nil, fmt.Errorf("%s does not use a KMS key", SSEC)
+		}
+		if customerKeyFile == "" {
+			return nil, fmt.Errorf("%s requires a customer key file", SSEC)
+		}
+		key, err := readKeyFile(customerKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &serverSideEncryption{customerKey: string(key)}, nil
+	default:
+		return nil, fmt.Errorf("Unknown server-side encryption %q, expected one of %s, %s and %s", mode, SSES3, SSEKMS, SSEC)
+	}
+}
+
+// readKeyFile reads a 256 bit key from `filename`, which contains the key as 32 raw bytes or base64 encoded.
+// The key is not part of any error message.
+func readKeyFile(filename string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read key file %q", filename)
+	}
+	if len(data) == keySize {
+		return data, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil || len(key) != keySize {
+		return nil, fmt.Errorf("key file %q must contain a %d byte key, either raw or base64 encoded", filename, keySize)
+	}
+	return key, nil
+}
+
+// serverSide returns the value of `x-amz-server-side-encryption` for written objects.
+func (e *serverSideEncryption) serverSide() *string {
+	if e == nil || e.algorithm == "" {
+		return nil
+	}
+	return aws.String(e.algorithm)
+}
+
+// kmsKey returns the ID of the KMS key for written objects.
+func (e *serverSideEncryption) kmsKey() *string {
+	if e == nil || e.kmsKeyID == "" {
+		return nil
+	}
+	return aws.String(e.kmsKeyID)
+}
+
+// customerAlgorithm returns the SSE-C algorithm which must be sent along with every request of an object.
+func (e *serverSideEncryption) customerAlgorithm() *string {
+	if e == nil || e.customerKey == "" {
+		return nil
+	}
+	return aws.String(s3.ServerSideEncryptionAes256)
+}
+
+// customerKeyValue returns the SSE-C key which must be sent along with every request of an object.
+func (e *serverSideEncryption) customerKeyValue() *string {
+	if e == nil || e.customerKey == "" {
+		return nil
+	}
+	return aws.String(e.customerKey)
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/sirupsen/logrus"
+)
+
+func TestNewServerSideEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "f3-sse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key := "0123456789abcdef0123456789abcdef"
+	keyFiles := map[string]string{
+		"raw":    key,
+		"base64": base64.StdEncoding.EncodeToString([]byte(key)) + "\n",
+		"short":  "0123456789",
+	}
+	for name, contents := range keyFiles {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, testData := range []struct {
+		mode, kmsKeyID, keyFile string
+		expected                *serverSideEncryption
+		fails                   bool
+	}{
+		{"", "", "", nil, false},
+		{"sse-s3", "", "", &serverSideEncryption{algorithm: s3.ServerSideEncryptionAes256}, false},
+		{"SSE-KMS", "", "", &serverSideEncryption{algorithm: s3.ServerSideEncryptionAwsKms}, false},
+		{"SSE-KMS", "my-key", "", &serverSideEncryption{algorithm: s3.ServerSideEncryptionAwsKms, kmsKeyID: "my-key"}, false},
+		{"SSE-C", "", "raw", &serverSideEncryption{customerKey: key}, false},
+		{"SSE-C", "", "base64", &serverSideEncryption{customerKey: key}, false},
+		{"SSE-C", "", "short", nil, true},
+		{"SSE-C", "", "missing", nil, true},
+		{"SSE-C", "", "", nil, true},
+		{"SSE-C", "my-key", "raw", nil, true},
+		{"SSE-S3", "my-key", "", nil, true},
+		{"", "my-key", "", nil, true},
+		{"AES", "", "", nil, true},
+	} {
+		keyFile := testData.keyFile
+		if keyFile != "" {
+			keyFile = filepath.Join(dir, keyFile)
+		}
+		sse, err := newServerSideEncryption(testData.mode, testData.kmsKeyID, keyFile)
+		if testData.fails {
+			if err == nil {
+				t.Errorf("%+v: expected an error", testData)
+			} else if strings.Contains(err.Error(), key) {
+				t.Errorf("%+v: error reveals the key: %s", testData, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: %s", testData, err)
+			continue
+		}
+		if fmt.Sprint(sse) != fmt.Sprint(testData.expected) {
+			t.Errorf("%+v: expected %+v but was %+v", testData, testData.expected, sse)
+		}
+	}
+}
+
+func TestServerSideEncryption(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	defer func(partSize, copySize, maxCopySize int64) {
+		uploadPartSize, copyPartSize, maxCopyObjectSize = partSize, copySize, maxCopySize
+	}(uploadPartSize, copyPartSize, maxCopyObjectSize)
+	uploadPartSize, copyPartSize, maxCopyObjectSize = 4, 6, 10
+
+	customerKey := "0123456789abcdef0123456789abcdef"
+	for _, sse := range []*serverSideEncryption{
+		{algorithm: s3.ServerSideEncryptionAwsKms, kmsKeyID: "my-key"},
+		{customerKey: customerKey},
+	} {
+		bucketName := "test-bucket"
+		bucketMock := newBucketMock(bucketName)
+		d := S3Driver{
+			featureFlags: featurePut | featureGet | featureMove | featureMakeDir,
+			sse:          sse,
+			s3:           &s3Mock{bucket: bucketMock},
+			uploader:     &s3UploaderMock{bucket: bucketMock},
+			metrics:      metricsSenderMock{},
+			bucketName:   bucketName,
+			bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+		}
+
+		steps := []struct {
+			description string
+			run         func() error
+		}{
+			{"put small object", func() error { _, err := d.PutFile("small.txt", strings.NewReader("abc"), false); return err }},
+			{"put large object", func() error {
+				_, err := d.PutFile("large.txt", strings.NewReader("0123456789abcdef"), false)
+				return err
+			}},
+			{"append", func() error { _, err := d.PutFile("small.txt", strings.NewReader("defghij"), true); return err }},
+			{"rename", func() error { return d.Rename("small.txt", "renamed.txt") }},
+			{"rename large object", func() error { return d.Rename("large.txt", "renamed-large.txt") }},
+			{"make directory", func() error { return d.MakeDir("dir") }},
+			{"rename directory", func() error { return d.Rename("dir", "other-dir") }},
+			{"stat", func() error { _, err := d.Stat("renamed.txt"); return err }},
+			{"hash", func() error { _, _, err := d.Hash("renamed-large.txt", hashSHA256); return err }},
+			{"get", func() error {
+				_, body, err := d.GetFile("renamed-large.txt", 3)
+				if err != nil {
+					return err
+				}
+				data, _ := ioutil.ReadAll(body)
+				if string(data) != "3456789abcdef" {
+					return fmt.Errorf("unexpected contents %q", data)
+				}
+				return nil
+			}},
+		}
+		for _, step := range steps {
+			if err := step.run(); err != nil {
+				t.Errorf("%+v: %s failed: %s", sse, step.description, err)
+			}
+		}
+		for key, object := range bucketMock.List() {
+			if object.encryption != sse.algorithm || object.customerKey != sse.customerKey {
+				t.Errorf("%+v: object %q is not encrypted as requested: %q, %q", sse, key, object.encryption, object.customerKey)
+			}
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// trashPrefix is the prefix of the objects deleted by users if soft delete is enabled, see trashKey
+	trashPrefix = ".trash/"
+	// metadataOriginalKey is the key of a deleted object
+	metadataOriginalKey = "f3-original-key"
+)
+
+// trashKey returns the key of the deleted object with key `key` in the trash, i.e. `.trash/<date>/<user>/<key>`.
+// The user name is escaped, so that the trash directories of users never overlap.
+func trashKey(key, user string, now time.Time) string {
+	return trashPrefix + now.UTC().Format("2006-01-02") + "/" + url.PathEscape(user) + "/" + key
+}
+
+// copyAttributes returns the attributes which keep the metadata and headers of the object described by `head` in a copy.
+func (d *S3Driver) copyAttributes(head *s3.HeadObjectOutput) *s3manager.UploadInput {
+	metadata := map[string]*string{}
+	for name, value := range head.Metadata {
+		metadata[strings.ToLower(name)] = value
+	}
+	return &s3manager.UploadInput{
+		Metadata:             metadata,
+		CacheControl:         head.CacheControl,
+		ContentDisposition:   head.ContentDisposition,
+		ContentEncoding:      head.ContentEncoding,
+		ContentLanguage:      head.ContentLanguage,
+		ContentType:          head.ContentType,
+		StorageClass:         head.StorageClass,
+		ServerSideEncryption: d.sse.serverSide(),
+		SSEKMSKeyId:          d.sse.kmsKey(),
+		SSECustomerAlgorithm: d.sse.customerAlgorithm(),
+		SSECustomerKey:       d.sse.customerKeyValue(),
+	}
+}
+
+// headObject returns the metadata and headers of the object with key `key`.
+func (d *S3Driver) headObject(key string) (*s3.HeadObjectOutput, error) {
+	return d.s3.HeadObject(&s3.HeadObjectInput{
+		Bucket:               aws.String(d.bucketName),
+		Key:                  aws.String(key),
+		SSECustomerAlgorithm: d.sse.customerAlgorithm(),
+		SSECustomerKey:       d.sse.customerKeyValue(),
+	})
+}
+
+// trashObject moves the object with key `key` to the logged in user's trash directory of today.
+// The original key is stored in the metadata of the deleted object.
+func (d *S3Driver) trashObject(key string) error {
+	head, err := d.headObject(key)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to get object %q", d.fqdn(key))
+	}
+	attributes := d.copyAttributes(head)
+	attributes.Metadata[metadataOriginalKey] = aws.String(url.PathEscape(key))
+	return d.moveObject(key, trashKey(key, d.user(), time.Now()), aws.Int64Value(head.ContentLength), attributes)
+}
+
+// trashObjects moves the objects located under `prefix` to the logged in user's trash directory of today.
+// Directory markers are deleted, restoring the files below them restores the directories as well.
+func (d *S3Driver) trashObjects(prefix string) error {
+	keys := []string{}
+	markers := []*s3.ObjectIdentifier{}
+	err := d.walkPrefix(prefix, "", func(page *s3.ListObjectsV2Output) error {
+		for _, object := range page.Contents {
+			if key := aws.StringValue(object.Key); strings.HasSuffix(key, "/") {
+				markers = append(markers, &s3.ObjectIdentifier{Key: object.Key})
+			} else {
+				keys = append(keys, key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to list %q", d.fqdn(prefix))
+	}
+	for _, key := range keys {
+		if err := d.trashObject(key); err != nil {
+			return err
+		}
+	}
+	for len(markers) > 0 {
+		batch := markers
+		if len(batch) > deleteBatchSize {
+			batch = batch[:deleteBatchSize]
+		}
+		if err := d.deleteObjects(batch); err != nil {
+			return err
+		}
+		markers = markers[len(batch):]
+	}
+	return nil
+}
+
+// Restore moves the object located at `path`, which was deleted by the logged in user, back from the trash.
+// If the object was deleted several times, the most recently deleted version is restored.
+func (d *S3Driver) Restore(path string) error {
+	defer d.enterMount(path)()
+	if !d.softDelete {
+		return notEnabled("RESTORE")
+	}
+	if d.features()&featurePut == 0 {
+		return notEnabled("PUT")
+	}
+	if err := d.checkAccess(featurePut, path); err != nil {
+		return err
+	}
+	if d.isRoot(path) {
+		return fmt.Errorf("can not restore the root directory")
+	}
+
+	key := d.objectKey(path)
+	fqdn := d.fqdn(key)
+	dates := []string{}
+	err := d.walkPrefix(trashPrefix, "/", func(page *s3.ListObjectsV2Output) error {
+		for _, commonPrefix := range page.CommonPrefixes {
+			dates = append(dates, aws.StringValue(commonPrefix.Prefix))
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to list the trash of %q", d.bucketURL)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dates)))
+	for _, date := range dates {
+		srcKey := date + url.PathEscape(d.user()) + "/" + key
+		head, err := d.headObject(srcKey)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Failed to get object %q", d.fqdn(srcKey))
+		}
+
+		if d.preventOverwrite() {
+			if !d.reservations.reserve(key) {
+				return fmt.Errorf("%q is being written by another session", fqdn)
+			}
+			defer d.reservations.release(key)
+			if err := d.checkNotExists(key); err != nil {
+				return err
+			}
+		}
+		attributes := d.copyAttributes(head)
+		delete(attributes.Metadata, metadataOriginalKey)
+		if err := d.moveObject(srcKey, key, aws.Int64Value(head.ContentLength), attributes, d.writeOptions()...); err != nil {
+			logrus.WithFields(logrus.Fields{"time": time.Now(), "key": fqdn, "action": "RESTORE", "error": err}).Errorf("Failed to restore %q", fqdn)
+			return err
+		}
+		d.forgetUpload(path)
+		logrus.WithFields(logrus.Fields{"time": time.Now(), "key": fqdn, "action": "RESTORE"}).Infof("Restored %q from %q", fqdn, d.fqdn(srcKey))
+		return nil
+	}
+	return fmt.Errorf("%q: not in the trash", d.resolvePath(path))
+}
+
+// purgeTrash deletes the objects in the trash which were deleted before `before` and returns their number.
+// Objects are only listed if `dryRun` is set.
+func (d *S3Driver) purgeTrash(before time.Time, dryRun bool) (int, error) {
+	count, err := d.deleteObjectsBefore(trashPrefix, before, dryRun)
+	if err != nil {
+		return count, errors.Wrapf(err, "Failed to purge the trash of %q", d.bucketURL)
+	}
+	return count, nil
+}
+
+// deleteObjectsBefore deletes the objects located under `prefix` which were last modified before `before`
+// and returns their number. Objects are only listed if `dryRun` is set.
+func (d *S3Driver) deleteObjectsBefore(prefix string, before time.Time, dryRun bool) (int, error) {
+	count := 0
+	batch := []*s3.ObjectIdentifier{}
+	err := d.walkPrefix(prefix, "", func(page *s3.ListObjectsV2Output) error {
+		for _, object := range page.Contents {
+			if !aws.TimeValue(object.LastModified).Before(before) {
+				continue
+			}
+			fields := logrus.Fields{"key": d.fqdn(aws.StringValue(object.Key)), "modified": aws.TimeValue(object.LastModified)}
+			if dryRun {
+				logrus.WithFields(fields).Infof("Found %q", d.fqdn(aws.StringValue(object.Key)))
+				count++
+				continue
+			}
+			batch = append(batch, &s3.ObjectIdentifier{Key: object.Key})
+			if len(batch) == deleteBatchSize {
+				if err := d.deleteObjects(batch); err != nil {
+					return err
+				}
+				count += len(batch)
+				batch = batch[:0]
+			}
+		}
+		return nil
+	})
+	if err == nil && len(batch) > 0 {
+		if err = d.deleteObjects(batch); err == nil {
+			count += len(batch)
+		}
+	}
+	return count, err
+}
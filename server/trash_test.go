@@ -0,0 +1,192 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/sirupsen/logrus"
+)
+
+func TestTrashKey(t *testing.T) {
+	now := time.Date(2019, 3, 4, 23, 30, 0, 0, time.FixedZone("UTC-2", -2*60*60))
+	for _, testData := range []struct {
+		key, user, expected string
+	}{
+		{"alice/report.pdf", "alice", ".trash/2019-03-05/alice/alice/report.pdf"},
+		{"b/x", "a", ".trash/2019-03-05/a/b/x"},
+		{"x", "a/b", ".trash/2019-03-05/a%2Fb/x"},
+	} {
+		if actual := trashKey(testData.key, testData.user, now); actual != testData.expected {
+			t.Errorf("Expected trash key %q but was %q", testData.expected, actual)
+		}
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucket := newBucketMock(bucketName)
+	bucket.Put("alice/report.csv", objectMock{
+		data:     []byte("a,b"),
+		lastMod:  time.Now(),
+		etag:     "report",
+		metadata: map[string]*string{metadataUser: aws.String("alice")},
+		headers:  objectHeaders{contentType: "text/csv", cacheControl: "no-cache"},
+	})
+	config := &Config{Users: map[string]UserConfig{"bob": {Home: "alice/"}, "admin": {Home: "/"}}}
+	credentials, err := AuthenticatorFromString("alice:secret\nbob:secret\nadmin:secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := startFTPServer(t, func() *S3Driver {
+		return &S3Driver{
+			featureFlags:       featureList | featureGet | featurePut | featureRemove | featureRemoveDir,
+			softDelete:         true,
+			recursiveRemoveDir: true,
+			noOverwrite:        true,
+			reservations:       newKeyReservations(),
+			config:             config,
+			homeTemplate:       DefaultHome,
+			s3:                 &s3Mock{bucket: bucket},
+			uploader:           &s3UploaderMock{bucket: bucket},
+			metrics:            metricsSenderMock{},
+			bucketName:         bucketName,
+			bucketURL:          intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+		}
+	}, credentials)
+
+	alice := dialFTP(t, addr, "alice", "secret")
+	alice.expect(250, "DELE report.csv")
+	if _, err := bucket.Get("alice/report.csv"); err == nil {
+		t.Errorf("Expected the deleted file to be gone")
+	}
+	trashed, err := bucket.Get(trashKey("alice/report.csv", "alice", time.Now()))
+	if err != nil {
+		t.Fatalf("Expected the deleted file to be in the trash: %s", err)
+	}
+	if original := metadataValue(trashed.metadata, metadataOriginalKey); original != "alice%2Freport.csv" {
+		t.Errorf("Expected the original key in the metadata but was %q", original)
+	}
+	if listing, _ := alice.retrieve("LIST /"); listing != "" {
+		t.Errorf("Expected an empty directory but was %q", listing)
+	}
+
+	bob := dialFTP(t, addr, "bob", "secret")
+	bob.expect(550, "SITE RESTORE report.csv")
+	alice.expect(501, "SITE RESTORE")
+	alice.expect(550, "SITE RESTORE other.csv")
+	alice.expect(200, "SITE RESTORE /report.csv")
+	restored, err := bucket.Get("alice/report.csv")
+	if err != nil {
+		t.Fatalf("Expected the file to be restored: %s", err)
+	}
+	if string(restored.data) != "a,b" || restored.headers.contentType != "text/csv" || restored.headers.cacheControl != "no-cache" {
+		t.Errorf("Expected the file to be restored with its headers but was %q %+v", restored.data, restored.headers)
+	}
+	if metadataValue(restored.metadata, metadataUser) != "alice" || metadataValue(restored.metadata, metadataOriginalKey) != "" {
+		t.Errorf("Expected the metadata of the file to be restored but was %v", restored.metadata)
+	}
+	alice.expect(550, "SITE RESTORE report.csv")
+
+	alice.expect(250, "DELE report.csv")
+	if code := alice.store("new", "STOR report.csv"); code != 226 {
+		t.Fatalf("Upload failed with %d", code)
+	}
+	alice.expect(550, "SITE RESTORE report.csv")
+	if object, _ := bucket.Get("alice/report.csv"); string(object.data) != "new" {
+		t.Errorf("Expected the restore not to overwrite the new file but was %q", object.data)
+	}
+
+	for _, key := range []string{"alice/dir/", "alice/dir/a.txt", "alice/dir/sub/", "alice/dir/sub/b.txt"} {
+		bucket.Put(key, objectMock{data: []byte(key), lastMod: time.Now(), etag: key})
+	}
+	alice.expect(250, "RMD dir")
+	for key := range bucket.List() {
+		if strings.HasPrefix(key, "alice/dir/") {
+			t.Errorf("Expected %q to be removed with its directory", key)
+		}
+	}
+	for _, key := range []string{"alice/dir/a.txt", "alice/dir/sub/b.txt"} {
+		if _, err := bucket.Get(trashKey(key, "alice", time.Now())); err != nil {
+			t.Errorf("Expected %q to be in the trash: %s", key, err)
+		}
+	}
+
+	// the trash and temporary objects are inaccessible even for users whose home is the root of the bucket
+	bucket.Put(temporaryPrefix+"upload", objectMock{data: []byte("upload"), lastMod: time.Now(), etag: "upload"})
+	trashedKey := trashKey("alice/dir/a.txt", "alice", time.Now())
+	admin := dialFTP(t, addr, "admin", "secret")
+	if listing, code := admin.retrieve("LIST /"); code != 226 || strings.Contains(listing, ".trash") || strings.Contains(listing, temporaryPrefix) {
+		t.Errorf("Expected the reserved directories not to be listed but was %d %q", code, listing)
+	}
+	if _, code := admin.retrieve("LIST /.trash"); code == 226 {
+		t.Errorf("Expected the trash not to be listed")
+	}
+	if _, code := admin.retrieve("RETR /" + trashedKey); code == 226 {
+		t.Errorf("Expected files in the trash not to be downloaded")
+	}
+	if _, code := admin.retrieve("RETR /" + temporaryPrefix + "upload"); code == 226 {
+		t.Errorf("Expected temporary objects not to be downloaded")
+	}
+	if code := admin.store("data", "STOR /.trash/new.txt"); code == 226 {
+		t.Errorf("Expected uploads to the trash to be denied")
+	}
+	admin.expect(450, "SIZE /"+trashedKey)
+	admin.expect(550, "CWD /.trash")
+	admin.expect(550, "DELE /"+trashedKey)
+	admin.expect(550, "RMD /.trash")
+	if _, err := bucket.Get(trashedKey); err != nil {
+		t.Errorf("Expected the file in the trash to be kept: %s", err)
+	}
+
+	alice.expect(200, "SITE RESTORE dir/sub/b.txt")
+	if listing, _ := alice.retrieve("LIST dir"); !strings.Contains(listing, "sub") {
+		t.Errorf("Expected the restored file to restore its directory but was %q", listing)
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucket := newBucketMock(bucketName)
+	now := time.Now()
+	for key, age := range map[string]time.Duration{
+		"alice/file.txt":                   90 * 24 * time.Hour,
+		".trash/2019-01-01/alice/old.txt":  90 * 24 * time.Hour,
+		".trash/2019-01-01/bob/old.txt":    31 * 24 * time.Hour,
+		".trash/2019-03-01/alice/new.txt":  2 * 24 * time.Hour,
+		".trash/2019-03-02/alice/new2.txt": time.Hour,
+	} {
+		bucket.Put(key, objectMock{data: []byte(key), lastMod: now.Add(-age), etag: key})
+	}
+	d := &S3Driver{
+		s3:         &s3Mock{bucket: bucket},
+		bucketName: bucketName,
+		bucketURL:  intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+
+	count, err := d.purgeTrash(now.Add(-30*24*time.Hour), true)
+	if err != nil || count != 2 {
+		t.Errorf("Expected to find 2 files but found %d: %v", count, err)
+	}
+	if len(bucket.List()) != 5 {
+		t.Errorf("Expected a dry run not to delete anything")
+	}
+	count, err = d.purgeTrash(now.Add(-30*24*time.Hour), false)
+	if err != nil || count != 2 {
+		t.Errorf("Expected to purge 2 files but purged %d: %v", count, err)
+	}
+	keys := []string{}
+	for key := range bucket.List() {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if expected := []string{".trash/2019-03-01/alice/new.txt", ".trash/2019-03-02/alice/new2.txt", "alice/file.txt"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected %v to remain but were %v", expected, strings.Join(keys, ", "))
+	}
+}